@@ -5,6 +5,7 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -323,3 +324,91 @@ func rng() *mathutil.FC32 {
 
 	return x
 }
+
+// allocLimit is a Storage failing every allocation after the first n ones.
+type allocLimit struct {
+	Storage
+	n int
+}
+
+func (s *allocLimit) allow() error {
+	if s.n == 0 {
+		return fmt.Errorf("allocation limit reached")
+	}
+
+	s.n--
+	return nil
+}
+
+func (s *allocLimit) Alloc(size int64) (int64, error) {
+	if err := s.allow(); err != nil {
+		return 0, err
+	}
+
+	return s.Storage.Alloc(size)
+}
+
+func (s *allocLimit) Calloc(size int64) (int64, error) {
+	if err := s.allow(); err != nil {
+		return 0, err
+	}
+
+	return s.Storage.Calloc(size)
+}
+
+func (s *allocLimit) Realloc(off, size int64) (int64, error) {
+	if err := s.allow(); err != nil {
+		return 0, err
+	}
+
+	return s.Storage.Realloc(off, size)
+}
+
+// ioLimit is a Storage failing every read after the first r ones and every
+// write after the first w ones. A negative limit does not restrict.
+type ioLimit struct {
+	Storage
+	r, w int
+}
+
+func (s *ioLimit) ReadAt(b []byte, off int64) (int, error) {
+	if s.r == 0 {
+		return 0, fmt.Errorf("read limit reached")
+	}
+
+	s.r--
+	return s.Storage.ReadAt(b, off)
+}
+
+func (s *ioLimit) WriteAt(b []byte, off int64) (int, error) {
+	if s.w == 0 {
+		return 0, fmt.Errorf("write limit reached")
+	}
+
+	s.w--
+	return s.Storage.WriteAt(b, off)
+}
+
+// writeFault is a Storage failing a single write, the first write of b if b is
+// not nil or the write after the first w ones otherwise.
+type writeFault struct {
+	Storage
+	b []byte
+	w int
+}
+
+func (s *writeFault) WriteAt(b []byte, off int64) (int, error) {
+	switch {
+	case s.b != nil:
+		if bytes.Equal(b, s.b) {
+			s.b, s.w = nil, -1
+			return 0, fmt.Errorf("write failed")
+		}
+	case s.w == 0:
+		s.w = -1
+		return 0, fmt.Errorf("write failed")
+	case s.w > 0:
+		s.w--
+	}
+	return s.Storage.WriteAt(b, off)
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/cznic/mathutil"
+)
+
+const (
+	arrayPage = 4096 // Preferred size of an Array page in bytes.
+)
+
+const (
+	oArrayLen      = 8 * iota // int64		0	8
+	oArrayElemSize            // int64		8	8
+	oArrayPerPage             // int64		16	8
+	oArrayDir                 // int64		24	8
+	oArrayDirCap              // int64		32	8
+
+	szArray
+)
+
+// Array is a persistent, growable array of fixed size elements. The elements
+// are stored in fixed size pages, which never move, and the offsets of the
+// pages are kept in a directory block. Appending an element needs at most a
+// page allocation and, when the directory is full, a Realloc of the
+// directory, which doubles its capacity. The offset of an element is stable
+// while the element is in the array.
+type Array struct {
+	*DB
+	Off      int64 // Location in the database.
+	ElemSize int64 // The elemSize argument of NewArray.
+	perPage  int64
+}
+
+// NewArray allocates and returns a new, empty Array or an error, if any. The
+// elemSize argument is the size of the Array elements, it must be positive.
+func (db *DB) NewArray(elemSize int64) (*Array, error) {
+	if elemSize <= 0 {
+		panic(fmt.Errorf("%T.NewArray: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szArray)
+	if err != nil {
+		return nil, err
+	}
+
+	perPage := mathutil.MaxInt64(arrayPage/elemSize, 1)
+	if err := db.w8(off+oArrayElemSize, elemSize); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oArrayPerPage, perPage); err != nil {
+		return nil, err
+	}
+
+	return &Array{DB: db, Off: off, ElemSize: elemSize, perPage: perPage}, nil
+}
+
+// OpenArray opens and returns an existing Array or an error, if any.
+func (db *DB) OpenArray(off int64) (*Array, error) {
+	elemSize, err := db.r8(off + oArrayElemSize)
+	if err != nil {
+		return nil, err
+	}
+
+	perPage, err := db.r8(off + oArrayPerPage)
+	if err != nil {
+		return nil, err
+	}
+
+	if elemSize <= 0 || perPage <= 0 {
+		return nil, fmt.Errorf("%T.OpenArray: corrupted database", db)
+	}
+
+	return &Array{DB: db, Off: off, ElemSize: elemSize, perPage: perPage}, nil
+}
+
+func (a *Array) pages(n int64) int64 { return (n + a.perPage - 1) / a.perPage }
+
+// resize changes the length of a from n to m elements, allocating or freeing
+// pages as needed. Added elements in new pages are zeroed.
+func (a *Array) resize(n, m int64) error {
+	pn, pm := a.pages(n), a.pages(m)
+	dir, err := a.r8(a.Off + oArrayDir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pm < pn:
+		for i := pm; i < pn; i++ {
+			p, err := a.r8(dir + 8*i)
+			if err != nil {
+				return err
+			}
+
+			if err := a.Free(p); err != nil {
+				return err
+			}
+		}
+
+		if pm == 0 {
+			if err := a.Free(dir); err != nil {
+				return err
+			}
+
+			if err := a.w8(a.Off+oArrayDir, 0); err != nil {
+				return err
+			}
+
+			if err := a.w8(a.Off+oArrayDirCap, 0); err != nil {
+				return err
+			}
+		}
+	case pm > pn:
+		c, err := a.r8(a.Off + oArrayDirCap)
+		if err != nil {
+			return err
+		}
+
+		if pm > c {
+			for c = mathutil.MaxInt64(c, 1); c < pm; {
+				c *= 2
+			}
+			switch {
+			case dir == 0:
+				dir, err = a.Alloc(8 * c)
+			default:
+				dir, err = a.Realloc(dir, 8*c)
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := a.w8(a.Off+oArrayDir, dir); err != nil {
+				return err
+			}
+
+			if err := a.w8(a.Off+oArrayDirCap, c); err != nil {
+				return err
+			}
+		}
+
+		for i := pn; i < pm; i++ {
+			p, err := a.Calloc(a.perPage * a.ElemSize)
+			if err != nil {
+				return err
+			}
+
+			if err := a.w8(dir+8*i, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return a.w8(a.Off+oArrayLen, m)
+}
+
+func (a *Array) at(dir, i int64) (int64, error) {
+	p, err := a.r8(dir + 8*(i/a.perPage))
+	if err != nil {
+		return 0, err
+	}
+
+	return p + a.ElemSize*(i%a.perPage), nil
+}
+
+// Append adds an element with value v to the end of a and returns its index
+// or an error, if any. The length of v must be equal to ElemSize.
+func (a *Array) Append(v []byte) (int64, error) {
+	if int64(len(v)) != a.ElemSize {
+		panic(fmt.Errorf("%T.Append: invalid argument", a))
+	}
+
+	n, err := a.Len()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := a.resize(n, n+1); err != nil {
+		return 0, err
+	}
+
+	return n, a.Set(n, v)
+}
+
+// At returns the offset of the element at index i or an error, if any.
+func (a *Array) At(i int64) (int64, error) {
+	n, err := a.Len()
+	if err != nil {
+		return 0, err
+	}
+
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("%T.At: index %v out of range [0, %v)", a, i, n)
+	}
+
+	dir, err := a.r8(a.Off + oArrayDir)
+	if err != nil {
+		return 0, err
+	}
+
+	return a.at(dir, i)
+}
+
+// Len returns the number of elements in a or an error, if any.
+func (a *Array) Len() (int64, error) { return a.r8(a.Off + oArrayLen) }
+
+// Remove frees all space used by a.
+func (a *Array) Remove() error {
+	if err := a.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := a.Free(a.Off); err != nil {
+		return err
+	}
+
+	a.Off = 0
+	return nil
+}
+
+// Set sets the value of the element at index i to v. The length of v must be
+// equal to ElemSize.
+func (a *Array) Set(i int64, v []byte) error {
+	if int64(len(v)) != a.ElemSize {
+		panic(fmt.Errorf("%T.Set: invalid argument", a))
+	}
+
+	off, err := a.At(i)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.WriteAt(v, off)
+	return err
+}
+
+// Truncate changes the length of a to n. Pages past the new length are freed.
+// Elements added by extending a are zeroed.
+func (a *Array) Truncate(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("%T.Truncate: invalid length %v", a, n)
+	}
+
+	m, err := a.Len()
+	if err != nil {
+		return err
+	}
+
+	if n == m {
+		return nil
+	}
+
+	if err := a.resize(m, n); err != nil {
+		return err
+	}
+
+	// Added elements in the formerly last page may hold stale data.
+	if end := mathutil.MinInt64(a.pages(m)*a.perPage, n); end > m {
+		off, err := a.At(m)
+		if err != nil {
+			return err
+		}
+
+		if _, err := a.WriteAt(make([]byte, (end-m)*a.ElemSize), off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func (a *Array) verify(tb testing.TB, e [][]byte) {
+	n, err := a.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(e)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	b := make([]byte, a.ElemSize)
+	for i, v := range e {
+		off, err := a.At(int64(i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if _, err := a.ReadAt(b, off); err != nil {
+			tb.Fatal(err)
+		}
+
+		if !bytes.Equal(b, v) {
+			tb.Fatalf("element %v: got %x, expected %x", i, b, v)
+		}
+	}
+
+	if _, err := a.At(n); err == nil {
+		tb.Fatal("expected error")
+	}
+}
+
+func testArray(t *testing.T, ts func(t testing.TB) (file.File, func()), elemSize int64, n int) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	a, err := db.NewArray(elemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := a.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	val := func(v int) []byte {
+		b := make([]byte, elemSize)
+		for i := range b {
+			b[i] = byte(v + i)
+		}
+		return b
+	}
+	var e [][]byte
+	x := rng()
+	for i := 0; i < 4*n; i++ {
+		switch op := uint32(x.Next()) % 16; {
+		case op < 10:
+			v := val(i)
+			j, err := a.Append(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := j, int64(len(e)); g != e {
+				t.Fatal(i, g, e)
+			}
+
+			e = append(e, v)
+		case op < 14:
+			if len(e) == 0 {
+				break
+			}
+
+			j := uint32(x.Next()) % uint32(len(e))
+			v := val(i)
+			if err := a.Set(int64(j), v); err != nil {
+				t.Fatal(err)
+			}
+
+			e[j] = v
+		default:
+			m := int(uint32(x.Next()) % uint32(2*len(e)+2))
+			if err := a.Truncate(int64(m)); err != nil {
+				t.Fatal(err)
+			}
+
+			for len(e) < m {
+				e = append(e, make([]byte, elemSize))
+			}
+			e = e[:m]
+		}
+		if i%(n/4) == 0 {
+			a.verify(t, e)
+		}
+	}
+	if a, err = db.OpenArray(a.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	a.verify(t, e)
+	if err := a.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	a.verify(t, nil)
+}
+
+func TestArray(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testArray(t, v.f, 8, 1<<12) }) {
+			break
+		}
+	}
+}
+
+func TestArrayLargeElements(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testArray(t, v.f, arrayPage+1, 1<<8) }) {
+			break
+		}
+	}
+}
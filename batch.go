@@ -0,0 +1,272 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cznic/internal/buffer"
+)
+
+type btBatchOp struct {
+	k   []byte
+	v   []byte
+	del bool
+}
+
+// BTreeBatch collects Set and Delete operations to be applied to a BTree
+// together. Keys of the tree must collate as byte strings.
+type BTreeBatch struct {
+	ops []btBatchOp
+	t   *BTree
+}
+
+// NewBatch returns a new, empty BTreeBatch of t.
+func (t *BTree) NewBatch() *BTreeBatch { return &BTreeBatch{t: t} }
+
+// Delete records deleting the item with key k. The length of k must be equal
+// to SzKey. The batch keeps a copy of k.
+func (b *BTreeBatch) Delete(k []byte) {
+	if int64(len(k)) != b.t.SzKey {
+		panic(fmt.Errorf("%T.Delete: invalid argument", b))
+	}
+
+	b.ops = append(b.ops, btBatchOp{k: append([]byte(nil), k...), del: true})
+}
+
+// Len returns the number of recorded operations.
+func (b *BTreeBatch) Len() int { return len(b.ops) }
+
+// Set records adding or overwriting the item with key k and value v. The
+// lengths of k and v must be equal to SzKey and SzVal. If the tree owns its
+// values, v may have any length. The batch keeps copies of k and v.
+func (b *BTreeBatch) Set(k, v []byte) {
+	if int64(len(k)) != b.t.SzKey || !b.t.owned && int64(len(v)) != b.t.SzVal {
+		panic(fmt.Errorf("%T.Set: invalid argument", b))
+	}
+
+	b.ops = append(b.ops, btBatchOp{k: append([]byte(nil), k...), v: append([]byte(nil), v...)})
+}
+
+// Apply sorts the recorded operations by key and applies them to the tree in
+// a single left to right pass. Consecutive operations falling into the same
+// data page share the descent from the root and items are inserted or
+// removed in place while no page split or merge is necessary. Of multiple
+// operations on the same key only the last one recorded is applied. The tree
+// length is updated once. Apply removes all recorded operations from b.
+//
+// The free function may be nil, otherwise it's called with the offsets of the
+// key and value of an item that is being deleted from the tree or with a zero
+// koff and the offset of a value that is being overwritten. If the tree owns
+// its values, the value block is freed after calling free.
+func (b *BTreeBatch) Apply(free func(koff, voff int64) error) (err error) {
+	t := b.t
+	free = t.ownedFree(free)
+	ops := b.ops
+	b.ops = nil
+	sort.SliceStable(ops, func(i, j int) bool { return bytes.Compare(ops[i].k, ops[j].k) < 0 })
+	w := 0
+	for i, v := range ops {
+		if i+1 < len(ops) && bytes.Equal(v.k, ops[i+1].k) {
+			continue
+		}
+
+		ops[w] = v
+		w++
+	}
+	ops = ops[:w]
+
+	var delta int64
+
+	defer func() {
+		if delta == 0 {
+			return
+		}
+
+		if e := t.incLen(delta); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	p := buffer.Get(int(t.SzKey))
+	defer buffer.Put(p)
+
+	cmp := func(k []byte) func(int64) (int, error) {
+		return func(koff int64) (int, error) {
+			if n, err := t.ReadAt(*p, koff); n != len(*p) {
+				if err == nil {
+					panic("internal error")
+				}
+
+				return 0, err
+			}
+
+			return bytes.Compare(k, *p), nil
+		}
+	}
+
+	for len(ops) != 0 {
+		d, err := t.leaf(cmp(ops[0].k))
+		if err != nil {
+			return err
+		}
+
+		var hi int64
+		if d != 0 {
+			next, err := t.next(d)
+			if err != nil {
+				return err
+			}
+
+			if next != 0 {
+				hi = t.key(next, 0)
+			}
+		}
+
+		for len(ops) != 0 {
+			op := ops[0]
+			if hi != 0 {
+				c, err := cmp(op.k)(hi)
+				if err != nil {
+					return err
+				}
+
+				if c >= 0 {
+					break
+				}
+			}
+
+			n, redescend, err := t.applyOp(d, op, cmp(op.k), free)
+			if err != nil {
+				return err
+			}
+
+			ops = ops[1:]
+			delta += int64(n)
+			if redescend {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (t *BTree) leaf(cmp func(koff int64) (int, error)) (btDPage, error) {
+	r, err := t.root()
+	if err != nil || r == 0 {
+		return 0, err
+	}
+
+	for {
+		q, err := t.openPage(r)
+		if err != nil {
+			return 0, err
+		}
+
+		switch x := q.(type) {
+		case btXPage:
+			xc, err := t.lenX(x)
+			if err != nil {
+				return 0, err
+			}
+
+			i, ok, err := t.findX(x, xc, cmp)
+			if err != nil {
+				return 0, err
+			}
+
+			if ok {
+				i++
+			}
+			if r, err = t.child(x, i); err != nil {
+				return 0, err
+			}
+		case btDPage:
+			return x, nil
+		}
+	}
+}
+
+// applyOp applies op to data page d, the page where the key of op belongs, or
+// to an empty tree if d is zero. It returns the change of the tree length and
+// a boolean value indicating d may be no more valid because op could not be
+// applied in place.
+func (t *BTree) applyOp(d btDPage, op btBatchOp, cmp func(koff int64) (int, error), free func(koff, voff int64) error) (int, bool, error) {
+	var dc, i int
+	var ok bool
+	if d != 0 {
+		var err error
+		if dc, err = t.len(d); err != nil {
+			return 0, false, err
+		}
+
+		if i, ok, err = t.find(d, dc, cmp); err != nil {
+			return 0, false, err
+		}
+	}
+
+	switch {
+	case op.del && !ok:
+		return 0, false, nil
+	case op.del:
+		r, err := t.root()
+		if err != nil {
+			return 0, false, err
+		}
+
+		if dc > t.kd || int64(d) == r && dc > 1 {
+			return -1, false, t.extract(d, dc, i, free)
+		}
+
+		_, err = t.del(cmp, free)
+		return -1, true, err
+	case ok:
+		voff := t.val(d, i)
+		if free != nil {
+			if err := free(0, voff); err != nil {
+				return 0, false, err
+			}
+		}
+
+		return 0, false, t.writeBatchVal(voff, op.v)
+	case d != 0 && dc < 2*t.kd:
+		if err := t.insert(d, dc, i); err != nil {
+			return 0, false, err
+		}
+
+		if _, err := t.WriteAt(op.k, t.key(d, i)); err != nil {
+			return 0, false, err
+		}
+
+		return 1, false, t.writeBatchVal(t.val(d, i), op.v)
+	default:
+		koff, voff, _, err := t.put(cmp)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if _, err := t.WriteAt(op.k, koff); err != nil {
+			return 0, false, err
+		}
+
+		return 1, true, t.writeBatchVal(voff, op.v)
+	}
+}
+
+// writeBatchVal writes the value v of a new or overwritten item to voff.
+func (t *BTree) writeBatchVal(voff int64, v []byte) error {
+	if !t.owned {
+		_, err := t.WriteAt(v, voff)
+		return err
+	}
+
+	if err := t.w8(voff, 0); err != nil {
+		return err
+	}
+
+	return t.WriteValue(voff, v)
+}
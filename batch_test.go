@@ -0,0 +1,154 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func batchKey(k int) []byte { return []byte{byte(k >> 24), byte(k >> 16), byte(k >> 8), byte(k)} }
+
+func batchVal(v int) []byte {
+	return []byte{byte(v >> 56), byte(v >> 48), byte(v >> 40), byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func testBTreeBatch(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewBTree(8, 8, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bt.bremove(t)
+
+	const N = 1 << 12
+	m := map[int]int{}
+	x := rng()
+	for round := 0; round < 8; round++ {
+		b := bt.NewBatch()
+		for i := 0; i < N; i++ {
+			k := x.Next() & (N - 1)
+			switch {
+			case round%4 == 3 || x.Next()%3 == 0:
+				kb := batchKey(k)
+				b.Delete(kb)
+				copy(kb, batchKey(k+1))
+				delete(m, k)
+			default:
+				v := x.Next()
+				kb, vb := batchKey(k), batchVal(v)
+				b.Set(kb, vb)
+				copy(kb, batchKey(k+1))
+				copy(vb, batchVal(v+1))
+				m[k] = v
+			}
+		}
+		if g, e := b.Len(), N; g != e {
+			t.Fatal(g, e)
+		}
+
+		if err := b.Apply(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := b.Len(), 0; g != e {
+			t.Fatal(g, e)
+		}
+
+		bt.verifyDirect(t)
+		if g, e := bt.tlen(t), int64(len(m)); g != e {
+			t.Fatal(round, g, e)
+		}
+
+		for k, v := range m {
+			voff, ok, err := bt.Get(bt.bcmp(k))
+			if err != nil || !ok {
+				t.Fatal(k, ok, err)
+			}
+
+			w, err := bt.r8(voff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := w, int64(v); g != e {
+				t.Fatal(k, g, e)
+			}
+		}
+	}
+}
+
+func TestBTreeBatch(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeBatch(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeBatchFree(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewBTree(8, 8, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := func(koff, voff int64) error {
+		p, err := bt.r8(voff)
+		if err != nil {
+			return err
+		}
+
+		return bt.Free(p)
+	}
+
+	defer func() {
+		if err := bt.Remove(free); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1 << 10
+	for round := 0; round < 3; round++ {
+		b := bt.NewBatch()
+		for i := 0; i < N; i++ {
+			if round == 2 && i%2 == 0 {
+				b.Delete(batchKey(i))
+				continue
+			}
+
+			p, err := bt.Alloc(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b.Set(batchKey(i), batchVal(int(p)))
+		}
+		if err := b.Apply(free); err != nil {
+			t.Fatal(err)
+		}
+
+		bt.verifyDirect(t)
+	}
+	if g, e := bt.tlen(t), int64(N/2); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestBTreeBatchFree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeBatchFree(t, v.f) }) {
+			break
+		}
+	}
+}
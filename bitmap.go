@@ -0,0 +1,689 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/cznic/internal/buffer"
+	"github.com/cznic/mathutil"
+)
+
+const (
+	bitmapArrayMax = 4096 // Maximum cardinality of an array container.
+	bitmapWords    = 1024 // Number of int64 words in a bitmap container.
+)
+
+const (
+	oBitmapCard  = 8 * iota // int64		0	8
+	oBitmapIndex            // int64		8	8
+
+	szBitmap
+)
+
+const (
+	oBitmapContainerOff  = 0  // int64		0	8
+	oBitmapContainerCard = 8  // int32		8	4
+	oBitmapContainerCap  = 12 // int32		12	4
+
+	szBitmapContainer = 16
+)
+
+// Bitmap is a persistent, compressed set of uint32 values using the roaring
+// layout. Values sharing the high 16 bits are stored in a container. A
+// container with at most 4096 values is a sorted array of the low 16 bits of
+// the values, a container with more values is a bitmap of 65536 bits. The
+// containers are indexed by a BTree keyed by the high 16 bits of their
+// values.
+type Bitmap struct {
+	*DB
+	Off int64 // Location in the database.
+	t   *BTree
+}
+
+type bitmapContainer struct {
+	off  int64
+	card int
+	cap  int // Capacity of an array container.
+	a    []uint16
+	w    []uint64
+}
+
+// NewBitmap allocates and returns a new, empty Bitmap or an error, if any.
+func (db *DB) NewBitmap() (*Bitmap, error) {
+	off, err := db.Calloc(szBitmap)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.NewBTree(0, 0, 4, szBitmapContainer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oBitmapIndex, t.Off); err != nil {
+		return nil, err
+	}
+
+	return &Bitmap{DB: db, Off: off, t: t}, nil
+}
+
+// OpenBitmap opens and returns an existing Bitmap or an error, if any.
+func (db *DB) OpenBitmap(off int64) (*Bitmap, error) {
+	index, err := db.r8(off + oBitmapIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.OpenBTree(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bitmap{DB: db, Off: off, t: t}, nil
+}
+
+func (b *Bitmap) cmp(hi int) func(koff int64) (int, error) {
+	return func(koff int64) (int, error) {
+		k, err := b.r4(koff)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case hi < k:
+			return -1, nil
+		case hi > k:
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+}
+
+func (b *Bitmap) incCard(delta int64) error {
+	n, err := b.Cardinality()
+	if err != nil {
+		return err
+	}
+
+	return b.w8(b.Off+oBitmapCard, n+delta)
+}
+
+// container returns the container descriptor at voff. The container data
+// are not loaded.
+func (b *Bitmap) container(voff int64) (*bitmapContainer, error) {
+	off, err := b.r8(voff + oBitmapContainerOff)
+	if err != nil {
+		return nil, err
+	}
+
+	card, err := b.r4(voff + oBitmapContainerCard)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := b.r4(voff + oBitmapContainerCap)
+	if err != nil {
+		return nil, err
+	}
+
+	if card <= 0 || card > 1<<16 || card <= bitmapArrayMax && card > n {
+		return nil, fmt.Errorf("%T: corrupted database", b)
+	}
+
+	return &bitmapContainer{off: off, card: card, cap: n}, nil
+}
+
+// load reads the data of c from s.
+func (c *bitmapContainer) load(s Storage) error {
+	n := 2 * c.card
+	if c.card > bitmapArrayMax {
+		n = 8 * bitmapWords
+	}
+	p := buffer.Get(n)
+	defer buffer.Put(p)
+
+	q := *p
+	if _, err := s.ReadAt(q, c.off); err != nil {
+		return err
+	}
+
+	if c.card > bitmapArrayMax {
+		c.w = make([]uint64, bitmapWords)
+		for i := range c.w {
+			c.w[i] = dec8(q[8*i:])
+		}
+		return nil
+	}
+
+	c.a = make([]uint16, c.card)
+	for i := range c.a {
+		c.a[i] = uint16(q[2*i])<<8 | uint16(q[2*i+1])
+	}
+	return nil
+}
+
+func (c *bitmapContainer) words() []uint64 {
+	if c.w != nil {
+		return c.w
+	}
+
+	w := make([]uint64, bitmapWords)
+	for _, v := range c.a {
+		w[v>>6] |= 1 << (v & 63)
+	}
+	return w
+}
+
+func (c *bitmapContainer) values() []uint16 {
+	if c.w == nil {
+		return c.a
+	}
+
+	a := make([]uint16, 0, c.card)
+	for i, v := range c.w {
+		for v != 0 {
+			j := bits.TrailingZeros64(v)
+			a = append(a, uint16(i<<6|j))
+			v &= v - 1
+		}
+	}
+	return a
+}
+
+// save writes the loaded data of c, which has the cardinality c.card, to
+// storage, converting between array and bitmap representations as needed,
+// and updates the container descriptor at voff.
+func (b *Bitmap) save(voff int64, c *bitmapContainer) (err error) {
+	var q []byte
+	switch {
+	case c.card > bitmapArrayMax:
+		w := c.words()
+		q = make([]byte, 8*bitmapWords)
+		for i, v := range w {
+			enc8(q[8*i:], v)
+		}
+		if c.off == 0 || c.cap != 0 {
+			c.cap = 0
+			c.off, err = b.realloc(c.off, int64(len(q)))
+		}
+	default:
+		a := c.values()
+		q = make([]byte, 2*len(a))
+		encArray(q, a)
+		if n := len(a); n > c.cap || n < c.cap/4 {
+			c.cap = mathutil.Min(mathutil.Max(n+n/2, 4), bitmapArrayMax)
+			c.off, err = b.realloc(c.off, 2*int64(c.cap))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.WriteAt(q, c.off); err != nil {
+		return err
+	}
+
+	if err := b.w8(voff+oBitmapContainerOff, c.off); err != nil {
+		return err
+	}
+
+	if err := b.w4(voff+oBitmapContainerCard, c.card); err != nil {
+		return err
+	}
+
+	return b.w4(voff+oBitmapContainerCap, c.cap)
+}
+
+func (b *Bitmap) realloc(off, size int64) (int64, error) {
+	if off == 0 {
+		return b.Alloc(size)
+	}
+
+	return b.Realloc(off, size)
+}
+
+func (b *Bitmap) writeArray(off int64, a []uint16) error {
+	if len(a) == 0 {
+		return nil
+	}
+
+	p := buffer.Get(2 * len(a))
+	defer buffer.Put(p)
+
+	encArray(*p, a)
+	_, err := b.WriteAt(*p, off)
+	return err
+}
+
+func encArray(b []byte, a []uint16) {
+	for i, v := range a {
+		b[2*i], b[2*i+1] = byte(v>>8), byte(v)
+	}
+}
+
+// put adds the container c with the high bits hi to b. The container must
+// not exist in b.
+func (b *Bitmap) put(hi int, c *bitmapContainer) error {
+	koff, voff, err := b.t.Set(b.cmp(hi), nil)
+	if err != nil {
+		return err
+	}
+
+	if err := b.w4(koff, hi); err != nil {
+		return err
+	}
+
+	if err := b.save(voff, c); err != nil {
+		return err
+	}
+
+	return b.incCard(int64(c.card))
+}
+
+// Add adds x to b and returns a boolean value indicating x was not present in
+// b before or an error, if any.
+func (b *Bitmap) Add(x uint32) (bool, error) {
+	hi, lo := int(x>>16), uint16(x)
+	voff, ok, err := b.t.Get(b.cmp(hi))
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return true, b.put(hi, &bitmapContainer{card: 1, a: []uint16{lo}})
+	}
+
+	c, err := b.container(voff)
+	if err != nil {
+		return false, err
+	}
+
+	if c.card > bitmapArrayMax {
+		// Update a single word of a bitmap container in place.
+		woff := c.off + 8*int64(lo>>6)
+		w, err := b.r8(woff)
+		if err != nil {
+			return false, err
+		}
+
+		bit := int64(1) << (lo & 63)
+		if w&bit != 0 {
+			return false, nil
+		}
+
+		if err := b.w8(woff, w|bit); err != nil {
+			return false, err
+		}
+
+		if err := b.w4(voff+oBitmapContainerCard, c.card+1); err != nil {
+			return false, err
+		}
+
+		return true, b.incCard(1)
+	}
+
+	if err := c.load(b); err != nil {
+		return false, err
+	}
+
+	i := sort.Search(len(c.a), func(i int) bool { return c.a[i] >= lo })
+	if i < len(c.a) && c.a[i] == lo {
+		return false, nil
+	}
+
+	c.a = append(c.a, 0)
+	copy(c.a[i+1:], c.a[i:])
+	c.a[i] = lo
+	c.card++
+	switch {
+	case c.card <= c.cap:
+		// Rewrite only the moved part of an array container.
+		if err := b.writeArray(c.off+2*int64(i), c.a[i:]); err != nil {
+			return false, err
+		}
+
+		if err := b.w4(voff+oBitmapContainerCard, c.card); err != nil {
+			return false, err
+		}
+	default:
+		if err := b.save(voff, c); err != nil {
+			return false, err
+		}
+	}
+
+	return true, b.incCard(1)
+}
+
+// And returns a new Bitmap in the DB of b holding the values present in both
+// b and o or an error, if any. The bitmaps may be in different DBs.
+func (b *Bitmap) And(o *Bitmap) (*Bitmap, error) { return b.op(o, MergeIntersection) }
+
+// AndNot returns a new Bitmap in the DB of b holding the values present in b
+// but not in o or an error, if any. The bitmaps may be in different DBs.
+func (b *Bitmap) AndNot(o *Bitmap) (*Bitmap, error) { return b.op(o, MergeDifference) }
+
+// Cardinality returns the number of values in b or an error, if any.
+func (b *Bitmap) Cardinality() (int64, error) { return b.r8(b.Off + oBitmapCard) }
+
+// Clear removes all values from b.
+func (b *Bitmap) Clear() error {
+	if err := b.t.Clear(func(_, voff int64) error {
+		off, err := b.r8(voff + oBitmapContainerOff)
+		if err != nil {
+			return err
+		}
+
+		return b.Free(off)
+	}); err != nil {
+		return err
+	}
+
+	return b.w8(b.Off+oBitmapCard, 0)
+}
+
+// Contains returns whether x is present in b or an error, if any.
+func (b *Bitmap) Contains(x uint32) (bool, error) {
+	hi, lo := int(x>>16), uint16(x)
+	voff, ok, err := b.t.Get(b.cmp(hi))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	c, err := b.container(voff)
+	if err != nil {
+		return false, err
+	}
+
+	if c.card > bitmapArrayMax {
+		w, err := b.r8(c.off + 8*int64(lo>>6))
+		if err != nil {
+			return false, err
+		}
+
+		return w&(1<<(lo&63)) != 0, nil
+	}
+
+	if err := c.load(b); err != nil {
+		return false, err
+	}
+
+	i := sort.Search(len(c.a), func(i int) bool { return c.a[i] >= lo })
+	return i < len(c.a) && c.a[i] == lo, nil
+}
+
+// Drop frees all space used by b.
+func (b *Bitmap) Drop() error {
+	if err := b.Clear(); err != nil {
+		return err
+	}
+
+	if err := b.t.Remove(nil); err != nil {
+		return err
+	}
+
+	if err := b.Free(b.Off); err != nil {
+		return err
+	}
+
+	b.Off = 0
+	return nil
+}
+
+// Or returns a new Bitmap in the DB of b holding the values present in b, o
+// or both or an error, if any. The bitmaps may be in different DBs.
+func (b *Bitmap) Or(o *Bitmap) (*Bitmap, error) { return b.op(o, MergeUnion) }
+
+func (b *Bitmap) op(o *Bitmap, op MergeOp) (r *Bitmap, err error) {
+	if r, err = b.NewBitmap(); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			r.Drop()
+			r = nil
+		}
+	}()
+
+	ca, err := b.t.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	cb, err := o.t.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	// Containers present in both bitmaps must be combined by all the set
+	// operations, but MergeDifference does not produce them.
+	mop := op
+	if op == MergeDifference {
+		mop = MergeUnion
+	}
+	m := NewBTreeMerge(mop, ca, cb, nil)
+	for m.Next() {
+		var w []uint64
+		var hi int
+		switch {
+		case m.AK == 0 && op == MergeDifference:
+			continue
+		case m.BK == 0 || m.AK == 0:
+			// Only one of the bitmaps has the container, the result
+			// gets a copy of it.
+			t, koff, voff := b, m.AK, m.AV
+			if koff == 0 {
+				t, koff, voff = o, m.BK, m.BV
+			}
+			if hi, err = t.r4(koff); err != nil {
+				return nil, err
+			}
+
+			c, err := t.container(voff)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := c.load(t); err != nil {
+				return nil, err
+			}
+
+			if err := r.put(hi, &bitmapContainer{card: c.card, a: c.a, w: c.w}); err != nil {
+				return nil, err
+			}
+
+			continue
+		default:
+			if hi, err = b.r4(m.AK); err != nil {
+				return nil, err
+			}
+
+			ca, err := b.container(m.AV)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := ca.load(b); err != nil {
+				return nil, err
+			}
+
+			cb, err := o.container(m.BV)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := cb.load(o); err != nil {
+				return nil, err
+			}
+
+			switch {
+			case ca.w != nil:
+				w = append([]uint64(nil), ca.w...)
+			default:
+				w = ca.words()
+			}
+			for i, v := range cb.words() {
+				switch op {
+				case MergeUnion:
+					w[i] |= v
+				case MergeIntersection:
+					w[i] &= v
+				case MergeDifference:
+					w[i] &^= v
+				}
+			}
+		}
+
+		var card int
+		for _, v := range w {
+			card += bits.OnesCount64(v)
+		}
+		if card == 0 {
+			continue
+		}
+
+		if err := r.put(hi, &bitmapContainer{card: card, w: w}); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.Err(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Remove removes x from b and returns a boolean value indicating x was present
+// in b or an error, if any.
+func (b *Bitmap) Remove(x uint32) (bool, error) {
+	hi, lo := int(x>>16), uint16(x)
+	voff, ok, err := b.t.Get(b.cmp(hi))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	c, err := b.container(voff)
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.load(b); err != nil {
+		return false, err
+	}
+
+	switch {
+	case c.w != nil:
+		bit := uint64(1) << (lo & 63)
+		if c.w[lo>>6]&bit == 0 {
+			return false, nil
+		}
+
+		if c.card-1 > bitmapArrayMax {
+			woff := c.off + 8*int64(lo>>6)
+			if err := b.w8(woff, int64(c.w[lo>>6]&^bit)); err != nil {
+				return false, err
+			}
+
+			if err := b.w4(voff+oBitmapContainerCard, c.card-1); err != nil {
+				return false, err
+			}
+
+			return true, b.incCard(-1)
+		}
+
+		c.w[lo>>6] &^= bit
+	default:
+		i := sort.Search(len(c.a), func(i int) bool { return c.a[i] >= lo })
+		if i == len(c.a) || c.a[i] != lo {
+			return false, nil
+		}
+
+		c.a = append(c.a[:i], c.a[i+1:]...)
+	}
+
+	c.card--
+	switch {
+	case c.card == 0:
+		if err := b.Free(c.off); err != nil {
+			return false, err
+		}
+
+		if _, err := b.t.Delete(b.cmp(hi), nil); err != nil {
+			return false, err
+		}
+	default:
+		if err := b.save(voff, c); err != nil {
+			return false, err
+		}
+	}
+
+	return true, b.incCard(-1)
+}
+
+// SeekFirst returns a cursor positioned before the smallest value of b or an
+// error, if any.
+func (b *Bitmap) SeekFirst() (*BitmapCursor, error) {
+	c, err := b.t.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BitmapCursor{b: b, c: c}, nil
+}
+
+// BitmapCursor provides enumerating Bitmap values in ascending order.
+type BitmapCursor struct {
+	X   uint32 // Current value. Not valid before calling Next.
+	a   []uint16
+	b   *Bitmap
+	c   *BTreeCursor
+	err error
+	hi  uint32
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *BitmapCursor) Err() error { return c.err }
+
+// Next moves the cursor to the next value and sets the X field accordingly.
+// It returns true on success, or false if there is no next value or an error
+// happened while moving the cursor. Err should be consulted to distinguish
+// between the two cases.
+func (c *BitmapCursor) Next() bool {
+	for len(c.a) == 0 {
+		if c.err != nil || !c.c.Next() {
+			if c.err == nil {
+				c.err = c.c.Err()
+			}
+			return false
+		}
+
+		hi, err := c.b.r4(c.c.K)
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		ct, err := c.b.container(c.c.V)
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		if c.err = ct.load(c.b); c.err != nil {
+			return false
+		}
+
+		c.hi = uint32(hi) << 16
+		c.a = ct.values()
+	}
+
+	c.X = c.hi | uint32(c.a[0])
+	c.a = c.a[1:]
+	return true
+}
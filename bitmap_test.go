@@ -0,0 +1,201 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+	"github.com/cznic/mathutil"
+)
+
+func (b *Bitmap) verify(tb testing.TB, m map[uint32]bool) {
+	n, err := b.Cardinality()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got cardinality %v, expected %v", g, e)
+	}
+
+	var e []uint32
+	for k := range m {
+		e = append(e, k)
+	}
+	sort.Slice(e, func(i, j int) bool { return e[i] < e[j] })
+	c, err := b.SeekFirst()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	i := 0
+	for ; c.Next(); i++ {
+		if i >= len(e) || c.X != e[i] {
+			tb.Fatalf("value %v: got %v", i, c.X)
+		}
+	}
+	if err := c.Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if i != len(e) {
+		tb.Fatalf("got %v values, expected %v", i, len(e))
+	}
+}
+
+// bitmapValue returns a value falling into a sparse container, a dense one
+// converting between array and bitmap representations or a bitmap one.
+func bitmapValue(x *mathutil.FC32) uint32 {
+	switch uint32(x.Next()) % 4 {
+	case 0:
+		return uint32(x.Next())
+	case 1, 2:
+		return 1<<16 | uint32(x.Next())%(2*bitmapArrayMax+100)
+	default:
+		return 5<<16 | uint32(x.Next())%(1<<16)
+	}
+}
+
+func testBitmap(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	b, err := db.NewBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := b.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[uint32]bool{}
+	x := rng()
+	const N = 1 << 14
+	for i := 0; i < N; i++ {
+		v := bitmapValue(x)
+		switch op := uint32(x.Next()) % 8; {
+		case op < 5 || i < N/2:
+			ok, err := b.Add(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok == m[v] {
+				t.Fatal(i, v, ok)
+			}
+
+			m[v] = true
+		case op < 7:
+			ok, err := b.Remove(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != m[v] {
+				t.Fatal(i, v, ok)
+			}
+
+			delete(m, v)
+		default:
+			ok, err := b.Contains(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != m[v] {
+				t.Fatal(i, v, ok)
+			}
+		}
+	}
+	if b, err = db.OpenBitmap(b.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	b.verify(t, m)
+
+	// Shrink the bitmap container of 1<<16 back to an array one.
+	for v := range m {
+		if v>>16 == 1 && v&1 == 0 {
+			if ok, err := b.Remove(v); !ok || err != nil {
+				t.Fatal(v, ok, err)
+			}
+
+			delete(m, v)
+		}
+	}
+	b.verify(t, m)
+
+	o, err := db.NewBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := o.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	n := map[uint32]bool{}
+	for i := 0; i < N/2; i++ {
+		v := bitmapValue(x)
+		if _, err := o.Add(v); err != nil {
+			t.Fatal(err)
+		}
+
+		n[v] = true
+	}
+	o.verify(t, n)
+
+	for _, v := range []struct {
+		f  func(*Bitmap) (*Bitmap, error)
+		in func(a, b bool) bool
+	}{
+		{b.And, func(a, b bool) bool { return a && b }},
+		{b.AndNot, func(a, b bool) bool { return a && !b }},
+		{b.Or, func(a, b bool) bool { return a || b }},
+	} {
+		r, err := v.f(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := map[uint32]bool{}
+		for k := range m {
+			if v.in(true, n[k]) {
+				e[k] = true
+			}
+		}
+		for k := range n {
+			if v.in(m[k], true) {
+				e[k] = true
+			}
+		}
+		r.verify(t, e)
+		if err := r.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.verify(t, nil)
+}
+
+func TestBitmap(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBitmap(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cznic/mathutil"
+)
+
+const (
+	blobChunk = 1 << 16
+)
+
+const (
+	oBlobSize  = 8 * iota // int64		0	8
+	oBlobIndex            // int64		8	8
+
+	szBlob
+)
+
+var (
+	_ io.ReadSeeker  = (*Blob)(nil)
+	_ io.ReaderAt    = (*Blob)(nil)
+	_ io.WriterAt    = (*Blob)(nil)
+	_ io.WriteCloser = (*BlobWriter)(nil)
+)
+
+// Blob is a persistent byte sequence of arbitrary size. The data are stored in
+// chunks of 64kB, the last chunk is allocated only as large as needed. The
+// offsets of the chunks are kept in a separate index block. A zero chunk
+// offset denotes a hole which reads as zeros.
+//
+// Blob does not embed *DB as its ReadAt, WriteAt and Free methods operate on
+// the blob data, not on the database.
+type Blob struct {
+	Off int64 // Location in the database.
+	db  *DB
+	pos int64
+}
+
+// CreateBlob allocates a new, empty Blob and returns a BlobWriter appending to
+// it or an error, if any. The data written are not guaranteed to be stored
+// until BlobWriter.Close returns.
+func (db *DB) CreateBlob() (*BlobWriter, error) {
+	off, err := db.Calloc(szBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := db.OpenBlob(off)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobWriter{Off: off, b: b}, nil
+}
+
+// OpenBlob returns the Blob found at offset off. The read position of the
+// returned Blob is zero.
+func (db *DB) OpenBlob(off int64) (*Blob, error) { return &Blob{Off: off, db: db}, nil }
+
+// chunks returns the number of chunks of a blob of size bytes.
+func (b *Blob) chunks(size int64) int64 { return (size + blobChunk - 1) / blobChunk }
+
+// chunkSize returns the number of bytes stored in chunk i of a blob of size
+// bytes.
+func (b *Blob) chunkSize(i, size int64) int64 { return mathutil.MinInt64(size-i*blobChunk, blobChunk) }
+
+func (b *Blob) chunk(i int64) (int64, error) {
+	idx, err := b.db.r8(b.Off + oBlobIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.db.r8(idx + 8*i)
+}
+
+func (b *Blob) setChunk(i, off int64) error {
+	idx, err := b.db.r8(b.Off + oBlobIndex)
+	if err != nil {
+		return err
+	}
+
+	return b.db.w8(idx+8*i, off)
+}
+
+func (b *Blob) zero(off, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	_, err := b.db.WriteAt(make([]byte, n), off)
+	return err
+}
+
+// resizeIndex changes the size of the chunk index from n to m entries. New
+// entries are zeroed.
+func (b *Blob) resizeIndex(n, m int64) error {
+	if n == m {
+		return nil
+	}
+
+	idx, err := b.db.r8(b.Off + oBlobIndex)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case m == 0:
+		if err := b.db.Free(idx); err != nil {
+			return err
+		}
+
+		idx = 0
+	case idx == 0:
+		if idx, err = b.db.Calloc(8 * m); err != nil {
+			return err
+		}
+	default:
+		if idx, err = b.db.Realloc(idx, 8*m); err != nil {
+			return err
+		}
+
+		if m > n {
+			if err := b.zero(idx+8*n, 8*(m-n)); err != nil {
+				return err
+			}
+		}
+	}
+	return b.db.w8(b.Off+oBlobIndex, idx)
+}
+
+// Free frees all space used by b.
+func (b *Blob) Free() error {
+	if err := b.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := b.db.Free(b.Off); err != nil {
+		return err
+	}
+
+	b.Off = 0
+	return nil
+}
+
+// Read implements io.Reader.
+func (b *Blob) Read(p []byte) (int, error) {
+	n, err := b.ReadAt(p, b.pos)
+	b.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *Blob) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%T.ReadAt: invalid offset %v", b, off)
+	}
+
+	size, err := b.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if rem := size - off; int64(len(p)) > rem {
+		p = p[:rem]
+		eof = io.EOF
+	}
+
+	var n int
+	for len(p) != 0 {
+		i := off / blobChunk
+		o := off % blobChunk
+		q := p[:mathutil.MinInt64(int64(len(p)), blobChunk-o)]
+		c, err := b.chunk(i)
+		if err != nil {
+			return n, err
+		}
+
+		switch {
+		case c == 0:
+			for i := range q {
+				q[i] = 0
+			}
+		default:
+			if _, err := b.db.ReadAt(q, c+o); err != nil {
+				return n, err
+			}
+		}
+		n += len(q)
+		off += int64(len(q))
+		p = p[len(q):]
+	}
+	return n, eof
+}
+
+// Seek implements io.Seeker.
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// nop
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		size, err := b.Size()
+		if err != nil {
+			return b.pos, err
+		}
+
+		offset += size
+	default:
+		return b.pos, fmt.Errorf("%T.Seek: invalid whence %v", b, whence)
+	}
+
+	if offset < 0 {
+		return b.pos, fmt.Errorf("%T.Seek: negative position %v", b, offset)
+	}
+
+	b.pos = offset
+	return offset, nil
+}
+
+// Size returns the size of b in bytes or an error, if any.
+func (b *Blob) Size() (int64, error) { return b.db.r8(b.Off + oBlobSize) }
+
+// Truncate changes the size of b. Chunks past the new size are freed. When
+// extending b, the added bytes read as zeros and no chunks are allocated for
+// them until they are written to.
+func (b *Blob) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%T.Truncate: invalid size %v", b, size)
+	}
+
+	old, err := b.Size()
+	if err != nil {
+		return err
+	}
+
+	if size == old {
+		return nil
+	}
+
+	n, m := b.chunks(old), b.chunks(size)
+	for i := m; i < n; i++ {
+		c, err := b.chunk(i)
+		if err != nil {
+			return err
+		}
+
+		if c != 0 {
+			if err := b.db.Free(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Resize the chunk that becomes or stops being the last one, keeping
+	// the invariant that chunk i has room for exactly chunkSize(i, size)
+	// bytes. That also discards stale data past the end of b.
+	if i := mathutil.MinInt64(n, m) - 1; i >= 0 {
+		c, err := b.chunk(i)
+		if err != nil {
+			return err
+		}
+
+		if x, y := b.chunkSize(i, old), b.chunkSize(i, size); c != 0 && x != y {
+			if c, err = b.db.Realloc(c, y); err != nil {
+				return err
+			}
+
+			if y > x {
+				if err := b.zero(c+x, y-x); err != nil {
+					return err
+				}
+			}
+
+			if err := b.setChunk(i, c); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.resizeIndex(n, m); err != nil {
+		return err
+	}
+
+	return b.db.w8(b.Off+oBlobSize, size)
+}
+
+// WriteAt implements io.WriterAt. Writing past the end of b extends it.
+func (b *Blob) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%T.WriteAt: invalid offset %v", b, off)
+	}
+
+	size, err := b.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if end := off + int64(len(p)); end > size {
+		if err := b.Truncate(end); err != nil {
+			return 0, err
+		}
+
+		size = end
+	}
+
+	var n int
+	for len(p) != 0 {
+		i := off / blobChunk
+		o := off % blobChunk
+		q := p[:mathutil.MinInt64(int64(len(p)), blobChunk-o)]
+		c, err := b.chunk(i)
+		if err != nil {
+			return n, err
+		}
+
+		if c == 0 {
+			sz := b.chunkSize(i, size)
+			switch {
+			case o == 0 && int64(len(q)) == sz:
+				c, err = b.db.Alloc(sz)
+			default:
+				c, err = b.db.Calloc(sz)
+			}
+			if err != nil {
+				return n, err
+			}
+
+			if err := b.setChunk(i, c); err != nil {
+				return n, err
+			}
+		}
+
+		if _, err := b.db.WriteAt(q, c+o); err != nil {
+			return n, err
+		}
+
+		n += len(q)
+		off += int64(len(q))
+		p = p[len(q):]
+	}
+	return n, nil
+}
+
+// BlobWriter appends data to a Blob. It buffers up to one chunk of data.
+type BlobWriter struct {
+	Off    int64 // Location of the Blob in the database.
+	b      *Blob
+	buf    []byte
+	closed bool
+	pos    int64
+}
+
+// Close writes any buffered data to the Blob. Writing to a closed BlobWriter
+// is an error.
+func (w *BlobWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("%T.Close: already closed", w)
+	}
+
+	w.closed = true
+	return w.flush()
+}
+
+func (w *BlobWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	n, err := w.b.WriteAt(w.buf, w.pos)
+	w.pos += int64(n)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Write implements io.Writer.
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("%T.Write: closed", w)
+	}
+
+	var n int
+	for len(p) != 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, blobChunk)
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cznic/file"
+	"github.com/cznic/mathutil"
+)
+
+func (b *Blob) verify(tb testing.TB, e []byte) {
+	size, err := b.Size()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := size, int64(len(e)); g != e {
+		tb.Fatalf("got size %v, expected %v", g, e)
+	}
+
+	if _, err := b.Seek(0, io.SeekStart); err != nil {
+		tb.Fatal(err)
+	}
+
+	g, err := ioutil.ReadAll(b)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if !bytes.Equal(g, e) {
+		tb.Fatalf("content mismatch, got len %v, expected len %v", len(g), len(e))
+	}
+}
+
+func testBlob(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	w, err := db.CreateBlob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := rng()
+	const N = 5*blobChunk + 1234
+	e := make([]byte, N)
+	for i := range e {
+		e[i] = byte(x.Next())
+	}
+	for p := e; len(p) != 0; {
+		n := int(uint32(x.Next())%(2*blobChunk/3)) + 1
+		if n > len(p) {
+			n = len(p)
+		}
+		if m, err := w.Write(p[:n]); m != n || err != nil {
+			t.Fatal(m, n, err)
+		}
+
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write([]byte{1}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	b, err := db.OpenBlob(w.Off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := b.Free(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	b.verify(t, e)
+	for i := 0; i < 100; i++ {
+		off := int64(uint32(x.Next()) % N)
+		p := make([]byte, uint32(x.Next())%(2*blobChunk))
+		n, err := b.ReadAt(p, off)
+		m := int(mathutil.MinInt64(int64(len(p)), N-off))
+		if n != m || n < len(p) && err != io.EOF || n == len(p) && err != nil {
+			t.Fatal(off, len(p), n, m, err)
+		}
+
+		if !bytes.Equal(p[:n], e[off:off+int64(n)]) {
+			t.Fatal(off, len(p))
+		}
+	}
+
+	if off, err := b.Seek(-10, io.SeekEnd); off != N-10 || err != nil {
+		t.Fatal(off, err)
+	}
+
+	p := make([]byte, 20)
+	if n, err := b.Read(p); n != 10 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	if n, err := b.Read(p); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+
+	// Shrink into the middle of a chunk, then extend. The extension must
+	// read as zeros.
+	sz := int64(2*blobChunk + 100)
+	if err := b.Truncate(sz); err != nil {
+		t.Fatal(err)
+	}
+
+	e = e[:sz]
+	b.verify(t, e)
+	if err := b.Truncate(4*blobChunk + 7); err != nil {
+		t.Fatal(err)
+	}
+
+	e = append(e, make([]byte, 4*blobChunk+7-sz)...)
+	b.verify(t, e)
+
+	// Write into a hole and past the end.
+	for _, off := range []int64{3*blobChunk + 10, 6 * blobChunk} {
+		p := []byte("foo bar baz")
+		if n, err := b.WriteAt(p, off); n != len(p) || err != nil {
+			t.Fatal(n, err)
+		}
+
+		if end := off + int64(len(p)); end > int64(len(e)) {
+			e = append(e, make([]byte, end-int64(len(e)))...)
+		}
+		copy(e[off:], p)
+		b.verify(t, e)
+	}
+
+	if err := b.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	b.verify(t, nil)
+	if n, err := b.ReadAt(p, 0); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+}
+
+func TestBlob(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBlob(t, v.f) }) {
+			break
+		}
+	}
+}
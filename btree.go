@@ -13,6 +13,7 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 
@@ -44,11 +45,13 @@ const (
 	oBTKD               // int64
 	oBTKX               // int64
 	oBTSzKey            // int64
-	oBTSzVal            // int64
+	oBTSzVal            // int64, btOwnedValues set if the tree owns its values.
 
 	szBTree
 )
 
+const btOwnedValues = 1 << 62
+
 const (
 	oBTDPageTag   = 8 * iota // int32
 	oBTDPageLen              // int32
@@ -79,6 +82,7 @@ type BTree struct {
 	SzVal int64 // The szVal argument of NewBTree.
 	kd    int
 	kx    int
+	owned bool
 }
 
 // NewBTree allocates and returns a new, empty BTree or an error, if any.  The
@@ -88,7 +92,7 @@ type BTree struct {
 func (db *DB) NewBTree(nd, nx int, szKey, szVal int64) (*BTree, error) {
 	if nd < 0 || nd > (math.MaxInt32-1)/2 ||
 		nx < 0 || nx > (math.MaxInt32-2)/2 ||
-		szKey < 0 || szVal < 0 {
+		szKey < 0 || szVal < 0 || szVal >= btOwnedValues {
 		panic(fmt.Errorf("%T.NewBTree: invalid argument", db))
 	}
 
@@ -124,6 +128,29 @@ func (db *DB) NewBTree(nd, nx int, szKey, szVal int64) (*BTree, error) {
 	return &BTree{DB: db, Off: off, SzKey: szKey, SzVal: szVal, kd: kd, kx: kx}, nil
 }
 
+// NewOwnedBTree is like NewBTree but the tree owns the values of its items.
+// The values are variable sized and stored out of line, in storage blocks
+// allocated, resized and freed by the tree. Every item stores only the offset
+// of its value block, so SzVal is 8, but the value slot must not be written
+// directly, use SetValue or WriteValue instead and Value to read it. A zero
+// value slot denotes an empty value.
+//
+// Deleting an item, clearing or removing the tree frees the value blocks
+// after calling the free function, if any. The value blocks are copied by
+// CloneTo and moved with their items by SplitAt and Join.
+func (db *DB) NewOwnedBTree(nd, nx int, szKey int64) (*BTree, error) {
+	t, err := db.NewBTree(nd, nx, szKey, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.setOwned(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
 // OpenBTree opend and returns an existing BTree or an error, if any.
 func (db *DB) OpenBTree(off int64) (*BTree, error) {
 	n, err := db.r8(off + oBTKD)
@@ -155,7 +182,9 @@ func (db *DB) OpenBTree(off int64) (*BTree, error) {
 		return nil, err
 	}
 
-	return &BTree{DB: db, Off: off, kd: kd, kx: kx, SzKey: szKey, SzVal: szVal}, nil
+	owned := szVal&btOwnedValues != 0
+	szVal &^= btOwnedValues
+	return &BTree{DB: db, Off: off, kd: kd, kx: kx, SzKey: szKey, SzVal: szVal, owned: owned}, nil
 }
 
 func (t *BTree) first() (int64, error)          { return t.r8(t.Off + oBTFirst) }
@@ -176,7 +205,16 @@ func (t *BTree) setPrev(d, prev btDPage) error  { return t.w8(int64(d)+oBTDPageP
 func (t *BTree) setRoot(n int64) error          { return t.w8(t.Off+oBTRoot, n) }
 func (t *BTree) setTag(d btDPage) error         { return t.w4(int64(d)+oBTDPageTag, btTagDataPage) }
 func (t *BTree) setTagX(x btXPage) error        { return t.w4(int64(x)+oBTXPageTag, btTagIndexPage) }
-func (t *BTree) val(d btDPage, i int) int64     { return t.key(d, i) + t.SzVal }
+func (t *BTree) val(d btDPage, i int) int64     { return t.key(d, i) + t.SzKey }
+
+// added prepares the value of a newly inserted item at voff.
+func (t *BTree) added(voff int64) error {
+	if !t.owned {
+		return nil
+	}
+
+	return t.w8(voff, 0)
+}
 
 func (t *BTree) cat(p btXPage, q, r btDPage, pc, qc, rc, pi int, free func(int64, int64) error) error {
 	if err := t.mvL(q, r, qc, rc, rc); err != nil {
@@ -304,6 +342,120 @@ func (t *BTree) child(x btXPage, i int) (y int64, yy error) {
 	return t.r8(int64(x) + oBTXPageItems + int64(i)*16)
 }
 
+// btCopy is the state of copying the pages of a tree to dst by copyPage.
+type btCopy struct {
+	dst         *BTree
+	first, last btDPage                          // First and last data page copied so far.
+	items       func(x, d btDPage, dc int) error // Copies dc items of x to d.
+	m           map[btDPage]btDPage              // Source data page -> copy.
+	op          string                           // Method name for error messages.
+	pages       []int64                          // All pages allocated in dst.
+}
+
+// free frees all pages allocated by c.
+func (c *btCopy) free() {
+	for _, v := range c.pages {
+		c.dst.Free(v)
+	}
+}
+
+// copyPage copies the subtree at off to c.dst and returns the offset of the
+// copy. Data pages are linked in key order, their items are copied by
+// c.items.
+func (t *BTree) copyPage(c *btCopy, off int64) (int64, error) {
+	p, err := t.openPage(off)
+	if err != nil {
+		return 0, err
+	}
+
+	switch x := p.(type) {
+	case btDPage:
+		dc, err := t.len(x)
+		if err != nil {
+			return 0, err
+		}
+
+		d, err := c.dst.newBTDPage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.pages = append(c.pages, int64(d))
+		if err := c.items(x, d, dc); err != nil {
+			return 0, err
+		}
+
+		if err := c.dst.setLenD(d, dc); err != nil {
+			return 0, err
+		}
+
+		if c.last != 0 {
+			if err := c.dst.setNext(c.last, d); err != nil {
+				return 0, err
+			}
+
+			if err := c.dst.setPrev(d, c.last); err != nil {
+				return 0, err
+			}
+		} else {
+			c.first = d
+		}
+
+		c.last = d
+		c.m[x] = d
+		return int64(d), nil
+	case btXPage:
+		xc, err := t.lenX(x)
+		if err != nil {
+			return 0, err
+		}
+
+		y, err := c.dst.newBTXPage(0)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pages = append(c.pages, int64(y))
+		if err := c.dst.setLenX(y, xc); err != nil {
+			return 0, err
+		}
+
+		for i := 0; i <= xc; i++ {
+			ch, err := t.child(x, i)
+			if err != nil {
+				return 0, err
+			}
+
+			if ch, err = t.copyPage(c, ch); err != nil {
+				return 0, err
+			}
+
+			if err := c.dst.setChild(y, i, ch); err != nil {
+				return 0, err
+			}
+		}
+
+		// Index keys point to the first item of a data page.
+		for i := 0; i < xc; i++ {
+			k, err := t.keyX(x, i)
+			if err != nil {
+				return 0, err
+			}
+
+			d, ok := c.m[btDPage(k-oBTDPageItems)]
+			if !ok {
+				return 0, fmt.Errorf("%T.%s: corrupted database", t, c.op)
+			}
+
+			if err := c.dst.setKey(y, i, c.dst.key(d, 0)); err != nil {
+				return 0, err
+			}
+		}
+		return int64(y), nil
+	}
+	panic("internal error")
+}
+
 func (t *BTree) clr(off int64, free func(int64, int64) error) error {
 	if off == 0 {
 		return nil
@@ -390,6 +542,30 @@ func (t *BTree) clrX(x btXPage, xc int, free func(int64, int64) error) error {
 	return t.Free(int64(x))
 }
 
+// cloneValue replaces the offset of a value block of t at voff in dst by the
+// offset of its copy.
+func (t *BTree) cloneValue(dst *BTree, voff int64) error {
+	off, err := dst.r8(voff)
+	if err != nil || off == 0 {
+		return err
+	}
+
+	b, ok, err := readPayload(t, off)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%T.CloneTo: corrupted value at %#x", t, off)
+	}
+
+	if err := dst.w8(voff, 0); err != nil {
+		return err
+	}
+
+	return dst.WriteValue(voff, b)
+}
+
 func (t *BTree) copy(d, s btDPage, di, si, n int) error {
 	if n <= 0 {
 		return nil
@@ -460,6 +636,176 @@ func (t *BTree) copyX(d, s btXPage, di, si, n int) error {
 	return nil
 }
 
+func (t *BTree) del(cmp func(koff int64) (int, error), free func(koff, voff int64) error) (bool, error) {
+	pi := -1
+	var p btXPage
+	pc := -1
+	r, err := t.root()
+	if err != nil {
+		return false, err
+	}
+
+	if r == 0 {
+		return false, nil
+	}
+
+	q, err := t.openPage(r)
+	if err != nil {
+		return false, err
+	}
+	for {
+		switch x := q.(type) {
+		case btXPage:
+			xc, err := t.lenX(x)
+			if err != nil {
+				return false, err
+			}
+
+			i, ok, err := t.findX(x, xc, cmp)
+			if err != nil {
+				return false, err
+			}
+
+			if ok {
+				r, err := t.root()
+				if err != nil {
+					return false, err
+				}
+
+				if xc < t.kx && int64(x) != r {
+					if pi >= 0 {
+						if pc, err = t.lenX(p); err != nil {
+							return false, err
+						}
+					}
+					if x, i, err = t.underflowX(p, x, pc, xc, pi, i); err != nil {
+						return false, err
+					}
+				}
+				pi = i + 1
+				p = x
+				ch, err := t.child(x, pi)
+				if err != nil {
+					return false, err
+				}
+
+				if q, err = t.openPage(ch); err != nil {
+					return false, err
+				}
+
+				continue
+			}
+
+			r, err := t.root()
+			if err != nil {
+				return false, err
+			}
+
+			if xc < t.kx && int64(x) != r {
+				if pi >= 0 {
+					if pc, err = t.lenX(p); err != nil {
+						return false, err
+					}
+				}
+				if x, i, err = t.underflowX(p, x, pc, xc, pi, i); err != nil {
+					return false, err
+				}
+			}
+			pi = i
+			p = x
+			ch, err := t.child(x, i)
+			if err != nil {
+				return false, err
+			}
+
+			if q, err = t.openPage(ch); err != nil {
+				return false, err
+			}
+		case btDPage:
+			xc, err := t.len(x)
+			if err != nil {
+				return false, err
+			}
+
+			i, ok, err := t.find(x, xc, cmp)
+			if err != nil {
+				return false, err
+			}
+
+			if ok {
+				if err := t.extract(x, xc, i, free); err != nil {
+					return false, err
+				}
+
+				xc--
+				if xc >= t.kd {
+					return true, nil
+				}
+
+				r, err := t.root()
+				if err != nil {
+					return false, err
+				}
+
+				if int64(x) != r {
+					if err := t.underflow(x, p, xc, pi, free); err != nil {
+						return false, err
+					}
+				} else if xc == 0 {
+					if err := t.Free(int64(x)); err != nil {
+						return false, err
+					}
+
+					if err := t.setRoot(0); err != nil {
+						return false, err
+					}
+
+					if err := t.setFirst(0); err != nil {
+						return false, err
+					}
+
+					if err := t.setLast(0); err != nil {
+						return false, err
+					}
+				}
+				return true, nil
+			}
+
+			return false, nil
+		}
+	}
+}
+
+// discard deletes the item at koff, just added by put. Its key may be not set
+// yet, so the item is found by cmp of its key.
+func (t *BTree) discard(cmp func(koff int64) (int, error), koff int64) error {
+	_, err := t.del(func(off int64) (int, error) {
+		if off == koff {
+			return 0, nil
+		}
+
+		return cmp(off)
+	}, t.ownedFree(nil))
+	return err
+}
+
+// empty returns a new, empty tree in db created with the same arguments as t.
+func (t *BTree) empty(db *DB) (*BTree, error) {
+	r, err := db.NewBTree(2*t.kd, 2*t.kx, t.SzKey, t.SzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.owned {
+		if err := r.setOwned(); err != nil {
+			db.Free(r.Off)
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
 func (t *BTree) extract(d btDPage, dc, i int, free func(int64, int64) error) error {
 	if free != nil {
 		if err := free(t.key(d, i), t.val(d, i)); err != nil {
@@ -473,17 +819,10 @@ func (t *BTree) extract(d btDPage, dc, i int, free func(int64, int64) error) err
 	}
 
 	if i < dc {
-		if err := t.copy(d, d, i, i+1, dc-i); err != nil {
-			return err
-		}
-	}
-	tc, err := t.Len()
-	if err != nil {
-		return err
+		return t.copy(d, d, i, i+1, dc-i)
 	}
 
-	tc--
-	return t.setLen(tc)
+	return nil
 }
 
 func (t *BTree) extractX(x btXPage, xc, i int) error {
@@ -554,23 +893,235 @@ func (t *BTree) findX(x btXPage, xc int, cmp func(off int64) (int, error)) (int,
 	return l, false, nil
 }
 
-func (t *BTree) insert(d btDPage, dc, i int) error {
-	if i < dc {
-		if err := t.copy(d, d, i+1, i, dc-i); err != nil {
-			return err
-		}
-	}
-
-	if err := t.setLenD(d, dc+1); err != nil {
+// fixChild moves items to or merges the child of p at index pi with its
+// siblings until the child is not underfull.
+func (t *BTree) fixChild(p btXPage, pi int) error {
+	root, err := t.root()
+	if err != nil {
 		return err
 	}
 
+	for {
+		pc, err := t.lenX(p)
+		if err != nil {
+			return err
+		}
+
+		ch, err := t.child(p, pi)
+		if err != nil {
+			return err
+		}
+
+		q, err := t.openPage(ch)
+		if err != nil {
+			return err
+		}
+
+		switch x := q.(type) {
+		case btDPage:
+			xc, err := t.len(x)
+			if err != nil {
+				return err
+			}
+
+			if xc >= t.kd {
+				return nil
+			}
+
+			if err := t.underflow(x, p, xc, pi, nil); err != nil {
+				return err
+			}
+		case btXPage:
+			xc, err := t.lenX(x)
+			if err != nil {
+				return err
+			}
+
+			if xc >= t.kx {
+				return nil
+			}
+
+			if _, _, err := t.underflowX(p, x, pc, xc, pi, 0); err != nil {
+				return err
+			}
+		}
+
+		r, err := t.root()
+		if err != nil {
+			return err
+		}
+
+		if r != root {
+			return nil
+		}
+
+		n, err := t.lenX(p)
+		if err != nil {
+			return err
+		}
+
+		if n < pc { // Merged.
+			return nil
+		}
+	}
+}
+
+// fixEdge rebalances the pages on the path from the root to the first (right
+// == false) or last (right == true) data page.
+func (t *BTree) fixEdge(right bool) error {
+	var p btXPage
+	for {
+		r, err := t.root()
+		if err != nil {
+			return err
+		}
+
+		if r == 0 {
+			return nil
+		}
+
+		q, err := t.openPage(r)
+		if err != nil {
+			return err
+		}
+
+		x, ok := q.(btXPage)
+		if !ok {
+			return nil
+		}
+
+		xc, err := t.lenX(x)
+		if err != nil {
+			return err
+		}
+
+		if xc != 0 {
+			p = x
+			break
+		}
+
+		ch, err := t.child(x, 0)
+		if err != nil {
+			return err
+		}
+
+		if err := t.setRoot(ch); err != nil {
+			return err
+		}
+
+		if err := t.Free(int64(x)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		pc, err := t.lenX(p)
+		if err != nil {
+			return err
+		}
+
+		pi := 0
+		if right {
+			pi = pc
+		}
+		r0, err := t.root()
+		if err != nil {
+			return err
+		}
+
+		if err := t.fixChild(p, pi); err != nil {
+			return err
+		}
+
+		r, err := t.root()
+		if err != nil {
+			return err
+		}
+
+		if r != r0 {
+			q, err := t.openPage(r)
+			if err != nil {
+				return err
+			}
+
+			x, ok := q.(btXPage)
+			if !ok {
+				return nil
+			}
+
+			p = x
+			continue
+		}
+
+		if pc, err = t.lenX(p); err != nil {
+			return err
+		}
+
+		if right {
+			pi = pc
+		}
+		ch, err := t.child(p, pi)
+		if err != nil {
+			return err
+		}
+
+		q, err := t.openPage(ch)
+		if err != nil {
+			return err
+		}
+
+		x, ok := q.(btXPage)
+		if !ok {
+			return nil
+		}
+
+		p = x
+	}
+}
+
+func (t *BTree) height() (int, error) {
+	off, err := t.root()
+	if err != nil {
+		return 0, err
+	}
+
+	var h int
+	for off != 0 {
+		h++
+		p, err := t.openPage(off)
+		if err != nil {
+			return 0, err
+		}
+
+		x, ok := p.(btXPage)
+		if !ok {
+			break
+		}
+
+		if off, err = t.child(x, 0); err != nil {
+			return 0, err
+		}
+	}
+	return h, nil
+}
+
+func (t *BTree) incLen(delta int64) error {
 	n, err := t.Len()
 	if err != nil {
 		return err
 	}
 
-	return t.setLen(n + 1)
+	return t.setLen(n + delta)
+}
+
+func (t *BTree) insert(d btDPage, dc, i int) error {
+	if i < dc {
+		if err := t.copy(d, d, i+1, i, dc-i); err != nil {
+			return err
+		}
+	}
+
+	return t.setLenD(d, dc+1)
 }
 
 func (t *BTree) insertX(x btXPage, xc, i int, k, ch int64) error {
@@ -609,6 +1160,100 @@ func (t *BTree) insertX(x btXPage, xc, i int, k, ch int64) error {
 	return t.setChild(x, i+1, ch)
 }
 
+// join links the pages of two non empty trees. Page ofirst is the first data
+// page of other.
+func (t *BTree) join(root, oroot int64, other *BTree, ofirst btDPage) error {
+	h, err := t.height()
+	if err != nil {
+		return err
+	}
+
+	oh, err := other.height()
+	if err != nil {
+		return err
+	}
+
+	sep := t.key(ofirst, 0)
+	switch {
+	case h == oh:
+		x, err := t.newBTXPage(root)
+		if err != nil {
+			return err
+		}
+
+		if err := t.insertX(x, 0, 0, sep, oroot); err != nil {
+			return err
+		}
+
+		if err := t.setRoot(int64(x)); err != nil {
+			return err
+		}
+
+		if err := t.fixChild(x, 1); err != nil {
+			return err
+		}
+
+		if root, err = t.root(); err != nil {
+			return err
+		}
+
+		if root != int64(x) {
+			return nil
+		}
+
+		return t.fixChild(x, 0)
+	case h > oh:
+		x, err := t.spine(root, h-oh-1, true)
+		if err != nil {
+			return err
+		}
+
+		xc, err := t.lenX(x)
+		if err != nil {
+			return err
+		}
+
+		if err := t.insertX(x, xc, xc, sep, oroot); err != nil {
+			return err
+		}
+
+		return t.fixChild(x, xc+1)
+	default:
+		x, err := other.spine(oroot, oh-h-1, false)
+		if err != nil {
+			return err
+		}
+
+		if oroot, err = other.root(); err != nil {
+			return err
+		}
+
+		if err := t.setRoot(oroot); err != nil {
+			return err
+		}
+
+		xc, err := t.lenX(x)
+		if err != nil {
+			return err
+		}
+
+		ch, err := t.child(x, 0)
+		if err != nil {
+			return err
+		}
+
+		if err := t.insertX(x, xc, 0, sep, ch); err != nil {
+			return err
+		}
+
+		if err := t.setChild(x, 0, root); err != nil {
+			return err
+		}
+
+		return t.fixChild(x, 0)
+	}
+}
+
 func (t *BTree) key(d btDPage, i int) int64 {
 	return int64(d) + oBTDPageItems + int64(i)*(t.SzKey+t.SzVal)
 }
@@ -783,17 +1428,188 @@ func (t *BTree) overflow(d btDPage, p btXPage, dc, pc, pi, i int) (btDPage, int,
 	return t.split(d, p, pi, i)
 }
 
+// ownedFree returns free wrapped to also free the value block of an item
+// being deleted from a tree owning its values.
+func (t *BTree) ownedFree(free func(koff, voff int64) error) func(koff, voff int64) error {
+	if !t.owned {
+		return free
+	}
+
+	return func(koff, voff int64) error {
+		if free != nil {
+			if err := free(koff, voff); err != nil {
+				return err
+			}
+		}
+
+		if voff == 0 {
+			return nil
+		}
+
+		off, err := t.r8(voff)
+		if err != nil || off == 0 {
+			return err
+		}
+
+		return t.Free(off)
+	}
+}
+
 func (t *BTree) prev(d btDPage) (btDPage, error) {
 	off, err := t.r8(int64(d) + oBTDPagePrev)
 	return btDPage(off), err
 }
 
-func (t *BTree) setChild(x btXPage, i int, c int64) error {
-	return t.w8(int64(x)+oBTXPageItems+int64(i)*16, c)
-}
+func (t *BTree) put(cmp func(koff int64) (int, error)) (int64, int64, bool, error) {
+	pi := -1
+	r, err := t.root()
+	if err != nil {
+		return 0, 0, false, err
+	}
 
-func (t *BTree) setKey(x btXPage, i int, k int64) error {
-	return t.w8(int64(x)+oBTXPageItems+int64(i)*16+8, k)
+	if r == 0 {
+		z, err := t.newBTDPage()
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if err := t.insert(z, 0, 0); err != nil {
+			return 0, 0, false, err
+		}
+
+		if err := t.setRoot(int64(z)); err != nil {
+			return 0, 0, false, err
+		}
+
+		if err := t.setFirst(z); err != nil {
+			return 0, 0, false, err
+		}
+
+		if err := t.setLast(z); err != nil {
+			return 0, 0, false, err
+		}
+
+		return t.key(z, 0), t.val(z, 0), false, nil
+	}
+
+	q, err := t.openPage(r)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var p btXPage
+	pc := -1
+	for {
+		switch x := q.(type) {
+		case btXPage:
+			xc, err := t.lenX(x)
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			i, ok, err := t.findX(x, xc, cmp)
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			if p != 0 {
+				if pc, err = t.lenX(p); err != nil {
+					return 0, 0, false, err
+				}
+			}
+
+			if ok {
+				i++
+				if xc > 2*t.kx {
+					if x, i, err = t.splitX(p, x, pc, xc, pi, i); err != nil {
+						return 0, 0, false, err
+					}
+				}
+				pi = i
+				p = x
+				ch, err := t.child(x, i)
+				if err != nil {
+					return 0, 0, false, err
+				}
+
+				if q, err = t.openPage(ch); err != nil {
+					return 0, 0, false, err
+				}
+
+				continue
+			}
+
+			if xc > 2*t.kx {
+				if x, i, err = t.splitX(p, x, pc, xc, pi, i); err != nil {
+					return 0, 0, false, err
+				}
+			}
+			pi = i
+			p = x
+			ch, err := t.child(x, i)
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			if q, err = t.openPage(ch); err != nil {
+				return 0, 0, false, err
+			}
+		case btDPage:
+			xc, err := t.len(x)
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			i, ok, err := t.find(x, xc, cmp)
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			if ok {
+				return t.key(x, i), t.val(x, i), true, nil
+			}
+
+			switch {
+			case xc < 2*t.kd:
+				if err := t.insert(x, xc, i); err != nil {
+					return 0, 0, false, err
+				}
+			default:
+				pc, err := t.lenX(p)
+				if err != nil {
+					return 0, 0, false, err
+				}
+
+				q, j, err := t.overflow(x, p, xc, pc, pi, i)
+				if err != nil {
+					return 0, 0, false, err
+				}
+
+				if q != 0 {
+					x = q
+					i = j
+				}
+			}
+			return t.key(x, i), t.val(x, i), false, nil
+		}
+	}
+}
+
+func (t *BTree) setChild(x btXPage, i int, c int64) error {
+	return t.w8(int64(x)+oBTXPageItems+int64(i)*16, c)
+}
+
+func (t *BTree) setKey(x btXPage, i int, k int64) error {
+	return t.w8(int64(x)+oBTXPageItems+int64(i)*16+8, k)
+}
+
+func (t *BTree) setOwned() error {
+	if err := t.w8(t.Off+oBTSzVal, t.SzVal|btOwnedValues); err != nil {
+		return err
+	}
+
+	t.owned = true
+	return nil
 }
 
 func (t *BTree) siblings(x btXPage, xc, i int) (l, r btDPage, err error) {
@@ -907,6 +1723,201 @@ func (t *BTree) split(d btDPage, p btXPage, pi, i int) (q btDPage, j int, err er
 	return 0, 0, t.insert(d, t.kd, i)
 }
 
+// spine descends n levels from root along the first (right == false) or last
+// (right == true) children, splitting full index pages like Set does, and
+// returns the index page reached.
+func (t *BTree) spine(root int64, n int, right bool) (btXPage, error) {
+	x := t.openXPage(root)
+	var p btXPage
+	pi, pc := -1, -1
+	for {
+		xc, err := t.lenX(x)
+		if err != nil {
+			return 0, err
+		}
+
+		i := 0
+		if right {
+			i = xc
+		}
+		if xc > 2*t.kx {
+			if p != 0 {
+				if pc, err = t.lenX(p); err != nil {
+					return 0, err
+				}
+			}
+
+			if x, i, err = t.splitX(p, x, pc, xc, pi, i); err != nil {
+				return 0, err
+			}
+		}
+
+		if n == 0 {
+			return x, nil
+		}
+
+		ch, err := t.child(x, i)
+		if err != nil {
+			return 0, err
+		}
+
+		n--
+		pi = i
+		p = x
+		x = t.openXPage(ch)
+	}
+}
+
+// splitPage splits the subtree at off to items collating before cmp and the
+// rest. It returns the roots of both parts, zero if a part is empty, and the
+// data pages on both sides of the cut.
+func (t *BTree) splitPage(off int64, cmp func(int64) (int, error)) (l, r int64, last, first btDPage, err error) {
+	p, err := t.openPage(off)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	switch x := p.(type) {
+	case btDPage:
+		dc, err := t.len(x)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		i, _, err := t.find(x, dc, cmp)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		switch {
+		case i == 0:
+			prev, err := t.prev(x)
+			return 0, off, prev, x, err
+		case i == dc:
+			next, err := t.next(x)
+			return off, 0, x, next, err
+		}
+
+		y, err := t.newBTDPage()
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if err := t.copy(y, x, 0, i, dc-i); err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if err := t.setLenD(y, dc-i); err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if err := t.setLenD(x, i); err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		next, err := t.next(x)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if next != 0 {
+			if err := t.setNext(y, next); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if err := t.setPrev(next, y); err != nil {
+				return 0, 0, 0, 0, err
+			}
+		}
+		return off, int64(y), x, y, nil
+	case btXPage:
+		xc, err := t.lenX(x)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		i, ok, err := t.findX(x, xc, cmp)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if ok {
+			i++
+		}
+		ch, err := t.child(x, i)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		cl, cr, last, first, err := t.splitPage(ch, cmp)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		if cr != 0 || i < xc {
+			n := xc - i
+			si := i
+			if cr == 0 {
+				n--
+				si++
+			}
+			y, err := t.newBTXPage(0)
+			if err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if err := t.copyX(y, x, 0, si, n); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if ch, err = t.child(x, xc); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if err := t.setChild(y, n, ch); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if cr != 0 {
+				if err := t.setChild(y, 0, cr); err != nil {
+					return 0, 0, 0, 0, err
+				}
+			}
+
+			if err := t.setLenX(y, n); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			r = int64(y)
+		}
+
+		switch {
+		case cl != 0:
+			if err := t.setChild(x, i, cl); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			if err := t.setLenX(x, i); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			l = off
+		case i != 0:
+			if err := t.setLenX(x, i-1); err != nil {
+				return 0, 0, 0, 0, err
+			}
+
+			l = off
+		default:
+			if err := t.Free(off); err != nil {
+				return 0, 0, 0, 0, err
+			}
+		}
+		return l, r, last, first, nil
+	}
+	panic("internal error")
+}
+
 func (t *BTree) splitX(p, q btXPage, pc, qc, pi, i int) (btXPage, int, error) {
 	r, err := t.newBTXPage(0)
 	if err != nil {
@@ -1179,6 +2190,7 @@ func (t *BTree) Len() (int64, error) { return t.r8(t.Off + oBTLen) } //TODO no e
 // key and value of an item that is being deleted from the tree. Both koff and
 // voff may be zero when appropriate.
 func (t *BTree) Clear(free func(koff, voff int64) error) error {
+	free = t.ownedFree(free)
 	r, err := t.root()
 	if err != nil {
 		return err
@@ -1229,148 +2241,192 @@ func (t *BTree) Clear(free func(koff, voff int64) error) error {
 	return t.setRoot(0)
 }
 
-// Delete removes an item from t and returns a boolean value indicating if the
-// item was found.
+// CloneTo copies t to dst, which may be the DB of t, and returns the new tree
+// or an error, if any. The pages of t are copied one by one and the offsets
+// linking them are rewritten, no items are re-inserted.
 //
-// The item is searched for by calling the cmp function that gets the offset of
-// a tree key to compare. It returns a positive value if the desired key
-// collates after the tree key, a zero if the keys are equal and a negative
-// value if the desired key collates before the tree key.
+// The clone function may be nil, otherwise it's called with the offsets of the
+// key and value of every item of the new tree after all pages were copied. It
+// can be used to deep copy data referred to by keys or values, like offsets of
+// other allocated storage blocks.
 //
-// For discussion of the free function see Clear.
-func (t *BTree) Delete(cmp func(koff int64) (int, error), free func(koff, voff int64) error) (bool, error) {
-	pi := -1
-	var p btXPage
-	pc := -1
-	r, err := t.root()
+// If an error occurs, the partially copied tree is freed, except for data
+// already deep copied by the clone function.
+func (t *BTree) CloneTo(dst *DB, clone func(koff, voff int64) error) (*BTree, error) {
+	r, err := t.empty(dst)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if r == 0 {
-		return false, nil
+	root, err := t.root()
+	if err != nil {
+		r.Free(r.Off)
+		return nil, err
 	}
 
-	q, err := t.openPage(r)
-	if err != nil {
-		return false, err
+	if root == 0 {
+		return r, nil
 	}
-	for {
-		switch x := q.(type) {
-		case btXPage:
-			xc, err := t.lenX(x)
-			if err != nil {
-				return false, err
-			}
 
-			i, ok, err := t.findX(x, xc, cmp)
-			if err != nil {
-				return false, err
-			}
+	c := &btCopy{
+		dst: r,
+		items: func(x, d btDPage, dc int) error {
+			return copyStorage(r, r.key(d, 0), t, t.key(x, 0), int64(dc)*(t.SzKey+t.SzVal))
+		},
+		m:  map[btDPage]btDPage{},
+		op: "CloneTo",
+	}
+	fail := func(err error) (*BTree, error) {
+		c.free()
+		r.Free(r.Off)
+		return nil, err
+	}
 
-			if ok {
-				r, err := t.root()
-				if err != nil {
-					return false, err
-				}
+	if root, err = t.copyPage(c, root); err != nil {
+		return fail(err)
+	}
 
-				if xc < t.kx && int64(x) != r {
-					if pi >= 0 {
-						if pc, err = t.lenX(p); err != nil {
-							return false, err
-						}
-					}
-					if x, i, err = t.underflowX(p, x, pc, xc, pi, i); err != nil {
-						return false, err
-					}
-				}
-				pi = i + 1
-				p = x
-				ch, err := t.child(x, pi)
-				if err != nil {
-					return false, err
-				}
+	if err := r.setRoot(root); err != nil {
+		return fail(err)
+	}
 
-				if q, err = t.openPage(ch); err != nil {
-					return false, err
-				}
+	if err := r.setFirst(c.first); err != nil {
+		return fail(err)
+	}
 
-				continue
-			}
+	if err := t.cloneItems(r, c.last, clone); err != nil {
+		r.Remove(nil)
+		return nil, err
+	}
 
-			r, err := t.root()
-			if err != nil {
-				return false, err
-			}
+	return r, nil
+}
 
-			if xc < t.kx && int64(x) != r {
-				if pi >= 0 {
-					if pc, err = t.lenX(p); err != nil {
-						return false, err
-					}
-				}
-				if x, i, err = t.underflowX(p, x, pc, xc, pi, i); err != nil {
-					return false, err
-				}
-			}
-			pi = i
-			p = x
-			ch, err := t.child(x, i)
-			if err != nil {
-				return false, err
-			}
+// cloneItems finishes CloneTo of t to r. On error, the value slots of r
+// still referring to value blocks of t are zeroed, so removing r does not
+// free them.
+func (t *BTree) cloneItems(r *BTree, last btDPage, clone func(koff, voff int64) error) (err error) {
+	if err := r.setLast(last); err != nil {
+		return err
+	}
 
-			if q, err = t.openPage(ch); err != nil {
-				return false, err
-			}
-		case btDPage:
-			xc, err := t.len(x)
-			if err != nil {
-				return false, err
-			}
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
 
-			i, ok, err := t.find(x, xc, cmp)
-			if err != nil {
-				return false, err
-			}
+	if err := r.setLen(n); err != nil {
+		return err
+	}
 
-			if ok {
-				if err := t.extract(x, xc, i, free); err != nil {
-					return false, err
-				}
+	if clone == nil && !t.owned {
+		return nil
+	}
 
-				xc--
-				if xc >= t.kd {
-					return true, nil
-				}
+	e, err := r.SeekFirst()
+	if err != nil {
+		return err
+	}
 
-				r, err := t.root()
-				if err != nil {
-					return false, err
-				}
+	cloned := true
+	defer func() {
+		if err == nil || !t.owned {
+			return
+		}
 
-				if int64(x) != r {
-					if err := t.underflow(x, p, xc, pi, free); err != nil {
-						return false, err
-					}
-				} else {
-					tc, err := t.Len()
-					if err != nil {
-						return false, err
-					}
+		if !cloned {
+			r.w8(e.V, 0)
+		}
+		for e.Next() {
+			r.w8(e.V, 0)
+		}
+	}()
 
-					if tc == 0 {
-						if err := t.Clear(free); err != nil {
-							return false, err
-						}
-					}
-				}
-				return true, nil
+	for e.Next() {
+		if t.owned {
+			cloned = false
+			if err := t.cloneValue(r, e.V); err != nil {
+				return err
 			}
 
-			return false, nil
+			cloned = true
+		}
+
+		if clone != nil {
+			if err := clone(e.K, e.V); err != nil {
+				return err
+			}
+		}
+	}
+	return e.Err()
+}
+
+// CompareAndSwap searches for a key in the tree and, if the value of the item
+// found is equal to expected, overwrites it with value. It returns a boolean
+// value indicating the value was swapped or an error, if any. The expected and
+// value arguments must have length equal to SzVal, except for trees owning
+// their values, where they may have any length.
+//
+// For discussion of the cmp function see Delete.
+func (t *BTree) CompareAndSwap(cmp func(koff int64) (int, error), expected, value []byte) (bool, error) {
+	if !t.owned && (int64(len(expected)) != t.SzVal || int64(len(value)) != t.SzVal) {
+		panic(fmt.Errorf("%T.CompareAndSwap: invalid argument", t))
+	}
+
+	voff, ok, err := t.Get(cmp)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if t.owned {
+		b, err := t.Value(voff)
+		if err != nil || !bytes.Equal(b, expected) {
+			return false, err
+		}
+
+		return true, t.WriteValue(voff, value)
+	}
+
+	p := buffer.Get(len(expected))
+	b := *p
+	if n, err := t.ReadAt(b, voff); n != len(b) {
+		if err == nil {
+			panic("internal error")
 		}
+
+		buffer.Put(p)
+		return false, err
+	}
+
+	ok = bytes.Equal(b, expected)
+	buffer.Put(p)
+	if !ok {
+		return false, nil
+	}
+
+	if _, err := t.WriteAt(value, voff); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Delete removes an item from t and returns a boolean value indicating if the
+// item was found.
+//
+// The item is searched for by calling the cmp function that gets the offset of
+// a tree key to compare. It returns a positive value if the desired key
+// collates after the tree key, a zero if the keys are equal and a negative
+// value if the desired key collates before the tree key.
+//
+// For discussion of the free function see Clear.
+func (t *BTree) Delete(cmp func(koff int64) (int, error), free func(koff, voff int64) error) (bool, error) {
+	ok, err := t.del(cmp, t.ownedFree(free))
+	if err != nil || !ok {
+		return false, err
 	}
+
+	return true, t.incLen(-1)
 }
 
 // Get searches for a key in the tree and returns the offset of its associated
@@ -1446,6 +2502,105 @@ func (t *BTree) Get(cmp func(koff int64) (int, error)) (int64, bool, error) {
 	}
 }
 
+// Join moves all items of other to t and leaves other empty. The trees must
+// be in the same DB, must have been created using the same arguments of
+// NewBTree and all keys of other must collate after all keys of t. Join moves
+// whole pages and rewrites only O(log n) of them.
+func (t *BTree) Join(other *BTree) error {
+	if other.DB != t.DB || other.Off == t.Off ||
+		other.kd != t.kd || other.kx != t.kx || other.owned != t.owned ||
+		other.SzKey != t.SzKey || other.SzVal != t.SzVal {
+		return fmt.Errorf("%T.Join: incompatible trees", t)
+	}
+
+	oroot, err := other.root()
+	if err != nil {
+		return err
+	}
+
+	if oroot == 0 {
+		return nil
+	}
+
+	ofirst, err := other.first()
+	if err != nil {
+		return err
+	}
+
+	olast, err := other.last()
+	if err != nil {
+		return err
+	}
+
+	on, err := other.Len()
+	if err != nil {
+		return err
+	}
+
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+
+	root, err := t.root()
+	if err != nil {
+		return err
+	}
+
+	last, err := t.last()
+	if err != nil {
+		return err
+	}
+
+	if err := t.setLast(btDPage(olast)); err != nil {
+		return err
+	}
+
+	if err := t.setLen(n + on); err != nil {
+		return err
+	}
+
+	switch {
+	case root == 0:
+		if err := t.setFirst(btDPage(ofirst)); err != nil {
+			return err
+		}
+
+		if err := t.setRoot(oroot); err != nil {
+			return err
+		}
+	default:
+		if err := t.setNext(btDPage(last), btDPage(ofirst)); err != nil {
+			return err
+		}
+
+		if err := t.setPrev(btDPage(ofirst), btDPage(last)); err != nil {
+			return err
+		}
+
+		if err := t.join(root, oroot, other, btDPage(ofirst)); err != nil {
+			return err
+		}
+	}
+
+	if err := other.setRoot(0); err != nil {
+		return err
+	}
+
+	if err := other.setFirst(0); err != nil {
+		return err
+	}
+
+	if err := other.setLast(0); err != nil {
+		return err
+	}
+
+	return other.setLen(0)
+}
+
+// Owned returns whether t owns its values, see NewOwnedBTree.
+func (t *BTree) Owned() bool { return t.owned }
+
 // Remove frees all space used by t.
 //
 // For discussion of the free function see Clear.
@@ -1455,7 +2610,7 @@ func (t *BTree) Remove(free func(koff, voff int64) error) (err error) {
 		return err
 	}
 
-	if err := t.clr(r, free); err != nil {
+	if err := t.clr(r, t.ownedFree(free)); err != nil {
 		return err
 	}
 
@@ -1467,6 +2622,94 @@ func (t *BTree) Remove(free func(koff, voff int64) error) (err error) {
 	return nil
 }
 
+// ResizeValues changes the size of the values of t to newSzVal. Every page is
+// copied once, data pages with the new item width, keeping their items, so no
+// items are reinserted and no pages are split or merged. The tree is switched
+// to the copy only after it is complete and the old pages are freed
+// afterwards. If an error occurs before the switch, the copy is freed and t
+// is left unchanged. The offsets of the items change.
+//
+// The new value of every item is initialized to the old value, truncated or
+// padded with zeros to newSzVal bytes. The fill function may be nil,
+// otherwise it's called for every item, in key order, with the offsets of its
+// old and new value and may modify the new value.
+//
+// Values of trees owning their values cannot be resized.
+func (t *BTree) ResizeValues(newSzVal int64, fill func(old, new int64) error) error {
+	if newSzVal < 0 || newSzVal >= btOwnedValues {
+		panic(fmt.Errorf("%T.ResizeValues: invalid argument", t))
+	}
+
+	if t.owned {
+		return fmt.Errorf("%T.ResizeValues: tree owns its values", t)
+	}
+
+	if newSzVal == t.SzVal && fill == nil {
+		return nil
+	}
+
+	root, err := t.root()
+	if err != nil {
+		return err
+	}
+
+	n := *t
+	n.SzVal = newSzVal
+	c := &btCopy{
+		dst: &n,
+		items: func(x, d btDPage, dc int) error {
+			sz := mathutil.MinInt64(t.SzVal, n.SzVal)
+			z := make([]byte, n.SzVal-sz)
+			for i := 0; i < dc; i++ {
+				if err := copyStorage(&n, n.key(d, i), t, t.key(x, i), t.SzKey+sz); err != nil {
+					return err
+				}
+
+				if len(z) != 0 {
+					if _, err := n.WriteAt(z, n.val(d, i)+sz); err != nil {
+						return err
+					}
+				}
+
+				if fill != nil {
+					if err := fill(t.val(x, i), n.val(d, i)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		m:  map[btDPage]btDPage{},
+		op: "ResizeValues",
+	}
+	var r int64
+	if root != 0 {
+		if r, err = t.copyPage(c, root); err != nil {
+			c.free()
+			return err
+		}
+	}
+
+	if err := t.setRoot(r); err != nil {
+		return err
+	}
+
+	if err := t.setFirst(c.first); err != nil {
+		return err
+	}
+
+	if err := t.setLast(c.last); err != nil {
+		return err
+	}
+
+	if err := t.w8(t.Off+oBTSzVal, newSzVal); err != nil {
+		return err
+	}
+
+	t.SzVal = newSzVal
+	return t.clr(root, nil)
+}
+
 // Seek searches the tree for a key collating after the key used by the cmp
 // function and a boolean value indicating the desired and found keys are
 // equal.
@@ -1479,7 +2722,7 @@ func (t *BTree) Seek(cmp func(int64) (int, error)) (*BTreeCursor, bool, error) {
 	}
 
 	if r == 0 {
-		return &BTreeCursor{}, false, nil
+		return &BTreeCursor{t: t}, false, nil
 	}
 
 	q, err := t.openPage(r)
@@ -1549,7 +2792,7 @@ func (t *BTree) SeekFirst() (*BTreeCursor, error) {
 	}
 
 	if p == 0 {
-		return &BTreeCursor{}, nil
+		return &BTreeCursor{t: t}, nil
 	}
 
 	d := t.openDPage(p)
@@ -1570,7 +2813,7 @@ func (t *BTree) SeekLast() (*BTreeCursor, error) {
 	}
 
 	if p == 0 {
-		return &BTreeCursor{}, nil
+		return &BTreeCursor{t: t}, nil
 	}
 
 	d := t.openDPage(p)
@@ -1586,150 +2829,342 @@ func (t *BTree) SeekLast() (*BTreeCursor, error) {
 
 // Set adds or overwrites an item in t and returns the offsets if its key and value or an error, if any.
 //
+// If t owns its values, a new item has an empty value and the value of an
+// existing item is not changed. Use SetValue or WriteValue to set it.
+//
 // For discussion of the cmp function see Delete.
 //
 // For discussion of the free function see Clear.
 func (t *BTree) Set(cmp func(koff int64) (int, error), free func(koff int64) error) (int64, int64, error) {
-	pi := -1
-	r, err := t.root()
+	koff, voff, ok, err := t.put(cmp)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	if r == 0 {
-		z, err := t.newBTDPage()
-		if err != nil {
+	switch {
+	case !ok:
+		if err := t.added(voff); err != nil {
 			return 0, 0, err
 		}
 
-		if err := t.insert(z, 0, 0); err != nil {
+		if err := t.incLen(1); err != nil {
 			return 0, 0, err
 		}
-
-		if err := t.setRoot(int64(z)); err != nil {
+	case free != nil:
+		if err := free(voff); err != nil {
 			return 0, 0, err
 		}
+	}
 
-		if err := t.setFirst(z); err != nil {
-			return 0, 0, err
+	return koff, voff, nil
+}
+
+// SetIfAbsent adds an item to t if its key is not yet present in t. It
+// returns the offsets of the key and value of the new or existing item and a
+// boolean value indicating the item was inserted or an error, if any. The
+// caller is responsible for setting the key and value of a new item only.
+//
+// For discussion of the cmp function see Delete.
+func (t *BTree) SetIfAbsent(cmp func(koff int64) (int, error)) (int64, int64, bool, error) {
+	koff, voff, ok, err := t.put(cmp)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if !ok {
+		if err := t.added(voff); err != nil {
+			return 0, 0, false, err
 		}
 
-		if err := t.setLast(z); err != nil {
-			return 0, 0, err
+		if err := t.incLen(1); err != nil {
+			return 0, 0, false, err
 		}
+	}
+
+	return koff, voff, !ok, nil
+}
 
-		return t.key(z, 0), t.val(z, 0), nil
+// SetValue adds or overwrites an item in t, which must own its values, and
+// sets its value to v. It returns the offsets of the item key and value slot
+// or an error, if any. The key of a new item must be set by the caller. The
+// existing value block, if any, is reused when v fits into it, otherwise it
+// is resized using Realloc.
+//
+// For discussion of the cmp function see Delete.
+func (t *BTree) SetValue(cmp func(koff int64) (int, error), v []byte) (int64, int64, error) {
+	if !t.owned {
+		return 0, 0, fmt.Errorf("%T.SetValue: tree does not own its values", t)
 	}
 
-	q, err := t.openPage(r)
+	koff, voff, err := t.Set(cmp, nil)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	var p btXPage
-	pc := -1
-	for {
-		switch x := q.(type) {
-		case btXPage:
-			xc, err := t.lenX(x)
-			if err != nil {
-				return 0, 0, err
-			}
+	return koff, voff, t.WriteValue(voff, v)
+}
 
-			i, ok, err := t.findX(x, xc, cmp)
-			if err != nil {
-				return 0, 0, err
-			}
+// SplitAt moves all items of t with keys collating before the key used by the
+// cmp function to a new tree in the DB of t and returns the new tree or an
+// error, if any. Items are moved by whole pages, only O(log n) pages on the
+// edges of the split are rewritten.
+//
+// For discussion of the cmp function see Delete.
+func (t *BTree) SplitAt(cmp func(koff int64) (int, error)) (_ *BTree, err error) {
+	u, err := t.empty(t.DB)
+	if err != nil {
+		return nil, err
+	}
 
-			if p != 0 {
-				if pc, err = t.lenX(p); err != nil {
-					return 0, 0, err
-				}
-			}
+	// The pages of u are reachable from t until the root of t is set to
+	// the right part.
+	moved := false
+	defer func() {
+		switch {
+		case err == nil:
+			// nop
+		case moved:
+			u.Remove(nil)
+		default:
+			u.Free(u.Off)
+		}
+	}()
 
-			if ok {
-				i++
-				if xc > 2*t.kx {
-					if x, i, err = t.splitX(p, x, pc, xc, pi, i); err != nil {
-						return 0, 0, err
-					}
-				}
-				pi = i
-				p = x
-				ch, err := t.child(x, i)
-				if err != nil {
-					return 0, 0, err
-				}
+	root, err := t.root()
+	if err != nil {
+		return nil, err
+	}
 
-				if q, err = t.openPage(ch); err != nil {
-					return 0, 0, err
-				}
+	if root == 0 {
+		return u, nil
+	}
 
-				continue
-			}
+	l, r, last, first, err := t.splitPage(root, cmp)
+	if err != nil {
+		return nil, err
+	}
 
-			if xc > 2*t.kx {
-				if x, i, err = t.splitX(p, x, pc, xc, pi, i); err != nil {
-					return 0, 0, err
-				}
-			}
-			pi = i
-			p = x
-			ch, err := t.child(x, i)
-			if err != nil {
-				return 0, 0, err
-			}
+	if last != 0 {
+		if err := t.setNext(last, 0); err != nil {
+			return nil, err
+		}
+	}
 
-			if q, err = t.openPage(ch); err != nil {
-				return 0, 0, err
-			}
-		case btDPage:
-			xc, err := t.len(x)
-			if err != nil {
-				return 0, 0, err
-			}
+	if first != 0 {
+		if err := t.setPrev(first, 0); err != nil {
+			return nil, err
+		}
+	}
 
-			i, ok, err := t.find(x, xc, cmp)
-			if err != nil {
-				return 0, 0, err
+	// Count the items of the smaller part.
+	var c, rc int64
+	for a, b := last, first; ; {
+		if a == 0 {
+			break
+		}
+
+		if b == 0 {
+			if c, err = t.Len(); err != nil {
+				return nil, err
 			}
 
-			if ok {
-				koff := t.key(x, i)
-				voff := t.val(x, i)
-				if free != nil {
-					if err := free(voff); err != nil {
-						return 0, 0, err
-					}
-				}
+			c -= rc
+			break
+		}
 
-				return koff, voff, nil
-			}
+		n, err := t.len(a)
+		if err != nil {
+			return nil, err
+		}
 
-			switch {
-			case xc < 2*t.kd:
-				if err := t.insert(x, xc, i); err != nil {
-					return 0, 0, err
-				}
-			default:
-				pc, err := t.lenX(p)
-				if err != nil {
-					return 0, 0, err
-				}
+		c += int64(n)
+		if a, err = t.prev(a); err != nil {
+			return nil, err
+		}
 
-				q, j, err := t.overflow(x, p, xc, pc, pi, i)
-				if err != nil {
-					return 0, 0, err
-				}
+		if n, err = t.len(b); err != nil {
+			return nil, err
+		}
 
-				if q != 0 {
-					x = q
-					i = j
-				}
-			}
-			return t.key(x, i), t.val(x, i), nil
+		rc += int64(n)
+		if b, err = t.next(b); err != nil {
+			return nil, err
 		}
 	}
+
+	if l != 0 {
+		tfirst, err := t.first()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := u.setRoot(l); err != nil {
+			return nil, err
+		}
+
+		if err := u.setFirst(btDPage(tfirst)); err != nil {
+			return nil, err
+		}
+
+		if err := u.setLast(last); err != nil {
+			return nil, err
+		}
+
+		if err := u.setLen(c); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := t.Len()
+	if err != nil {
+		return nil, err
+	}
+
+	tlast, err := t.last()
+	if err != nil {
+		return nil, err
+	}
+
+	if r == 0 || tlast == int64(last) {
+		tlast = int64(first)
+	}
+	if err := t.setRoot(r); err != nil {
+		return nil, err
+	}
+
+	moved = true
+	if err := t.setFirst(first); err != nil {
+		return nil, err
+	}
+
+	if err := t.setLast(btDPage(tlast)); err != nil {
+		return nil, err
+	}
+
+	if err := t.setLen(n - c); err != nil {
+		return nil, err
+	}
+
+	if err := u.fixEdge(true); err != nil {
+		return nil, err
+	}
+
+	if err := t.fixEdge(false); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Upsert adds an item to t or finds an existing one and calls fn with the
+// offset of its value and a boolean value indicating the item existed before.
+// It returns the offsets of the key and value of the item and a boolean value
+// indicating the item was inserted or an error, if any. The key of a new item
+// must be set by the caller. If fn returns an error, a new item is deleted
+// again.
+//
+// For discussion of the cmp function see Delete.
+func (t *BTree) Upsert(cmp func(koff int64) (int, error), fn func(voff int64, existed bool) error) (int64, int64, bool, error) {
+	koff, voff, ok, err := t.put(cmp)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if !ok {
+		if err := t.added(voff); err != nil {
+			t.discard(cmp, koff)
+			return 0, 0, false, err
+		}
+
+		if err := t.incLen(1); err != nil {
+			t.discard(cmp, koff)
+			return 0, 0, false, err
+		}
+	}
+
+	if err := fn(voff, ok); err != nil {
+		if !ok && t.discard(cmp, koff) == nil {
+			t.incLen(-1)
+		}
+		return 0, 0, false, err
+	}
+
+	return koff, voff, !ok, nil
+}
+
+// Value returns a copy of the value of an item of t, which must own its
+// values, or an error, if any. The voff argument is the offset of the item
+// value slot as returned by Get, Set or a BTreeCursor.
+func (t *BTree) Value(voff int64) ([]byte, error) {
+	if !t.owned {
+		return nil, fmt.Errorf("%T.Value: tree does not own its values", t)
+	}
+
+	off, err := t.r8(voff)
+	if err != nil {
+		return nil, err
+	}
+
+	if off == 0 {
+		return []byte{}, nil
+	}
+
+	b, ok, err := readPayload(t, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%T.Value: corrupted value at %#x", t, off)
+	}
+
+	return b, nil
+}
+
+// WriteValue sets the value of an item of t, which must own its values, to v.
+// The voff argument is the offset of the item value slot. Setting an empty
+// value frees the value block.
+func (t *BTree) WriteValue(voff int64, v []byte) error {
+	if !t.owned {
+		return fmt.Errorf("%T.WriteValue: tree does not own its values", t)
+	}
+
+	off, err := t.r8(voff)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(v) == 0:
+		if off == 0 {
+			return nil
+		}
+
+		if err := t.Free(off); err != nil {
+			return err
+		}
+
+		return t.w8(voff, 0)
+	case off != 0:
+		ok, err := writePayload(t, off, v)
+		if err != nil || ok {
+			return err
+		}
+
+		if off, err = t.Realloc(off, oPayloadData+int64(len(v))); err != nil {
+			return err
+		}
+	default:
+		if off, err = t.Alloc(oPayloadData + int64(len(v))); err != nil {
+			return err
+		}
+	}
+
+	if err := initPayload(t, off, v); err != nil {
+		return err
+	}
+
+	return t.w8(voff, off)
 }
 
 // BTreeCursor provides enumerating BTree items.
@@ -177,6 +177,42 @@ func (t *BTree) clear(tb testing.TB) {
 	}
 }
 
+func (t *BTree) clone(tb testing.TB, dst *DB) *BTree {
+	cp := func(off int64) error {
+		p, err := dst.r8(off)
+		if err != nil {
+			return err
+		}
+
+		n, err := t.r4(p)
+		if err != nil {
+			return err
+		}
+
+		if p, err = dst.Alloc(4); err != nil {
+			return err
+		}
+
+		if err := dst.w4(p, n); err != nil {
+			return err
+		}
+
+		return dst.w8(off, p)
+	}
+	r, err := t.CloneTo(dst, func(k, v int64) error {
+		if err := cp(k); err != nil {
+			return err
+		}
+
+		return cp(v)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return r
+}
+
 func (t *BTree) delete(tb testing.TB, k int) bool {
 	ok, err := t.Delete(t.cmp(k), func(k, v int64) error {
 		p, err := t.r8(k)
@@ -328,6 +364,176 @@ func (e *BTreeCursor) prev(tb testing.TB) (int, int, bool) {
 	return 0, 0, false
 }
 
+// verify checks the structure of t. Keys are int32 values pointed to by
+// int64 tree keys.
+func (t *BTree) verify(tb testing.TB) { t.verifyKeys(tb, false) }
+
+// verifyDirect is like verify but the int32 keys are stored directly in the
+// tree keys.
+func (t *BTree) verifyDirect(tb testing.TB) { t.verifyKeys(tb, true) }
+
+func (t *BTree) verifyKeys(tb testing.TB, direct bool) {
+	ikey := func(koff int64) int {
+		p := koff
+		if !direct {
+			var err error
+			if p, err = t.r8(koff); err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		k, err := t.r4(p)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		return k
+	}
+
+	root, err := t.root()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var leaves []btDPage
+	var n int64
+	depth := -1
+	var walk func(off int64, level int) btDPage
+	walk = func(off int64, level int) btDPage {
+		p, err := t.openPage(off)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		switch x := p.(type) {
+		case btDPage:
+			if depth < 0 {
+				depth = level
+			}
+			if level != depth {
+				tb.Fatalf("unbalanced tree: %v %v", level, depth)
+			}
+
+			c, err := t.len(x)
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			if c == 0 || off != root && c < t.kd || c > 2*t.kd {
+				tb.Fatalf("invalid data page length %v", c)
+			}
+
+			n += int64(c)
+			leaves = append(leaves, x)
+			return x
+		case btXPage:
+			c, err := t.lenX(x)
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			if c == 0 || off != root && c < t.kx-1 || c > 2*t.kx+1 {
+				tb.Fatalf("invalid index page length %v", c)
+			}
+
+			var first btDPage
+			for i := 0; i <= c; i++ {
+				ch, err := t.child(x, i)
+				if err != nil {
+					tb.Fatal(err)
+				}
+
+				d := walk(ch, level+1)
+				switch {
+				case i == 0:
+					first = d
+				default:
+					k, err := t.keyX(x, i-1)
+					if err != nil {
+						tb.Fatal(err)
+					}
+
+					if g, e := k, t.key(d, 0); g != e {
+						tb.Fatalf("invalid index key %#x, expected %#x", g, e)
+					}
+				}
+			}
+			return first
+		}
+		panic("internal error")
+	}
+
+	if root != 0 {
+		walk(root, 0)
+	}
+	if g, e := t.tlen(tb), n; g != e {
+		tb.Fatalf("invalid length %v, expected %v", g, e)
+	}
+
+	first, err := t.first()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	last, err := t.last()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var prev btDPage
+	if len(leaves) == 0 {
+		if first != 0 || last != 0 {
+			tb.Fatal(first, last)
+		}
+
+		return
+	}
+
+	if first != int64(leaves[0]) || last != int64(leaves[len(leaves)-1]) {
+		tb.Fatal(first, last)
+	}
+
+	k0 := ikey(t.key(leaves[0], 0)) - 1
+	for i, d := range leaves {
+		p, err := t.prev(d)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if p != prev {
+			tb.Fatalf("invalid prev link %#x, expected %#x", p, prev)
+		}
+
+		nx, err := t.next(d)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		var e btDPage
+		if i+1 < len(leaves) {
+			e = leaves[i+1]
+		}
+		if nx != e {
+			tb.Fatalf("invalid next link %#x, expected %#x", nx, e)
+		}
+
+		c, err := t.len(d)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		for j := 0; j < c; j++ {
+			k := ikey(t.key(d, j))
+			if k <= k0 {
+				tb.Fatalf("keys out of order %v %v", k0, k)
+			}
+
+			k0 = k
+		}
+		prev = d
+	}
+}
+
 func (t *BTree) dump() (r string) {
 	var buf bytes.Buffer
 
@@ -1613,6 +1819,1067 @@ func TestBTreeBPR4(t *testing.T) {
 	}
 }
 
+func testBTreeValOffset(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewBTree(16, 16, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := bt.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1000
+	for i := 0; i < N; i++ {
+		koff, voff, err := bt.Set(bt.bcmp(i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := voff, koff+bt.SzKey; g != e {
+			t.Fatal(i, g, e)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w8(voff, -int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.verifyDirect(t)
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if v, err := bt.r8(voff); err != nil || v != -int64(i) {
+			t.Fatal(i, v, err)
+		}
+	}
+}
+
+func TestBTreeValOffset(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeValOffset(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeCloneTo(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	db2, f2 := tmpDB(t, ts)
+
+	defer f2()
+
+	bt, err := db.NewBTree(16, 16, 8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bt.remove(t)
+
+	bt2 := bt.clone(t, db2.DB)
+
+	defer bt2.remove(t)
+
+	if g, e := bt2.tlen(t), int64(0); g != e {
+		t.Fatal(g, e)
+	}
+
+	const N = 1 << 10
+	for i := 0; i < N; i++ {
+		bt.set(t, 2*i, -i)
+	}
+	for i := 0; i < N; i += 3 {
+		bt.delete(t, 2*i)
+	}
+
+	verify := func(bt *BTree) {
+		e := bt.seekFirst(t)
+		var n int64
+		for i := 0; i < N; i++ {
+			if i%3 == 0 {
+				continue
+			}
+
+			k, v, ok := e.next(t)
+			if !ok {
+				t.Fatal(i)
+			}
+
+			if g, e := k, 2*i; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			if g, e := v, -i; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			if v, ok = bt.get(t, k); !ok || v != -i {
+				t.Fatal(i, v, ok)
+			}
+
+			n++
+		}
+		if _, _, ok := e.next(t); ok {
+			t.Fatal("unexpected item")
+		}
+
+		e = bt.seekLast(t)
+		for i := N - 1; i >= 0; i-- {
+			if i%3 == 0 {
+				continue
+			}
+
+			if k, _, ok := e.prev(t); !ok || k != 2*i {
+				t.Fatal(i, k, ok)
+			}
+		}
+		if _, _, ok := e.prev(t); ok {
+			t.Fatal("unexpected item")
+		}
+
+		if g, e := bt.tlen(t), n; g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	bt3 := bt.clone(t, db.DB)
+
+	defer bt3.remove(t)
+
+	bt4 := bt.clone(t, db2.DB)
+
+	defer bt4.remove(t)
+
+	for i := 1; i < N; i += 3 {
+		bt.delete(t, 2*i)
+		bt.set(t, 2*i+1, 0)
+	}
+	verify(bt3)
+	verify(bt4)
+	if bt4, err = db2.OpenBTree(bt4.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	verify(bt4)
+	for i := 0; i < N; i++ {
+		bt4.set(t, 2*i, -i)
+	}
+	for i := 0; i < N; i++ {
+		if v, ok := bt4.get(t, 2*i); !ok || v != -i {
+			t.Fatal(i, v, ok)
+		}
+	}
+}
+
+func TestBTreeCloneTo(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeCloneTo(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeCloneToError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewOwnedBTree(4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bt.bremove(t)
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		koff, _, err := bt.SetValue(bt.bcmp(i), batchVal(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fail every allocation in turn until the clone succeeds.
+	for n := 0; ; n++ {
+		r, err := bt.CloneTo(&DB{&allocLimit{db, n}}, nil)
+		if err == nil {
+			if err := r.Remove(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			break
+		}
+	}
+
+	// Fail the clone function.
+	for _, n := range []int{0, 1, N / 2, N - 1} {
+		i := 0
+		if _, err := bt.CloneTo(db.DB, func(koff, voff int64) error {
+			if i == n {
+				return fmt.Errorf("clone failed")
+			}
+
+			i++
+			return nil
+		}); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	bt.verifyDirect(t)
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		v, err := bt.Value(voff)
+		if err != nil || !bytes.Equal(v, batchVal(i)) {
+			t.Fatal(i, v, err)
+		}
+	}
+}
+
+func TestBTreeCloneToError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeCloneToError(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeSplitAtJoin(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	check := func(bt *BTree, lo, hi int) {
+		bt.verify(t)
+		if g, e := bt.tlen(t), int64(hi-lo); g != e {
+			t.Fatal(g, e)
+		}
+
+		e := bt.seekFirst(t)
+		for i := lo; i < hi; i++ {
+			k, v, ok := e.next(t)
+			if !ok || k != 2*i || v != -i {
+				t.Fatal(i, k, v, ok)
+			}
+		}
+		if _, _, ok := e.next(t); ok {
+			t.Fatal("unexpected item")
+		}
+	}
+
+	for _, n := range []int{0, 1, 2, 5, 10, 30, 100, 300} {
+		bt, err := db.NewBTree(4, 4, 8, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			bt.set(t, 2*i, -i)
+		}
+		for c := -1; c <= 2*n+1; c++ {
+			u, err := bt.SplitAt(bt.cmp(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := (c + 1) / 2
+			if m < 0 {
+				m = 0
+			}
+			if m > n {
+				m = n
+			}
+			check(u, 0, m)
+			check(bt, m, n)
+			if err := u.Join(bt); err != nil {
+				t.Fatal(err)
+			}
+
+			check(u, 0, n)
+			check(bt, 0, 0)
+			bt.bremove(t)
+			bt = u
+		}
+
+		bt.remove(t)
+	}
+
+	// Reading t fails before it is modified.
+	bt, err := db.NewBTree(4, 4, 8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		bt.set(t, 2*i, -i)
+	}
+	for r := 0; r < 3; r++ {
+		x := *bt
+		x.DB = &DB{&ioLimit{db, r, -1}}
+		if _, err := x.SplitAt(bt.cmp(101)); err == nil {
+			t.Fatal(r)
+		}
+
+		check(bt, 0, 100)
+	}
+	bt.remove(t)
+
+	for _, n := range []int{0, 1, 3, 10, 50, 200} {
+		for _, m := range []int{0, 1, 3, 10, 50, 200} {
+			a, err := db.NewBTree(4, 4, 8, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := db.NewBTree(4, 4, 8, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < n; i++ {
+				a.set(t, 2*i, -i)
+			}
+			for i := n; i < n+m; i++ {
+				b.set(t, 2*i, -i)
+			}
+			if err := a.Join(b); err != nil {
+				t.Fatal(err)
+			}
+
+			check(a, 0, n+m)
+			check(b, 0, 0)
+			for i := 0; i < n+m; i += 2 {
+				a.delete(t, 2*i)
+			}
+			for i := 0; i < n+m; i += 2 {
+				a.set(t, 2*i, -i)
+			}
+			check(a, 0, n+m)
+			a.remove(t)
+			b.remove(t)
+		}
+	}
+}
+
+func TestBTreeSplitAtJoin(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeSplitAtJoin(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeConditional(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewBTree(16, 16, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bt.bremove(t)
+
+	const N = 1 << 10
+	for i := 0; i < N; i += 2 {
+		koff, voff, ok, err := bt.SetIfAbsent(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(voff, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < N; i += 2 {
+		_, voff, ok, err := bt.SetIfAbsent(bt.bcmp(i))
+		if err != nil || ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if v, err := bt.r4(voff); err != nil || v != -i {
+			t.Fatal(i, v, err)
+		}
+	}
+	if g, e := bt.tlen(t), int64(N/2); g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < N; i++ {
+		koff, _, ok, err := bt.Upsert(bt.bcmp(i), func(voff int64, existed bool) error {
+			if g, e := existed, i%2 == 0; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			v, err := bt.r4(voff)
+			if err != nil {
+				return err
+			}
+
+			if !existed {
+				v = 0
+			}
+			return bt.w4(voff, v+1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := ok, i%2 != 0; g != e {
+			t.Fatal(i, g, e)
+		}
+
+		if ok {
+			if err := bt.w4(koff, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if g, e := bt.tlen(t), int64(N); g != e {
+		t.Fatal(g, e)
+	}
+
+	val := func(n int) []byte {
+		return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	for i := 0; i < N+2; i++ {
+		e := -i + 1
+		if i%2 != 0 {
+			e = 1
+		}
+		if ok, err := bt.CompareAndSwap(bt.bcmp(i), val(e+1), val(42)); err != nil || ok {
+			t.Fatal(i, ok, err)
+		}
+
+		ok, err := bt.CompareAndSwap(bt.bcmp(i), val(e), val(42))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := ok, i < N; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if v, err := bt.r4(voff); err != nil || v != 42 {
+			t.Fatal(i, v, err)
+		}
+	}
+}
+
+func TestBTreeConditional(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeConditional(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeUpsertError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewOwnedBTree(4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 1000
+	for i := 0; i < N; i += 2 {
+		koff, voff, ok, err := bt.SetIfAbsent(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.WriteValue(voff, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := fmt.Errorf("upsert")
+	for i := 0; i < N; i++ {
+		_, _, _, err := bt.Upsert(bt.bcmp(i), func(voff int64, existed bool) error {
+			if err := bt.WriteValue(voff, make([]byte, 100)); err != nil {
+				return err
+			}
+
+			return e
+		})
+		if err != e {
+			t.Fatal(i, err)
+		}
+	}
+
+	bt.verifyDirect(t)
+	if g, e := bt.tlen(t), int64(N/2); g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := ok, i%2 == 0; g != e {
+			t.Fatal(i, g, e)
+		}
+
+		if !ok {
+			continue
+		}
+
+		if v, err := bt.Value(voff); err != nil || len(v) != 100 {
+			t.Fatal(i, len(v), err)
+		}
+	}
+
+	if err := bt.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBTreeUpsertError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeUpsertError(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeOwned(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewOwnedBTree(4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(bt *BTree, m map[int][]byte) {
+		bt.verifyDirect(t)
+		if g, e := bt.tlen(t), int64(len(m)); g != e {
+			t.Fatal(g, e)
+		}
+
+		e, err := bt.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for e.Next() {
+			k, err := bt.r4(e.K)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := bt.Value(e.V)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w, ok := m[k]; !ok || !bytes.Equal(v, w) {
+				t.Fatalf("key %v: got %v bytes, expected %v bytes, %v", k, len(v), len(w), ok)
+			}
+		}
+		if err := e.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := func(bt *BTree, k int, v []byte) {
+		koff, _, err := bt.SetValue(bt.bcmp(k), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bt.WriteAt(batchKey(k), koff); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	val := func(n int) []byte { return bytes.Repeat([]byte{byte(n)}, n%300) }
+	m := map[int][]byte{}
+	x := rng()
+	for i := 0; i < 3000; i++ {
+		k := int(uint32(x.Next()) % 200)
+		switch uint32(x.Next()) % 10 {
+		case 0, 1:
+			ok, err := bt.Delete(bt.bcmp(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, e := m[k]; ok != e {
+				t.Fatal(i, k, ok, e)
+			}
+
+			delete(m, k)
+		case 2:
+			koff, _, err := bt.Set(bt.bcmp(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := bt.WriteAt(batchKey(k), koff); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := m[k]; !ok {
+				m[k] = []byte{}
+			}
+		default:
+			v := val(i)
+			set(bt, k, v)
+			m[k] = v
+		}
+	}
+	if bt, err = db.OpenBTree(bt.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bt.Owned() {
+		t.Fatal("not owned")
+	}
+
+	check(bt, m)
+
+	// CompareAndSwap.
+	for k, v := range m {
+		if ok, err := bt.CompareAndSwap(bt.bcmp(k), append(v, 1), []byte("foo")); ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		if ok, err := bt.CompareAndSwap(bt.bcmp(k), v, []byte("foo")); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		m[k] = []byte("foo")
+		break
+	}
+	check(bt, m)
+
+	// The clone owns copies of the values.
+	c, err := bt.CloneTo(db.DB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Owned() {
+		t.Fatal("not owned")
+	}
+
+	check(c, m)
+	var k0 int
+	for k0 = range m {
+		break
+	}
+	set(c, k0, []byte("bar"))
+	var diff []int
+	if err := Diff(bt, c, nil, nil, func(op DiffOp, akoff, avoff, bkoff, bvoff int64) error {
+		k, err := bt.r4(akoff)
+		if err != nil {
+			return err
+		}
+
+		if op != DiffChanged {
+			t.Fatal(op, k)
+		}
+
+		diff = append(diff, k)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff) != 1 || diff[0] != k0 {
+		t.Fatal(diff, k0)
+	}
+
+	if err := c.Clear(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(c, nil)
+	check(bt, m)
+	if err := c.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// SplitAt and Join move the values with the items.
+	u, err := bt.SplitAt(bt.bcmp(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, r := map[int][]byte{}, map[int][]byte{}
+	for k, v := range m {
+		switch {
+		case k < 100:
+			l[k] = v
+		default:
+			r[k] = v
+		}
+	}
+	check(u, l)
+	check(bt, r)
+	if err := u.Join(bt); err != nil {
+		t.Fatal(err)
+	}
+
+	check(u, m)
+	if err := bt.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bt = u
+
+	// Batch.
+	b := bt.NewBatch()
+	for i := 0; i < 300; i++ {
+		k := int(uint32(x.Next()) % 300)
+		switch {
+		case i%3 == 0:
+			b.Delete(batchKey(k))
+			delete(m, k)
+		default:
+			v := val(i)
+			b.Set(batchKey(k), v)
+			m[k] = v
+		}
+	}
+	if err := b.Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(bt, m)
+	if err := bt.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBTreeOwned(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeOwned(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeOldHeader(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	if g, e := szBTree, 64; g != e {
+		t.Fatal(g, e)
+	}
+
+	bt, err := db.NewBTree(4, 4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bt.bremove(t)
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		koff, voff, err := bt.Set(bt.bcmp(i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(voff, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A header of the layout without the owned values flag, followed by
+	// unrelated data.
+	h := make([]byte, szBTree)
+	if _, err := bt.ReadAt(h, bt.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := db.Alloc(2 * szBTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := db.Free(off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	b := bytes.Repeat([]byte{0xff}, 2*szBTree)
+	copy(b, h)
+	if _, err := db.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := db.OpenBTree(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Owned() || o.SzKey != 4 || o.SzVal != 4 {
+		t.Fatal(o.Owned(), o.SzKey, o.SzVal)
+	}
+
+	for i := 0; i < N; i++ {
+		voff, ok, err := o.Get(o.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(i, ok, err)
+		}
+
+		if v, err := o.r4(voff); err != nil || v != -i {
+			t.Fatal(i, v, err)
+		}
+	}
+
+	ow, err := db.NewOwnedBTree(4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ow, err = db.OpenBTree(ow.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ow.Owned() || ow.SzVal != 8 {
+		t.Fatal(ow.Owned(), ow.SzVal)
+	}
+
+	if err := ow.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBTreeOldHeader(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeOldHeader(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeResizeValues(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	bt, err := db.NewBTree(4, 4, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { bt.bremove(t) }()
+
+	check := func(n int, val func(k int) []byte) {
+		bt.verifyDirect(t)
+		if g, e := bt.tlen(t), int64(n); g != e {
+			t.Fatal(g, e)
+		}
+
+		e, err := bt.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, bt.SzVal)
+		i := 0
+		for ; e.Next(); i++ {
+			k, err := bt.r4(e.K)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if k != 2*i {
+				t.Fatal(i, k)
+			}
+
+			if _, err := bt.ReadAt(b, e.V); err != nil {
+				t.Fatal(err)
+			}
+
+			if w := val(k); !bytes.Equal(b, w) {
+				t.Fatalf("key %v: got %x, expected %x", k, b, w)
+			}
+		}
+		if err := e.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if i != n {
+			t.Fatal(i, n)
+		}
+	}
+
+	const N = 1000
+	for i := 0; i < N; i++ {
+		koff, voff, err := bt.Set(bt.bcmp(2*i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, 2*i); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bt.WriteAt(batchVal(2*i), voff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(N, batchVal)
+
+	// A failing resize leaves the tree unchanged and frees the copy.
+	e := fmt.Errorf("fill")
+	for _, n := range []int{0, 1, N / 2, N - 1} {
+		n := n
+		if err := bt.ResizeValues(16, func(old, new int64) error {
+			if n == 0 {
+				return e
+			}
+
+			n--
+			return nil
+		}); err != e {
+			t.Fatal(err)
+		}
+
+		if g, e := bt.SzVal, int64(8); g != e {
+			t.Fatal(g, e)
+		}
+
+		check(N, batchVal)
+	}
+	for _, n := range []int{0, 1, 50} {
+		x := *bt
+		x.DB = &DB{&allocLimit{db, n}}
+		if err := x.ResizeValues(16, nil); err == nil {
+			t.Fatal(n)
+		}
+
+		check(N, batchVal)
+	}
+
+	if err := bt.ResizeValues(16, func(old, new int64) error {
+		n, err := bt.r8(old)
+		if err != nil {
+			return err
+		}
+
+		return bt.w8(new+8, -n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	wide := func(k int) []byte {
+		b := append(batchVal(k), make([]byte, 8)...)
+		enc8(b[8:], uint64(-heapVal(b[:8])))
+		return b
+	}
+	check(N, wide)
+	if bt, err = db.OpenBTree(bt.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := bt.SzVal, int64(16); g != e {
+		t.Fatal(g, e)
+	}
+
+	check(N, wide)
+	if err := bt.ResizeValues(4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(N, func(k int) []byte { return batchVal(k)[:4] })
+
+	// The resized tree remains fully usable.
+	for i := N; i < N+100; i++ {
+		koff, voff, err := bt.Set(bt.bcmp(2*i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, 2*i); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bt.WriteAt(batchVal(2 * i)[:4], voff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(N+100, func(k int) []byte { return batchVal(k)[:4] })
+
+	if err := bt.ResizeValues(0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bt.verifyDirect(t)
+	if err := bt.Clear(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bt.ResizeValues(8, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(0, nil)
+}
+
+func TestBTreeResizeValues(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeResizeValues(t, v.f) }) {
+			break
+		}
+	}
+}
+
 func benchmarkBTreeSetSeq(b *testing.B, ts func(t testing.TB) (file.File, func()), nd, nx, n int) {
 	b.ResetTimer()
 	b.StopTimer()
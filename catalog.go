@@ -0,0 +1,268 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	oCatalogVersion = 8 * iota // int64		0	8
+	oCatalogNames              // int64		8	8
+
+	szCatalog
+)
+
+const (
+	oCatalogEntryOff    = 8 * iota // int64		0	8
+	oCatalogEntrySchema            // int64		8	8
+
+	szCatalogEntry
+)
+
+// Catalog is a persistent registry of named database objects, like BTrees or
+// Tables, and of their schema descriptors, for example the Schema of a
+// Record. It also records the schema version of the database, which is
+// advanced by Migrate. The entries are kept in a RadixTree keyed by the
+// object names.
+//
+// A Catalog only records the offsets of the objects, it never allocates or
+// frees them. A Catalog is typically found at the database root.
+type Catalog struct {
+	*DB
+	Off   int64 // Location in the database.
+	names *RadixTree
+}
+
+// NewCatalog allocates and returns a new, empty Catalog with version zero or
+// an error, if any.
+func (db *DB) NewCatalog() (*Catalog, error) {
+	off, err := db.Calloc(szCatalog)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.NewRadixTree(szCatalogEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oCatalogNames, t.Off); err != nil {
+		return nil, err
+	}
+
+	return &Catalog{DB: db, Off: off, names: t}, nil
+}
+
+// OpenCatalog opens and returns an existing Catalog or an error, if any.
+func (db *DB) OpenCatalog(off int64) (*Catalog, error) {
+	names, err := db.r8(off + oCatalogNames)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.OpenRadixTree(names)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.SzVal != szCatalogEntry {
+		return nil, fmt.Errorf("%T.OpenCatalog: corrupted database", db)
+	}
+
+	return &Catalog{DB: db, Off: off, names: t}, nil
+}
+
+func (c *Catalog) free(voff int64) error {
+	off, err := c.r8(voff + oCatalogEntrySchema)
+	if err != nil || off == 0 {
+		return err
+	}
+
+	return c.Free(off)
+}
+
+// Delete removes the entry of the named object, but not the object itself. It
+// returns a boolean value indicating the entry was found or an error, if any.
+func (c *Catalog) Delete(name string) (bool, error) { return c.names.Delete([]byte(name), c.free) }
+
+// Get returns the offset and schema descriptor of the named object and a
+// boolean value indicating the entry was found or an error, if any.
+func (c *Catalog) Get(name string) (int64, string, bool, error) {
+	voff, ok, err := c.names.Get([]byte(name))
+	if err != nil || !ok {
+		return 0, "", false, err
+	}
+
+	off, err := c.r8(voff + oCatalogEntryOff)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	p, err := c.r8(voff + oCatalogEntrySchema)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	if p == 0 {
+		return off, "", true, nil
+	}
+
+	b, ok, err := readPayload(c, p)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	if !ok {
+		return 0, "", false, fmt.Errorf("%T.Get: corrupted schema of %q", c, name)
+	}
+
+	return off, string(b), true, nil
+}
+
+// Names returns the names of all entries of c in lexicographic order or an
+// error, if any.
+func (c *Catalog) Names() ([]string, error) {
+	e, err := c.names.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	var a []string
+	for e.Next() {
+		a = append(a, string(e.K))
+	}
+	return a, e.Err()
+}
+
+// Remove frees all space used by c. The registered objects are not freed.
+func (c *Catalog) Remove() error {
+	if err := c.names.Remove(c.free); err != nil {
+		return err
+	}
+
+	if err := c.Free(c.Off); err != nil {
+		return err
+	}
+
+	c.Off = 0
+	return nil
+}
+
+// Set adds or replaces the entry of the named object located at off with the
+// schema descriptor schema, which may be empty. A schema descriptor that does
+// not fit the storage block of the old one is written to a new block, the old
+// block is freed only after the entry is updated.
+func (c *Catalog) Set(name string, off int64, schema string) error {
+	var old int64
+	voff, ok, err := c.names.Get([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if old, err = c.r8(voff + oCatalogEntrySchema); err != nil {
+			return err
+		}
+	}
+
+	p := old
+	switch {
+	case schema == "":
+		p = 0
+	case p != 0:
+		ok, err := writePayload(c, p, []byte(schema))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			break
+		}
+
+		fallthrough
+	default:
+		if p, err = c.Alloc(oPayloadData + int64(len(schema))); err != nil {
+			return err
+		}
+
+		if err := initPayload(c, p, []byte(schema)); err != nil {
+			c.Free(p)
+			return err
+		}
+	}
+
+	v := make([]byte, szCatalogEntry)
+	enc8(v[oCatalogEntryOff:], uint64(off))
+	enc8(v[oCatalogEntrySchema:], uint64(p))
+	if err := c.names.Set([]byte(name), v); err != nil {
+		if p != 0 && p != old {
+			c.Free(p)
+		}
+		return err
+	}
+
+	if old != 0 && p != old {
+		return c.Free(old)
+	}
+
+	return nil
+}
+
+// Version returns the schema version of c or an error, if any.
+func (c *Catalog) Version() (int64, error) { return c.r8(c.Off + oCatalogVersion) }
+
+// Migration is a versioned change of the database objects registered in a
+// Catalog, like rebuilding a BTree with a larger value size or adding an
+// index.
+type Migration struct {
+	Version int64                  // Positive, the resulting version of the Catalog.
+	Apply   func(c *Catalog) error // Performs the change.
+}
+
+// Migrate applies, in order, the migrations of m having a version greater
+// than the version of c. The versions in m must be positive and increasing.
+// Migrate returns the resulting version of c or an error, if any.
+//
+// After every successfully applied migration the version of c is set to the
+// migration version and Sync is called, so when the Storage is WAL-backed,
+// the changes made by a migration are committed together with the new
+// version. If a migration fails, Migrate returns its error without calling
+// Sync and the version of c is not changed. The changes made by the failed
+// migration are discarded by closing the WAL-backed Storage without calling
+// Sync.
+func (c *Catalog) Migrate(m []Migration) (int64, error) {
+	for i, v := range m {
+		if v.Version <= 0 || v.Apply == nil || i > 0 && v.Version <= m[i-1].Version {
+			panic(fmt.Errorf("%T.Migrate: invalid argument", c))
+		}
+	}
+
+	n, err := c.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range m {
+		if v.Version <= n {
+			continue
+		}
+
+		if err := v.Apply(c); err != nil {
+			return n, fmt.Errorf("%T.Migrate: version %v: %v", c, v.Version, err)
+		}
+
+		if err := c.w8(c.Off+oCatalogVersion, v.Version); err != nil {
+			return n, err
+		}
+
+		if err := c.Sync(); err != nil {
+			return n, err
+		}
+
+		n = v.Version
+	}
+	return n, nil
+}
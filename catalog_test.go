@@ -0,0 +1,261 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func testCatalog(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	c, err := db.NewCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := c.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	r, err := NewRecord(recordTestPos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 1 << 10
+	applied := 0
+	m := []Migration{
+		{1, func(c *Catalog) error {
+			applied++
+			bt, err := c.NewBTree(0, 0, 4, 8)
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < N; i++ {
+				koff, voff, err := bt.Set(bt.bcmp(i), nil)
+				if err != nil {
+					return err
+				}
+
+				if err := bt.w4(koff, i); err != nil {
+					return err
+				}
+
+				if err := r.Write(bt, voff, recordTestPos{float32(i), -1}); err != nil {
+					return err
+				}
+			}
+			return c.Set("pos", bt.Off, r.Schema())
+		}},
+		// Rebuild pos with a larger value size.
+		{3, func(c *Catalog) error {
+			applied++
+			off, _, ok, err := c.Get("pos")
+			if err != nil || !ok {
+				return fmt.Errorf("pos: %v %v", ok, err)
+			}
+
+			old, err := c.OpenBTree(off)
+			if err != nil {
+				return err
+			}
+
+			bt, err := c.NewBTree(0, 0, 4, 16)
+			if err != nil {
+				return err
+			}
+
+			e, err := old.SeekFirst()
+			if err != nil {
+				return err
+			}
+
+			for e.Next() {
+				i, err := old.r4(e.K)
+				if err != nil {
+					return err
+				}
+
+				koff, voff, err := bt.Set(bt.bcmp(i), nil)
+				if err != nil {
+					return err
+				}
+
+				if err := bt.w4(koff, i); err != nil {
+					return err
+				}
+
+				if err := copyStorage(bt, voff, old, e.V, old.SzVal); err != nil {
+					return err
+				}
+			}
+			if err := e.Err(); err != nil {
+				return err
+			}
+
+			if err := old.Remove(nil); err != nil {
+				return err
+			}
+
+			return c.Set("pos", bt.Off, "")
+		}},
+	}
+	for i := 0; i < 2; i++ {
+		n, err := c.Migrate(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 3 || applied != 2 {
+			t.Fatal(n, applied)
+		}
+	}
+
+	if c, err = db.OpenCatalog(c.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	m = append(m, Migration{4, func(c *Catalog) error { return fmt.Errorf("failed") }})
+	if n, err := c.Migrate(m); err == nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	if n, err := c.Version(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	off, schema, ok, err := c.Get("pos")
+	if err != nil || !ok || schema != "" {
+		t.Fatal(ok, schema, err)
+	}
+
+	bt, err := db.OpenBTree(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := bt.SzVal, int64(16); g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		var v recordTestPos
+		if err := r.Read(bt, voff, &v); err != nil {
+			t.Fatal(err)
+		}
+
+		if v.X != float32(i) || v.Y != -1 {
+			t.Fatal(i, v)
+		}
+	}
+
+	if err := c.Set("a", 1, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set("a", 2, "much longer schema"); err != nil {
+		t.Fatal(err)
+	}
+
+	if off, schema, ok, err := c.Get("a"); err != nil || !ok || off != 2 || schema != "much longer schema" {
+		t.Fatal(off, schema, ok, err)
+	}
+
+	names, err := c.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := names, []string{"a", "pos"}; !reflect.DeepEqual(g, e) {
+		t.Fatal(g, e)
+	}
+
+	if ok, err := c.Delete("a"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	if err := bt.Remove(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testCatalog(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testCatalogError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	c, err := db.NewCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := c.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := c.Set("a", 1, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, schema := range []string{"", "longer schema"} {
+		for w := 0; ; w++ {
+			if w > 100 {
+				t.Fatal(schema)
+			}
+
+			x, err := (&DB{&ioLimit{db, -1, w}}).OpenCatalog(c.Off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := x.Set("a", 2, schema); err == nil {
+				break
+			}
+
+			// A failed Set keeps the old entry.
+			off, s, ok, err := c.Get("a")
+			if err != nil || !ok || off != 1 || s != "x" {
+				t.Fatal(schema, w, off, s, ok, err)
+			}
+		}
+
+		if err := c.Set("a", 1, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCatalogError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testCatalogError(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -9,6 +9,7 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
@@ -19,6 +20,12 @@ var (
 	_ Storage = (*DB)(nil)
 )
 
+const (
+	oPayloadCap  = 8 * iota // int64		0	8
+	oPayloadLen             // int64		8	8
+	oPayloadData            // [cap]byte		16	cap
+)
+
 // Storage represents a database back end.
 type Storage interface {
 	// Alloc allocates a storage block large enough for storing size bytes
@@ -98,6 +105,196 @@ func (db *DB) r8(off int64) (int64, error) { return r8(db, off) }
 func (db *DB) w4(off int64, n int) error   { return w4(db, off, n) }
 func (db *DB) w8(off, n int64) error       { return w8(db, off, n) }
 
+func cmpStorage(a Storage, aoff int64, b Storage, boff, n int64) (int, error) {
+	var rq int
+	var p, q *[]byte
+	var x, y []byte
+	for ; n != 0; n -= int64(rq) {
+		if n <= maxCopyBuf {
+			rq = int(n)
+		} else {
+			rq = maxCopyBuf
+		}
+
+		if p == nil {
+			p = buffer.Get(rq)
+			x = *p
+			q = buffer.Get(rq)
+			y = *q
+		}
+		if nr, err := a.ReadAt(x[:rq], aoff); nr != rq {
+			if err == nil {
+				panic("internal error")
+			}
+
+			buffer.Put(p)
+			buffer.Put(q)
+			return 0, err
+		}
+
+		if nr, err := b.ReadAt(y[:rq], boff); nr != rq {
+			if err == nil {
+				panic("internal error")
+			}
+
+			buffer.Put(p)
+			buffer.Put(q)
+			return 0, err
+		}
+
+		if c := bytes.Compare(x[:rq], y[:rq]); c != 0 {
+			buffer.Put(p)
+			buffer.Put(q)
+			return c, nil
+		}
+
+		aoff += int64(rq)
+		boff += int64(rq)
+	}
+	if p != nil {
+		buffer.Put(p)
+		buffer.Put(q)
+	}
+	return 0, nil
+}
+
+func copyStorage(dst Storage, doff int64, src Storage, soff, n int64) error {
+	var rq int
+	var p *[]byte
+	var b []byte
+	for ; n != 0; n -= int64(rq) {
+		if n <= maxCopyBuf {
+			rq = int(n)
+		} else {
+			rq = maxCopyBuf
+		}
+
+		if p == nil {
+			p = buffer.Get(rq)
+			b = *p
+		}
+		if nr, err := src.ReadAt(b[:rq], soff); nr != rq {
+			if err == nil {
+				panic("internal error")
+			}
+
+			buffer.Put(p)
+			return err
+		}
+
+		if nw, err := dst.WriteAt(b[:rq], doff); nw != rq {
+			if err == nil {
+				panic("internal error")
+			}
+
+			buffer.Put(p)
+			return err
+		}
+		soff += int64(rq)
+		doff += int64(rq)
+	}
+	if p != nil {
+		buffer.Put(p)
+	}
+	return nil
+}
+
+// readPayload returns a copy of the variable sized payload at off. The
+// returned boolean value is false if the recorded length is not valid.
+func readPayload(s Storage, off int64) ([]byte, bool, error) {
+	c, err := r8(s, off+oPayloadCap)
+	if err != nil {
+		return nil, false, err
+	}
+
+	n, err := r8(s, off+oPayloadLen)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n < 0 || n > c {
+		return nil, false, nil
+	}
+
+	b := make([]byte, n)
+	if n == 0 {
+		return b, true, nil
+	}
+
+	if _, err := s.ReadAt(b, off+oPayloadData); err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// writePayload sets the variable sized payload at off to data if it fits its
+// capacity and reports whether it did.
+func writePayload(s Storage, off int64, data []byte) (bool, error) {
+	c, err := r8(s, off+oPayloadCap)
+	if err != nil {
+		return false, err
+	}
+
+	if int64(len(data)) > c {
+		return false, nil
+	}
+
+	return true, writePayloadLen(s, off, data)
+}
+
+// initPayload writes a new variable sized payload with capacity len(data) at
+// off.
+func initPayload(s Storage, off int64, data []byte) error {
+	if err := w8(s, off+oPayloadCap, int64(len(data))); err != nil {
+		return err
+	}
+
+	return writePayloadLen(s, off, data)
+}
+
+func writePayloadLen(s Storage, off int64, data []byte) error {
+	if err := w8(s, off+oPayloadLen, int64(len(data))); err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, err := s.WriteAt(data, off+oPayloadData)
+	return err
+}
+
+// keyCmp returns a function comparing k to the len(k) bytes found at koff.
+func keyCmp(s Storage, k []byte) func(koff int64) (int, error) {
+	return func(koff int64) (int, error) {
+		p := buffer.Get(len(k))
+		defer buffer.Put(p)
+
+		if n, err := s.ReadAt(*p, koff); n != len(*p) {
+			if err == nil {
+				panic("internal error")
+			}
+
+			return 0, err
+		}
+
+		return bytes.Compare(k, *p), nil
+	}
+}
+
+func dec8(b []byte) uint64 {
+	return uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32 |
+		uint64(b[4])<<24 | uint64(b[5])<<16 | uint64(b[6])<<8 | uint64(b[7])
+}
+
+func enc8(b []byte, n uint64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(n >> uint(56-8*i))
+	}
+}
+
 func r4(s Storage, off int64) (int, error) {
 	p := buffer.Get(4)
 	b := *p
@@ -4,12 +4,24 @@
 
 package db
 
+import (
+	"fmt"
+)
+
 const (
 	oDListPrev = 8 * iota // int64		0	8
 	oDListNext            // int64		8	8
 	oDListData            // [dataSize]byte	16	dataSize
 )
 
+const (
+	oDListHeadFirst = 8 * iota // int64		0	8
+	oDListHeadLast             // int64		8	8
+	oDListHeadLen              // int64		16	8
+
+	szDListHead
+)
+
 // DList is a node of a doubly linked list.
 type DList struct {
 	*DB
@@ -35,10 +47,35 @@ func (db *DB) NewDList(dataSize int64) (DList, error) {
 	}
 
 	if err := r.setPrev(0); err != nil {
+		db.Free(off)
+		return DList{}, err
+	}
+
+	if err := r.setNext(0); err != nil {
+		db.Free(off)
+		return DList{}, err
+	}
+
+	return r, nil
+}
+
+// NewDListData returns a newly allocated DList with a variable sized payload
+// initialized to a copy of data or an error, if any. The node records the
+// length of its payload, use the Data and SetData methods to access it.
+//
+// The result of NewDListData is not a part of any list.
+func (db *DB) NewDListData(data []byte) (DList, error) {
+	r, err := db.NewDList(oPayloadData + int64(len(data)))
+	if err != nil {
 		return DList{}, err
 	}
 
-	return r, r.setNext(0)
+	if err := initPayload(r, r.DataOff(), data); err != nil {
+		db.Free(r.Off)
+		return DList{}, err
+	}
+
+	return r, nil
 }
 
 // OpenDList returns a DList found at offset off.
@@ -50,6 +87,21 @@ func (l DList) setPrev(off int64) error { return l.w8(l.Off+oDListPrev, off) }
 // DataOff returns the offset in db at which data of l are located.
 func (l DList) DataOff() int64 { return l.Off + oDListData }
 
+// Data returns a copy of the payload of l, which must have been created by
+// NewDListData.
+func (l DList) Data() ([]byte, error) {
+	b, ok, err := readPayload(l, l.DataOff())
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%T.Data: corrupted node at %#x", l, l.Off)
+	}
+
+	return b, nil
+}
+
 // Next returns the offset of the next node of l.
 func (l DList) Next() (int64, error) { return l.r8(l.Off + oDListNext) }
 
@@ -104,7 +156,7 @@ func (l DList) InsertBefore(off int64) error {
 		return err
 	}
 
-	if n.setPrev(l.Off); err != nil {
+	if err := n.setPrev(l.Off); err != nil {
 		return err
 	}
 
@@ -119,63 +171,19 @@ func (l DList) InsertBefore(off int64) error {
 		}
 	}
 
-	if l.setPrev(prev); err != nil {
+	if err := l.setPrev(prev); err != nil {
 		return err
 	}
 
 	return l.setNext(n.Off)
 }
 
-// Remove removes l from a list.
+// Remove removes l from a list and frees it.
 func (l DList) Remove() error {
-	prev, err := l.Prev()
-	if err != nil {
-		return err
-	}
-
-	next, err := l.Next()
-	if err != nil {
+	if err := l.Unlink(); err != nil {
 		return err
 	}
 
-	var p, n DList
-	if prev != 0 {
-		if p, err = l.OpenDList(prev); err != nil {
-			return err
-		}
-	}
-	if next != 0 {
-		if n, err = l.OpenDList(next); err != nil {
-			return err
-		}
-	}
-
-	switch {
-	case prev == 0:
-		switch {
-		case next == 0:
-			// nop
-		default:
-			if err = n.setPrev(0); err != nil {
-				return err
-			}
-		}
-	default:
-		switch {
-		case next == 0:
-			if err = p.setNext(0); err != nil {
-				return err
-			}
-		default:
-			if err := p.setNext(next); err != nil {
-				return err
-			}
-
-			if err := n.setPrev(prev); err != nil {
-				return err
-			}
-		}
-	}
 	return l.Free(l.Off)
 }
 
@@ -244,3 +252,799 @@ func (l DList) RemoveToFirst() error {
 	}
 	return nil
 }
+
+// SetData sets the payload of l, which must have been created by
+// NewDListData, to a copy of data. If data does not fit the space allocated
+// for the payload, the node is reallocated, the links from its neighbors are
+// updated and its new offset is returned in the Off field of the result. Use
+// DListHead.SetData for nodes of a list with a header.
+func (l DList) SetData(data []byte) (DList, error) {
+	ok, err := writePayload(l, l.DataOff(), data)
+	if err != nil || ok {
+		return l, err
+	}
+
+	off, err := l.Realloc(l.Off, oDListData+oPayloadData+int64(len(data)))
+	if err != nil {
+		return l, err
+	}
+
+	r := DList{l.DB, off}
+	if err := initPayload(r, r.DataOff(), data); err != nil {
+		return r, err
+	}
+
+	if off == l.Off {
+		return r, nil
+	}
+
+	prev, err := r.Prev()
+	if err != nil {
+		return r, err
+	}
+
+	next, err := r.Next()
+	if err != nil {
+		return r, err
+	}
+
+	if prev != 0 {
+		p, err := l.OpenDList(prev)
+		if err != nil {
+			return r, err
+		}
+
+		if err := p.setNext(off); err != nil {
+			return r, err
+		}
+	}
+
+	if next != 0 {
+		n, err := l.OpenDList(next)
+		if err != nil {
+			return r, err
+		}
+
+		if err := n.setPrev(off); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// Sort sorts the list starting at l, which must be its first node, and
+// returns the new first node. The prev links are rewritten in a final pass.
+// For details see SList.Sort.
+func (l DList) Sort(less func(aoff, boff int64) (bool, error)) (DList, error) {
+	first, _, err := sortChain(l.DB, l.Off, oDListNext, less)
+	if err != nil {
+		return DList{}, err
+	}
+
+	if err := fixPrev(l.DB, first); err != nil {
+		return DList{}, err
+	}
+
+	return l.OpenDList(first)
+}
+
+// Unlink removes l from a list without freeing it. The links of l are
+// cleared, so it can be inserted into a list again.
+func (l DList) Unlink() error {
+	prev, err := l.Prev()
+	if err != nil {
+		return err
+	}
+
+	next, err := l.Next()
+	if err != nil {
+		return err
+	}
+
+	if prev != 0 {
+		p, err := l.OpenDList(prev)
+		if err != nil {
+			return err
+		}
+
+		if err := p.setNext(next); err != nil {
+			return err
+		}
+	}
+
+	if next != 0 {
+		n, err := l.OpenDList(next)
+		if err != nil {
+			return err
+		}
+
+		if err := n.setPrev(prev); err != nil {
+			return err
+		}
+	}
+
+	if err := l.setPrev(0); err != nil {
+		return err
+	}
+
+	return l.setNext(0)
+}
+
+// DListHead is a persistent header of a doubly linked list of DList nodes. It
+// records the first and last node of the list and the number of its nodes.
+type DListHead struct {
+	*DB
+	Off int64
+}
+
+// NewDListHead returns a newly allocated, empty DListHead or an error, if
+// any.
+func (db *DB) NewDListHead() (DListHead, error) {
+	off, err := db.Calloc(szDListHead)
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	return db.OpenDListHead(off)
+}
+
+// OpenDListHead returns a DListHead found at offset off.
+func (db *DB) OpenDListHead(off int64) (DListHead, error) { return DListHead{db, off}, nil }
+
+func (h DListHead) setBack(off int64) error  { return h.w8(h.Off+oDListHeadLast, off) }
+func (h DListHead) setFront(off int64) error { return h.w8(h.Off+oDListHeadFirst, off) }
+func (h DListHead) setLen(n int64) error     { return h.w8(h.Off+oDListHeadLen, n) }
+
+// Back returns the offset of the last node of the list or zero if the list is
+// empty.
+func (h DListHead) Back() (int64, error) { return h.r8(h.Off + oDListHeadLast) }
+
+// Front returns the offset of the first node of the list or zero if the list
+// is empty.
+func (h DListHead) Front() (int64, error) { return h.r8(h.Off + oDListHeadFirst) }
+
+// Len returns the number of nodes in the list.
+func (h DListHead) Len() (int64, error) { return h.r8(h.Off + oDListHeadLen) }
+
+func (h DListHead) add(delta int64) error {
+	n, err := h.Len()
+	if err != nil {
+		return err
+	}
+
+	return h.setLen(n + delta)
+}
+
+// Concat moves all nodes of other, which must be a different list in the same
+// DB, to the back of h and leaves other empty. The nodes are relinked in
+// place.
+func (h DListHead) Concat(other DListHead) error {
+	if other.Off == h.Off {
+		return fmt.Errorf("%T.Concat: invalid argument", h)
+	}
+
+	ofirst, err := other.Front()
+	if err != nil || ofirst == 0 {
+		return err
+	}
+
+	olast, err := other.Back()
+	if err != nil {
+		return err
+	}
+
+	on, err := other.Len()
+	if err != nil {
+		return err
+	}
+
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	if err := h.link(last, ofirst); err != nil {
+		return err
+	}
+
+	if err := h.setBack(olast); err != nil {
+		return err
+	}
+
+	if err := h.add(on); err != nil {
+		return err
+	}
+
+	if err := other.setFront(0); err != nil {
+		return err
+	}
+
+	if err := other.setBack(0); err != nil {
+		return err
+	}
+
+	return other.setLen(0)
+}
+
+// InsertAfter inserts n after the node at off, which must be a part of the
+// list. Node n must not be already a part of any list.
+func (h DListHead) InsertAfter(n DList, off int64) error {
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	if err := n.InsertAfter(off); err != nil {
+		return err
+	}
+
+	if off == last {
+		if err := h.setBack(n.Off); err != nil {
+			return err
+		}
+	}
+
+	return h.add(1)
+}
+
+// InsertBefore inserts n before the node at off, which must be a part of the
+// list. Node n must not be already a part of any list.
+func (h DListHead) InsertBefore(n DList, off int64) error {
+	first, err := h.Front()
+	if err != nil {
+		return err
+	}
+
+	if err := n.InsertBefore(off); err != nil {
+		return err
+	}
+
+	if off == first {
+		if err := h.setFront(n.Off); err != nil {
+			return err
+		}
+	}
+
+	return h.add(1)
+}
+
+// link makes next the successor of prev. A zero prev stands for the front of
+// the list and a zero next for its back.
+func (h DListHead) link(prev, next int64) error {
+	switch {
+	case prev == 0:
+		if err := h.setFront(next); err != nil {
+			return err
+		}
+	default:
+		p, err := h.OpenDList(prev)
+		if err != nil {
+			return err
+		}
+
+		if err := p.setNext(next); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case next == 0:
+		return h.setBack(prev)
+	default:
+		n, err := h.OpenDList(next)
+		if err != nil {
+			return err
+		}
+
+		return n.setPrev(prev)
+	}
+}
+
+// MoveAfter moves n after the node at off. Both n and the node at off must be
+// a part of the list and they must be different.
+func (h DListHead) MoveAfter(n DList, off int64) error { return h.Splice(n.Off, n.Off, off) }
+
+// MoveBefore moves n before the node at off. Both n and the node at off must
+// be a part of the list and they must be different.
+func (h DListHead) MoveBefore(n DList, off int64) error {
+	if n.Off == off {
+		return fmt.Errorf("%T.MoveBefore: invalid argument", h)
+	}
+
+	x, err := h.OpenDList(off)
+	if err != nil {
+		return err
+	}
+
+	prev, err := x.Prev()
+	if err != nil || prev == n.Off {
+		return err
+	}
+
+	return h.Splice(n.Off, n.Off, prev)
+}
+
+// MoveToBack moves n, which must be a part of the list, to the back of the
+// list.
+func (h DListHead) MoveToBack(n DList) error {
+	last, err := h.Back()
+	if err != nil || last == n.Off {
+		return err
+	}
+
+	return h.Splice(n.Off, n.Off, last)
+}
+
+// MoveToFront moves n, which must be a part of the list, to the front of the
+// list.
+func (h DListHead) MoveToFront(n DList) error { return h.Splice(n.Off, n.Off, 0) }
+
+// PopBack unlinks the last node of the list and returns it. The returned node
+// is not freed. If the list is empty, the Off field of the result is zero.
+func (h DListHead) PopBack() (DList, error) {
+	last, err := h.Back()
+	if err != nil || last == 0 {
+		return DList{}, err
+	}
+
+	n, err := h.OpenDList(last)
+	if err != nil {
+		return DList{}, err
+	}
+
+	if err := h.Unlink(n); err != nil {
+		return DList{}, err
+	}
+
+	return n, nil
+}
+
+// PopFront unlinks the first node of the list and returns it. The returned
+// node is not freed. If the list is empty, the Off field of the result is
+// zero.
+func (h DListHead) PopFront() (DList, error) {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return DList{}, err
+	}
+
+	n, err := h.OpenDList(first)
+	if err != nil {
+		return DList{}, err
+	}
+
+	if err := h.Unlink(n); err != nil {
+		return DList{}, err
+	}
+
+	return n, nil
+}
+
+// PushBack appends n to the list. Node n must not be already a part of any
+// list.
+func (h DListHead) PushBack(n DList) error {
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	if last != 0 {
+		return h.InsertAfter(n, last)
+	}
+
+	return h.pushEmpty(n)
+}
+
+// PushFront prepends n to the list. Node n must not be already a part of any
+// list.
+func (h DListHead) PushFront(n DList) error {
+	first, err := h.Front()
+	if err != nil {
+		return err
+	}
+
+	if first != 0 {
+		return h.InsertBefore(n, first)
+	}
+
+	return h.pushEmpty(n)
+}
+
+func (h DListHead) pushEmpty(n DList) error {
+	if err := n.setPrev(0); err != nil {
+		return err
+	}
+
+	if err := n.setNext(0); err != nil {
+		return err
+	}
+
+	if err := h.setFront(n.Off); err != nil {
+		return err
+	}
+
+	if err := h.setBack(n.Off); err != nil {
+		return err
+	}
+
+	return h.setLen(1)
+}
+
+// Remove removes n from the list and frees it.
+func (h DListHead) Remove(n DList) error {
+	if err := h.Unlink(n); err != nil {
+		return err
+	}
+
+	return n.Free(n.Off)
+}
+
+// RemoveAll removes and frees all nodes of the list.
+func (h DListHead) RemoveAll() error {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return err
+	}
+
+	n, err := h.OpenDList(first)
+	if err != nil {
+		return err
+	}
+
+	if err := n.RemoveToLast(); err != nil {
+		return err
+	}
+
+	if err := h.setFront(0); err != nil {
+		return err
+	}
+
+	if err := h.setBack(0); err != nil {
+		return err
+	}
+
+	return h.setLen(0)
+}
+
+// Reverse reverses the order of the nodes of the list in place.
+func (h DListHead) Reverse() error {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return err
+	}
+
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	for off := first; off != 0; {
+		n, err := h.OpenDList(off)
+		if err != nil {
+			return err
+		}
+
+		prev, err := n.Prev()
+		if err != nil {
+			return err
+		}
+
+		next, err := n.Next()
+		if err != nil {
+			return err
+		}
+
+		if err := n.setPrev(next); err != nil {
+			return err
+		}
+
+		if err := n.setNext(prev); err != nil {
+			return err
+		}
+
+		off = next
+	}
+
+	if err := h.setFront(last); err != nil {
+		return err
+	}
+
+	return h.setBack(first)
+}
+
+// SetData sets the payload of n, which must be a part of the list and must
+// have been created by NewDListData, to a copy of data. If n is reallocated,
+// the links from its neighbors and the list header are updated.
+func (h DListHead) SetData(n DList, data []byte) (DList, error) {
+	first, err := h.Front()
+	if err != nil {
+		return n, err
+	}
+
+	last, err := h.Back()
+	if err != nil {
+		return n, err
+	}
+
+	r, err := n.SetData(data)
+	if err != nil || r.Off == n.Off {
+		return r, err
+	}
+
+	if n.Off == first {
+		if err := h.setFront(r.Off); err != nil {
+			return r, err
+		}
+	}
+
+	if n.Off == last {
+		if err := h.setBack(r.Off); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// Sort sorts the list. For details see DList.Sort.
+func (h DListHead) Sort(less func(aoff, boff int64) (bool, error)) error {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return err
+	}
+
+	first, last, err := sortChain(h.DB, first, oDListNext, less)
+	if err != nil {
+		return err
+	}
+
+	if err := fixPrev(h.DB, first); err != nil {
+		return err
+	}
+
+	if err := h.setFront(first); err != nil {
+		return err
+	}
+
+	return h.setBack(last)
+}
+
+// Splice moves the range of nodes from first to last, inclusive, after the
+// node at at or to the front of the list if at is zero. The range must be a
+// part of the list, first must not follow last and at must not be in the
+// range. The nodes are relinked in place, their payloads are not copied.
+func (h DListHead) Splice(first, last, at int64) error {
+	for off := first; ; {
+		if off == 0 || off == at {
+			return fmt.Errorf("%T.Splice: invalid range", h)
+		}
+
+		if off == last {
+			break
+		}
+
+		n, err := h.OpenDList(off)
+		if err != nil {
+			return err
+		}
+
+		if off, err = n.Next(); err != nil {
+			return err
+		}
+	}
+
+	f, err := h.OpenDList(first)
+	if err != nil {
+		return err
+	}
+
+	l, err := h.OpenDList(last)
+	if err != nil {
+		return err
+	}
+
+	prev, err := f.Prev()
+	if err != nil {
+		return err
+	}
+
+	if prev == at {
+		return nil
+	}
+
+	next, err := l.Next()
+	if err != nil {
+		return err
+	}
+
+	if err := h.link(prev, next); err != nil {
+		return err
+	}
+
+	var after int64
+	switch {
+	case at == 0:
+		if after, err = h.Front(); err != nil {
+			return err
+		}
+	default:
+		a, err := h.OpenDList(at)
+		if err != nil {
+			return err
+		}
+
+		if after, err = a.Next(); err != nil {
+			return err
+		}
+	}
+
+	if err := h.link(at, first); err != nil {
+		return err
+	}
+
+	return h.link(last, after)
+}
+
+// SplitAt moves the nodes from the node at off, which must be a part of the
+// list, to the back of the list to a newly allocated DListHead and returns
+// it. The nodes are relinked in place.
+func (h DListHead) SplitAt(off int64) (DListHead, error) {
+	if off == 0 {
+		return DListHead{}, fmt.Errorf("%T.SplitAt: invalid argument", h)
+	}
+
+	var n int64
+	for x := off; x != 0; n++ {
+		l, err := h.OpenDList(x)
+		if err != nil {
+			return DListHead{}, err
+		}
+
+		if x, err = l.Next(); err != nil {
+			return DListHead{}, err
+		}
+	}
+
+	last, err := h.Back()
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	l, err := h.OpenDList(off)
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	prev, err := l.Prev()
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	cnt, err := h.Len()
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	r, err := h.NewDListHead()
+	if err != nil {
+		return DListHead{}, err
+	}
+
+	if err := r.setFront(off); err != nil {
+		r.Free(r.Off)
+		return DListHead{}, err
+	}
+
+	if err := r.setBack(last); err != nil {
+		r.Free(r.Off)
+		return DListHead{}, err
+	}
+
+	if err := r.setLen(n); err != nil {
+		r.Free(r.Off)
+		return DListHead{}, err
+	}
+
+	if err := h.cut(prev, l, cnt-n); err != nil {
+		// r is freed only if the nodes are linked back to h.
+		if h.link(prev, off) == nil && h.setBack(last) == nil && h.setLen(cnt) == nil {
+			r.Free(r.Off)
+		}
+		return DListHead{}, err
+	}
+
+	return r, nil
+}
+
+// cut ends the list, now having n nodes, at prev, which precedes the node l.
+func (h DListHead) cut(prev int64, l DList, n int64) error {
+	if err := h.link(prev, 0); err != nil {
+		return err
+	}
+
+	if err := h.setLen(n); err != nil {
+		return err
+	}
+
+	return l.setPrev(0)
+}
+
+// Unlink removes n, which must be a part of the list, from the list without
+// freeing it. The links of n are cleared, so it can be inserted into a list
+// again.
+func (h DListHead) Unlink(n DList) error {
+	prev, err := n.Prev()
+	if err != nil {
+		return err
+	}
+
+	next, err := n.Next()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case prev == 0:
+		if err := h.setFront(next); err != nil {
+			return err
+		}
+	default:
+		p, err := h.OpenDList(prev)
+		if err != nil {
+			return err
+		}
+
+		if err := p.setNext(next); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case next == 0:
+		if err := h.setBack(prev); err != nil {
+			return err
+		}
+	default:
+		x, err := h.OpenDList(next)
+		if err != nil {
+			return err
+		}
+
+		if err := x.setPrev(prev); err != nil {
+			return err
+		}
+	}
+
+	if err := n.setPrev(0); err != nil {
+		return err
+	}
+
+	if err := n.setNext(0); err != nil {
+		return err
+	}
+
+	return h.add(-1)
+}
+
+// fixPrev sets the prev links of the list starting at off to match its next
+// links.
+func fixPrev(db *DB, off int64) error {
+	var prev int64
+	for off != 0 {
+		n, err := db.OpenDList(off)
+		if err != nil {
+			return err
+		}
+
+		if err := n.setPrev(prev); err != nil {
+			return err
+		}
+
+		prev = off
+		if off, err = n.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,6 +5,8 @@
 package db
 
 import (
+	"bytes"
+	"sort"
 	"testing"
 
 	"github.com/cznic/file"
@@ -336,6 +338,707 @@ func TestDListRemoveToFirst(t *testing.T) {
 	}
 }
 
+func dListHeadVerify(t testing.TB, h DListHead, out []int) {
+	n, err := h.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := n, int64(len(out)); g != e {
+		t.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	off, err := h.Front()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	for i, ev := range out {
+		l, err := h.OpenDList(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prev, err := l.Prev()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := prev, last; g != e {
+			t.Fatalf("list item #%v, got prev %#x, expected %#x", i, g, e)
+		}
+
+		v, err := h.r8(l.DataOff())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := v, int64(ev); g != e {
+			t.Fatalf("list item #%v, got %v, expected %v", i, g, e)
+		}
+
+		last = off
+		if off, err = l.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if off != 0 {
+		t.Fatalf("unexpected list item %#x", off)
+	}
+
+	back, err := h.Back()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := back, last; g != e {
+		t.Fatalf("got back %#x, expected %#x", g, e)
+	}
+}
+
+func testDListHead(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewDListHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	node := func(v int) DList {
+		n, err := db.NewDList(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := n.w8(n.DataOff(), int64(v)); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+	pop := func(n DList, err error) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n.Off == 0 {
+			return -1
+		}
+
+		v, err := n.r8(n.DataOff())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := n.Free(n.Off); err != nil {
+			t.Fatal(err)
+		}
+
+		return int(v)
+	}
+
+	dListHeadVerify(t, h, nil)
+	if g, e := pop(h.PopFront()), -1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := pop(h.PopBack()), -1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := h.PushBack(node(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{20})
+	if err := h.PushFront(node(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 20})
+	if err := h.PushBack(node(40)); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 20, 40})
+	first, err := h.Front()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.OpenDList(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := l.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.InsertAfter(node(30), second); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 20, 30, 40})
+	if err := h.InsertBefore(node(5), first); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{5, 10, 20, 30, 40})
+	if g, e := pop(h.PopFront()), 5; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := h.InsertBefore(node(15), second); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 15, 20, 30, 40})
+	if first, err = h.Front(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = h.OpenDList(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if first, err = l.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = h.OpenDList(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Remove(l); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 20, 30, 40})
+	back, err := h.Back()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.InsertAfter(node(50), back); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 20, 30, 40, 50})
+	if l, err = h.OpenDList(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Remove(l); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{10, 30, 40, 50})
+	if g, e := pop(h.PopBack()), 50; g != e {
+		t.Fatal(g, e)
+	}
+
+	dListHeadVerify(t, h, []int{10, 30, 40})
+	if g, e := pop(h.PopFront()), 10; g != e {
+		t.Fatal(g, e)
+	}
+
+	dListHeadVerify(t, h, []int{30, 40})
+	if back, err = h.Back(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = h.OpenDList(back); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Remove(l); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{30})
+	if g, e := pop(h.PopBack()), 30; g != e {
+		t.Fatal(g, e)
+	}
+
+	dListHeadVerify(t, h, nil)
+	for i := 0; i < 10; i++ {
+		if err := h.PushBack(node(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, err = db.OpenDListHead(h.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	dListHeadVerify(t, h, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+}
+
+func TestDListHead(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDListHead(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testDListHeadRelink(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewDListHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 20
+	m := map[int]DList{}
+	var out []int
+	for i := 0; i < N; i++ {
+		n, err := db.NewDList(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := n.w8(n.DataOff(), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.PushBack(n); err != nil {
+			t.Fatal(err)
+		}
+
+		m[i] = n
+		out = append(out, i)
+	}
+	dListHeadVerify(t, h, out)
+
+	index := func(v int) int {
+		for i, w := range out {
+			if w == v {
+				return i
+			}
+		}
+		panic("internal error")
+	}
+	x := rng()
+	next := func(n int) int { return int(uint32(x.Next()) % uint32(n)) }
+	for i := 0; i < 500; i++ {
+		a := next(N)
+		b := next(N)
+		var err error
+		switch next(8) {
+		case 0:
+			if a == b {
+				continue
+			}
+
+			err = h.MoveAfter(m[a], m[b].Off)
+			j := index(a)
+			out = append(out[:j], out[j+1:]...)
+			j = index(b) + 1
+			out = append(out[:j], append([]int{a}, out[j:]...)...)
+		case 1:
+			if a == b {
+				continue
+			}
+
+			err = h.MoveBefore(m[a], m[b].Off)
+			j := index(a)
+			out = append(out[:j], out[j+1:]...)
+			j = index(b)
+			out = append(out[:j], append([]int{a}, out[j:]...)...)
+		case 2:
+			err = h.MoveToFront(m[a])
+			j := index(a)
+			out = append([]int{a}, append(out[:j:j], out[j+1:]...)...)
+		case 3:
+			err = h.MoveToBack(m[a])
+			j := index(a)
+			out = append(append(out[:j:j], out[j+1:]...), a)
+		case 4:
+			err = h.Reverse()
+			for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+				out[i], out[j] = out[j], out[i]
+			}
+		case 5:
+			lo, hi := index(a), index(b)
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+
+			r := append([]int(nil), out[lo:hi+1]...)
+			rest := append(out[:lo:lo], out[hi+1:]...)
+			var at int64
+			j := 0
+			if len(rest) != 0 {
+				if k := next(len(rest) + 1); k != 0 {
+					at = m[rest[k-1]].Off
+					j = k
+				}
+			}
+
+			err = h.Splice(m[r[0]].Off, m[r[len(r)-1]].Off, at)
+			out = append(rest[:j:j], append(r, rest[j:]...)...)
+		case 6:
+			if err = h.Unlink(m[a]); err != nil {
+				break
+			}
+
+			err = h.PushBack(m[a])
+			j := index(a)
+			out = append(append(out[:j:j], out[j+1:]...), a)
+		case 7:
+			var o DListHead
+			if o, err = h.SplitAt(m[a].Off); err != nil {
+				break
+			}
+
+			j := index(a)
+			dListHeadVerify(t, h, out[:j])
+			dListHeadVerify(t, o, out[j:])
+			if err = h.Concat(o); err != nil {
+				break
+			}
+
+			dListHeadVerify(t, o, nil)
+			err = o.Free(o.Off)
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		dListHeadVerify(t, h, out)
+	}
+
+	// Writing the new head or cutting the list fails.
+	for w := 0; ; w++ {
+		x := h
+		x.DB = &DB{&writeFault{Storage: db, w: w}}
+		o, err := x.SplitAt(m[out[len(out)/2]].Off)
+		if err == nil {
+			o.DB = db.DB
+			if err := h.Concat(o); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := o.Free(o.Off); err != nil {
+				t.Fatal(err)
+			}
+
+			break
+		}
+
+		dListHeadVerify(t, h, out)
+	}
+
+	if err := h.Splice(m[out[0]].Off, m[out[2]].Off, m[out[1]].Off); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err := h.Splice(m[out[2]].Off, m[out[0]].Off, 0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	dListHeadVerify(t, h, out)
+}
+
+func TestDListHeadRelink(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDListHeadRelink(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testDListData(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewDListHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 5
+	payload := func(i, sz int) []byte {
+		b := make([]byte, sz)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+		return b
+	}
+	sizes := make([]int, N)
+	check := func() {
+		off, err := h.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var last, prev int64
+		for i := 0; i < N; i++ {
+			l, err := h.OpenDList(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if prev, err = l.Prev(); err != nil {
+				t.Fatal(err)
+			}
+
+			if prev != last {
+				t.Fatalf("node #%v: got prev %#x, expected %#x", i, prev, last)
+			}
+
+			b, err := l.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := b, payload(i, sizes[i]); !bytes.Equal(g, e) {
+				t.Fatalf("node #%v: got %v, expected %v", i, g, e)
+			}
+
+			last = off
+			if off, err = l.Next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if off != 0 {
+			t.Fatalf("unexpected list item %#x", off)
+		}
+
+		back, err := h.Back()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if back != last {
+			t.Fatalf("got back %#x, expected %#x", back, last)
+		}
+	}
+
+	// Writing the links or the payload of the new node fails.
+	for w := 0; w < 5; w++ {
+		if _, err := (&DB{&ioLimit{db, -1, w}}).NewDListData(payload(1, 1)); err == nil {
+			t.Fatal(w)
+		}
+	}
+	for i := 0; i < N; i++ {
+		n, err := db.NewDListData(payload(i, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.PushBack(n); err != nil {
+			t.Fatal(err)
+		}
+
+		sizes[i] = i
+	}
+	check()
+	for _, sz := range []int{3, 100, 10, 0, 1000} {
+		for i := 0; i < N; i++ {
+			off, err := h.Front()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := h.OpenDList(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for j := 0; j < i; j++ {
+				if l.Off, err = l.Next(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := h.SetData(l, payload(i, sz+i)); err != nil {
+				t.Fatal(err)
+			}
+
+			sizes[i] = sz + i
+			check()
+		}
+	}
+}
+
+func TestDListData(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDListData(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testDListSort(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	x := rng()
+	less := func(aoff, boff int64) (bool, error) {
+		a, err := db.r8(aoff + oDListData)
+		if err != nil {
+			return false, err
+		}
+
+		b, err := db.r8(boff + oDListData)
+		if err != nil {
+			return false, err
+		}
+
+		return a/1000 < b/1000, nil
+	}
+	for _, n := range []int{0, 1, 2, 3, 17, 999} {
+		h, err := db.NewDListHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e []int
+		for i := 0; i < n; i++ {
+			v := int(uint32(x.Next())%16)*1000 + i
+			l, err := db.NewDList(8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := l.w8(l.DataOff(), int64(v)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.PushBack(l); err != nil {
+				t.Fatal(err)
+			}
+
+			e = append(e, v)
+		}
+		sort.Ints(e)
+		if err := h.Sort(less); err != nil {
+			t.Fatal(err)
+		}
+
+		dListHeadVerify(t, h, e)
+		if n != 0 {
+			for i := range e {
+				e[i] = e[i]%1000*1000 + e[i]/1000
+			}
+			sort.Ints(e)
+			for i := range e {
+				e[i] = e[i]%1000*1000 + e[i]/1000
+			}
+			first, err := h.Front()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := h.OpenDList(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if l, err = l.Sort(func(aoff, boff int64) (bool, error) {
+				a, err := db.r8(aoff + oDListData)
+				if err != nil {
+					return false, err
+				}
+
+				b, err := db.r8(boff + oDListData)
+				if err != nil {
+					return false, err
+				}
+
+				return a%1000 < b%1000, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.setFront(l.Off); err != nil {
+				t.Fatal(err)
+			}
+
+			last := l.Off
+			for {
+				next, err := db.OpenDList(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				off, err := next.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if off == 0 {
+					break
+				}
+
+				last = off
+			}
+			if err := h.setBack(last); err != nil {
+				t.Fatal(err)
+			}
+
+			dListHeadVerify(t, h, e)
+		}
+
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDListSort(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDListSort(t, v.f) }) {
+			break
+		}
+	}
+}
+
 func benchmarkNewDList(b *testing.B, ts func(t testing.TB) (file.File, func()), dataSize int64) {
 	db, f := tmpDB(b, ts)
 
@@ -0,0 +1,612 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/cznic/internal/buffer"
+	"github.com/cznic/mathutil"
+)
+
+const (
+	hashBucketSize = 4096
+	hashMaxDepth   = 48
+)
+
+const (
+	oHashLen   = 8 * iota // int64
+	oHashDepth            // int64
+	oHashDir              // int64
+	oHashCap              // int64
+	oHashSzKey            // int64
+	oHashSzVal            // int64
+
+	szHash
+)
+
+const (
+	oHashBucketDepth = 4 * iota // int32
+	oHashBucketLen              // int32
+	oHashBucketItems            // [cap]struct{[szKey]byte, [szVal]byte}
+)
+
+// Hash is a persistent extendible hash table. Keys and values are fixed size
+// byte strings stored in the table. Items are kept in buckets found through a
+// directory indexed by the low bits of the FNV-1a hash of the key bytes. A
+// full bucket is split in two, doubling the directory when necessary, so a
+// lookup reads the directory entry and a single bucket. Buckets are never
+// merged.
+//
+// Splitting a bucket moves items, the value offsets returned by Get are valid
+// only until the next Set or Delete.
+type Hash struct {
+	*DB
+	Off   int64 // Location in the database.
+	SzKey int64 // The szKey argument of NewHash.
+	SzVal int64 // The szVal argument of NewHash.
+	cap   int
+}
+
+// NewHash allocates and returns a new, empty Hash or an error, if any. The
+// szKey and szVal arguments are the sizes of the Hash keys and values.
+func (db *DB) NewHash(szKey, szVal int64) (*Hash, error) {
+	if szKey < 0 || szVal < 0 || szKey+szVal > math.MaxInt32 {
+		panic(fmt.Errorf("%T.NewHash: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szHash)
+	if err != nil {
+		return nil, err
+	}
+
+	c := 4
+	if sz := szKey + szVal; sz != 0 {
+		c = mathutil.Max(c, int(hashBucketSize/sz))
+	}
+	if err := db.w8(off+oHashCap, int64(c)); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oHashSzKey, szKey); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oHashSzVal, szVal); err != nil {
+		return nil, err
+	}
+
+	t := &Hash{DB: db, Off: off, SzKey: szKey, SzVal: szVal, cap: c}
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// OpenHash opens and returns an existing Hash or an error, if any.
+func (db *DB) OpenHash(off int64) (*Hash, error) {
+	c, err := db.r8(off + oHashCap)
+	if err != nil {
+		return nil, err
+	}
+
+	szKey, err := db.r8(off + oHashSzKey)
+	if err != nil {
+		return nil, err
+	}
+
+	szVal, err := db.r8(off + oHashSzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if c < 1 || c > math.MaxInt32 || szKey < 0 || szVal < 0 {
+		return nil, fmt.Errorf("%T.OpenHash: corrupted database", db)
+	}
+
+	return &Hash{DB: db, Off: off, SzKey: szKey, SzVal: szVal, cap: int(c)}, nil
+}
+
+func (t *Hash) bucket(h uint64) (int64, error) {
+	g, err := t.depth()
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := t.dir()
+	if err != nil {
+		return 0, err
+	}
+
+	return t.r8(dir + 8*int64(h&(1<<uint(g)-1)))
+}
+
+func (t *Hash) depth() (int, error) {
+	n, err := t.r8(t.Off + oHashDepth)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 || n > hashMaxDepth {
+		return 0, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	return int(n), nil
+}
+
+func (t *Hash) depthB(b int64) (int, error)              { return t.r4(b + oHashBucketDepth) }
+func (t *Hash) dir() (int64, error)                      { return t.r8(t.Off + oHashDir) }
+func (t *Hash) item(b int64, i int) int64                { return b + oHashBucketItems + int64(i)*(t.SzKey+t.SzVal) }
+func (t *Hash) lenB(b int64) (int, error)                { return t.r4(b + oHashBucketLen) }
+func (t *Hash) setDepth(n int) error                     { return t.w8(t.Off+oHashDepth, int64(n)) }
+func (t *Hash) setDepthB(b int64, n int) error           { return t.w4(b+oHashBucketDepth, n) }
+func (t *Hash) setDir(off int64) error                   { return t.w8(t.Off+oHashDir, off) }
+func (t *Hash) setEntry(dir int64, i int, b int64) error { return t.w8(dir+8*int64(i), b) }
+func (t *Hash) setLenB(b int64, n int) error             { return t.w4(b+oHashBucketLen, n) }
+
+// find returns the index of the item with key k in bucket b or -1 if there's
+// no such item.
+func (t *Hash) find(b int64, k []byte) (int, error) {
+	n, err := t.lenB(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return -1, nil
+	}
+
+	sz := int(t.SzKey + t.SzVal)
+	p := buffer.Get(n * sz)
+	defer buffer.Put(p)
+
+	if n, err := t.ReadAt(*p, t.item(b, 0)); n != len(*p) {
+		if err == nil {
+			panic("internal error")
+		}
+
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		if bytes.Equal((*p)[i*sz:i*sz+int(t.SzKey)], k) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func (t *Hash) hash(k []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(k)
+	return h.Sum64()
+}
+
+func (t *Hash) incLen(delta int64) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oHashLen, n+delta)
+}
+
+// init sets up an empty directory of depth zero referring a single empty
+// bucket.
+func (t *Hash) init() error {
+	b, err := t.newBucket()
+	if err != nil {
+		return err
+	}
+
+	dir, err := t.Alloc(8)
+	if err != nil {
+		return err
+	}
+
+	if err := t.setEntry(dir, 0, b); err != nil {
+		return err
+	}
+
+	if err := t.setDir(dir); err != nil {
+		return err
+	}
+
+	if err := t.setDepth(0); err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oHashLen, 0)
+}
+
+func (t *Hash) newBucket() (int64, error) {
+	return t.Calloc(oHashBucketItems + int64(t.cap)*(t.SzKey+t.SzVal))
+}
+
+// split splits the full bucket b found at directory index i.
+func (t *Hash) split(b int64, i uint64) error {
+	l, err := t.depthB(b)
+	if err != nil {
+		return err
+	}
+
+	g, err := t.depth()
+	if err != nil {
+		return err
+	}
+
+	dir, err := t.dir()
+	if err != nil {
+		return err
+	}
+
+	if l == g {
+		if g == hashMaxDepth {
+			return fmt.Errorf("%T.Set: too many hash collisions", t)
+		}
+
+		n := int64(1) << uint(g)
+		if dir, err = t.Realloc(dir, 16*n); err != nil {
+			return err
+		}
+
+		if err := copyStorage(t, dir+8*n, t, dir, 8*n); err != nil {
+			return err
+		}
+
+		if err := t.setDir(dir); err != nil {
+			return err
+		}
+
+		g++
+		if err := t.setDepth(g); err != nil {
+			return err
+		}
+	}
+
+	b2, err := t.newBucket()
+	if err != nil {
+		return err
+	}
+
+	if err := t.setDepthB(b, l+1); err != nil {
+		return err
+	}
+
+	if err := t.setDepthB(b2, l+1); err != nil {
+		return err
+	}
+
+	// Redirect the directory entries of b with bit l set to b2.
+	low := i & (1<<uint(l) - 1)
+	for j := low | 1<<uint(l); j < 1<<uint(g); j += 1 << uint(l+1) {
+		if err := t.setEntry(dir, int(j), b2); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.lenB(b)
+	if err != nil {
+		return err
+	}
+
+	p := buffer.Get(int(t.SzKey))
+	defer buffer.Put(p)
+
+	sz := t.SzKey + t.SzVal
+	var w, w2 int
+	for j := 0; j < n; j++ {
+		if n, err := t.ReadAt(*p, t.item(b, j)); n != len(*p) {
+			if err == nil {
+				panic("internal error")
+			}
+
+			return err
+		}
+
+		switch {
+		case t.hash(*p)&(1<<uint(l)) != 0:
+			if err := copyStorage(t, t.item(b2, w2), t, t.item(b, j), sz); err != nil {
+				return err
+			}
+
+			w2++
+		default:
+			if w != j {
+				if err := copyStorage(t, t.item(b, w), t, t.item(b, j), sz); err != nil {
+					return err
+				}
+			}
+
+			w++
+		}
+	}
+
+	if err := t.setLenB(b, w); err != nil {
+		return err
+	}
+
+	return t.setLenB(b2, w2)
+}
+
+// Clear deletes all items of t.
+//
+// The free function may be nil, otherwise it's called with the offsets of the
+// key and value of an item that is being deleted from the table.
+func (t *Hash) Clear(free func(koff, voff int64) error) error {
+	if err := t.clr(free); err != nil {
+		return err
+	}
+
+	return t.init()
+}
+
+func (t *Hash) clr(free func(koff, voff int64) error) error {
+	g, err := t.depth()
+	if err != nil {
+		return err
+	}
+
+	dir, err := t.dir()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 1<<uint(g); i++ {
+		b, err := t.r8(dir + 8*int64(i))
+		if err != nil {
+			return err
+		}
+
+		l, err := t.depthB(b)
+		if err != nil {
+			return err
+		}
+
+		if i >= 1<<uint(l) {
+			continue
+		}
+
+		if free != nil {
+			n, err := t.lenB(b)
+			if err != nil {
+				return err
+			}
+
+			for j := 0; j < n; j++ {
+				koff := t.item(b, j)
+				if err := free(koff, koff+t.SzKey); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := t.Free(b); err != nil {
+			return err
+		}
+	}
+	return t.Free(dir)
+}
+
+// Delete removes the item with key k from t and returns a boolean value
+// indicating if the item was found. The length of k must be equal to SzKey.
+//
+// For discussion of the free function see Clear.
+func (t *Hash) Delete(k []byte, free func(koff, voff int64) error) (bool, error) {
+	if int64(len(k)) != t.SzKey {
+		panic(fmt.Errorf("%T.Delete: invalid argument", t))
+	}
+
+	b, err := t.bucket(t.hash(k))
+	if err != nil {
+		return false, err
+	}
+
+	i, err := t.find(b, k)
+	if err != nil || i < 0 {
+		return false, err
+	}
+
+	if free != nil {
+		koff := t.item(b, i)
+		if err := free(koff, koff+t.SzKey); err != nil {
+			return false, err
+		}
+	}
+
+	n, err := t.lenB(b)
+	if err != nil {
+		return false, err
+	}
+
+	if i != n-1 {
+		if err := copyStorage(t, t.item(b, i), t, t.item(b, n-1), t.SzKey+t.SzVal); err != nil {
+			return false, err
+		}
+	}
+
+	if err := t.setLenB(b, n-1); err != nil {
+		return false, err
+	}
+
+	return true, t.incLen(-1)
+}
+
+// Get searches for the item with key k and returns the offset of its value
+// and a boolean value indicating success. The length of k must be equal to
+// SzKey.
+func (t *Hash) Get(k []byte) (int64, bool, error) {
+	if int64(len(k)) != t.SzKey {
+		panic(fmt.Errorf("%T.Get: invalid argument", t))
+	}
+
+	b, err := t.bucket(t.hash(k))
+	if err != nil {
+		return 0, false, err
+	}
+
+	i, err := t.find(b, k)
+	if err != nil || i < 0 {
+		return 0, false, err
+	}
+
+	return t.item(b, i) + t.SzKey, true, nil
+}
+
+// Len returns the number of items in t or an error, if any.
+func (t *Hash) Len() (int64, error) { return t.r8(t.Off + oHashLen) }
+
+// Remove frees all space used by t.
+//
+// For discussion of the free function see Clear.
+func (t *Hash) Remove(free func(koff, voff int64) error) error {
+	if err := t.clr(free); err != nil {
+		return err
+	}
+
+	if err := t.Free(t.Off); err != nil {
+		return err
+	}
+
+	t.Off = 0
+	return nil
+}
+
+// Set adds or overwrites the item with key k and sets its value to v. The
+// lengths of k and v must be equal to SzKey and SzVal.
+func (t *Hash) Set(k, v []byte) error {
+	if int64(len(k)) != t.SzKey || int64(len(v)) != t.SzVal {
+		panic(fmt.Errorf("%T.Set: invalid argument", t))
+	}
+
+	h := t.hash(k)
+	for {
+		b, err := t.bucket(h)
+		if err != nil {
+			return err
+		}
+
+		i, err := t.find(b, k)
+		if err != nil {
+			return err
+		}
+
+		if i >= 0 {
+			_, err := t.WriteAt(v, t.item(b, i)+t.SzKey)
+			return err
+		}
+
+		n, err := t.lenB(b)
+		if err != nil {
+			return err
+		}
+
+		if n == t.cap {
+			if err := t.split(b, h); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if _, err := t.WriteAt(k, t.item(b, n)); err != nil {
+			return err
+		}
+
+		if _, err := t.WriteAt(v, t.item(b, n)+t.SzKey); err != nil {
+			return err
+		}
+
+		if err := t.setLenB(b, n+1); err != nil {
+			return err
+		}
+
+		return t.incLen(1)
+	}
+}
+
+// SeekFirst returns a cursor positioned before the first item of t, in
+// unspecified order, or an error, if any. The cursor is invalidated by any
+// Set or Delete.
+func (t *Hash) SeekFirst() (*HashCursor, error) {
+	g, err := t.depth()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := t.dir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashCursor{dir: dir, n: 1 << uint(g), t: t}, nil
+}
+
+// HashCursor provides enumerating Hash items in unspecified order.
+type HashCursor struct {
+	K   int64 // Item key offset. Not valid before calling Next.
+	V   int64 // Item value offset. Not valid before calling Next.
+	b   int64
+	bi  int
+	bn  int
+	dir int64
+	err error
+	i   int
+	n   int
+	t   *Hash
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *HashCursor) Err() error { return c.err }
+
+// Next moves the cursor to the next item and sets the K and V fields
+// accordingly. It returns true on success, or false if there is no next item
+// or an error happened while moving the cursor. Err should be consulted to
+// distinguish between the two cases.
+func (c *HashCursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	for c.bi >= c.bn {
+		if c.i >= c.n {
+			return false
+		}
+
+		i := c.i
+		c.i++
+		b, err := c.t.r8(c.dir + 8*int64(i))
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		l, err := c.t.depthB(b)
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		if i >= 1<<uint(l) {
+			continue
+		}
+
+		if c.bn, c.err = c.t.lenB(b); c.err != nil {
+			return false
+		}
+
+		c.b = b
+		c.bi = 0
+	}
+
+	c.K = c.t.item(c.b, c.bi)
+	c.V = c.K + c.t.SzKey
+	c.bi++
+	return true
+}
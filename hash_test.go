@@ -0,0 +1,222 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func (t *Hash) verify(tb testing.TB, m map[int]int) {
+	n, err := t.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	c, err := t.SeekFirst()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	seen := map[int]bool{}
+	for c.Next() {
+		k, err := t.r4(c.K)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if seen[k] {
+			tb.Fatalf("duplicate key %v", k)
+		}
+
+		seen[k] = true
+		v, err := t.r8(c.V)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if g, e := v, int64(m[k]); g != e {
+			tb.Fatalf("key %v: got %v, expected %v", k, g, e)
+		}
+	}
+	if err := c.Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := len(seen), len(m); g != e {
+		tb.Fatalf("got %v items, expected %v", g, e)
+	}
+}
+
+func testHash(t *testing.T, ts func(t testing.TB) (file.File, func()), szVal int64, n int) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewHash(4, szVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	val := func(v int) []byte {
+		b := make([]byte, szVal)
+		copy(b, batchVal(v))
+		return b
+	}
+	m := map[int]int{}
+	x := rng()
+	for i := 0; i < 4*n; i++ {
+		k := x.Next() & (n - 1)
+		switch {
+		case x.Next()%3 == 0:
+			ok, err := h.Delete(batchKey(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, e := m[k]
+			if ok != e {
+				t.Fatal(i, k, ok, e)
+			}
+
+			delete(m, k)
+		default:
+			if err := h.Set(batchKey(k), val(i)); err != nil {
+				t.Fatal(err)
+			}
+
+			m[k] = i
+		}
+	}
+	if h, err = db.OpenHash(h.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	h.verify(t, m)
+	for k := 0; k < n; k++ {
+		voff, ok, err := h.Get(batchKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, e := m[k]
+		if ok != e {
+			t.Fatal(k, ok, e)
+		}
+
+		if !ok {
+			continue
+		}
+
+		b := make([]byte, szVal)
+		if _, err := h.ReadAt(b, voff); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := b, val(v); !bytes.Equal(g, e) {
+			t.Fatal(k, g, e)
+		}
+	}
+
+	if err := h.Clear(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	h.verify(t, nil)
+	if _, ok, err := h.Get(batchKey(1)); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testHash(t, v.f, 8, 1<<13) }) {
+			break
+		}
+	}
+}
+
+func TestHashLargeValues(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testHash(t, v.f, 1000, 1<<9) }) {
+			break
+		}
+	}
+}
+
+func testHashFree(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewHash(4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := func(koff, voff int64) error {
+		p, err := h.r8(voff)
+		if err != nil {
+			return err
+		}
+
+		return h.Free(p)
+	}
+
+	defer func() {
+		if err := h.Remove(free); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1 << 10
+	for i := 0; i < N; i++ {
+		p, err := h.Alloc(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Set(batchKey(i), batchVal(int(p))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < N; i += 2 {
+		if ok, err := h.Delete(batchKey(i), free); !ok || err != nil {
+			t.Fatal(i, ok, err)
+		}
+	}
+	if g, e := h.tlen(t), int64(N/2); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestHashFree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testHashFree(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func (t *Hash) tlen(tb testing.TB) int64 {
+	c, err := t.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return c
+}
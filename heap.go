@@ -0,0 +1,477 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	oHeapSzVal = 8 * iota // int64		0	8
+	oHeapItems            // int64		8	8
+
+	szHeap
+)
+
+// Heap is a persistent binary min-heap. Every item is a separately allocated
+// storage block holding the item value followed by the index of the item in
+// the heap array. The heap array is an Array of item offsets.
+//
+// The offset of an item is its handle, it does not change while the item is
+// in the heap and it is also the offset of the item value. After changing the
+// value of an item, Fix must be called to restore the heap ordering.
+type Heap struct {
+	*DB
+	Off   int64 // Location in the database.
+	SzVal int64 // The szVal argument of NewHeap.
+	a     *Array
+	cmp   func(a, b int64) (int, error)
+}
+
+// NewHeap allocates and returns a new, empty Heap or an error, if any. The
+// szVal argument is the size of the Heap values.
+//
+// The cmp function is called with the offsets of the values of two items. It
+// returns a negative value if the item at a must be popped before the item at
+// b, a positive value if the item at b must be popped before the item at a
+// and zero otherwise.
+func (db *DB) NewHeap(szVal int64, cmp func(a, b int64) (int, error)) (*Heap, error) {
+	if szVal < 0 || cmp == nil {
+		panic(fmt.Errorf("%T.NewHeap: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szHeap)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := db.NewArray(8)
+	if err != nil {
+		db.Free(off)
+		return nil, err
+	}
+
+	if err := db.w8(off+oHeapSzVal, szVal); err != nil {
+		a.Remove()
+		db.Free(off)
+		return nil, err
+	}
+
+	if err := db.w8(off+oHeapItems, a.Off); err != nil {
+		a.Remove()
+		db.Free(off)
+		return nil, err
+	}
+
+	return &Heap{DB: db, Off: off, SzVal: szVal, a: a, cmp: cmp}, nil
+}
+
+// OpenHeap opens and returns an existing Heap or an error, if any. The cmp
+// argument must order the items in the same way as the cmp function passed to
+// NewHeap.
+func (db *DB) OpenHeap(off int64, cmp func(a, b int64) (int, error)) (*Heap, error) {
+	if cmp == nil {
+		panic(fmt.Errorf("%T.OpenHeap: invalid argument", db))
+	}
+
+	szVal, err := db.r8(off + oHeapSzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if szVal < 0 {
+		return nil, fmt.Errorf("%T.OpenHeap: corrupted database", db)
+	}
+
+	items, err := db.r8(off + oHeapItems)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := db.OpenArray(items)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Heap{DB: db, Off: off, SzVal: szVal, a: a, cmp: cmp}, nil
+}
+
+func (h *Heap) get(i int64) (int64, error) {
+	off, err := h.a.At(i)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.r8(off)
+}
+
+// set puts item n to slot i.
+func (h *Heap) set(i, n int64) error {
+	off, err := h.a.At(i)
+	if err != nil {
+		return err
+	}
+
+	if err := h.w8(off, n); err != nil {
+		return err
+	}
+
+	return h.w8(n+h.SzVal, i)
+}
+
+// index returns the heap array index of item n and the length of the heap
+// array.
+func (h *Heap) index(n int64) (int64, int64, error) {
+	cnt, err := h.Len()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	i, err := h.r8(n + h.SzVal)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if i < 0 || i >= cnt {
+		return 0, 0, fmt.Errorf("%T: invalid handle %#x", h, n)
+	}
+
+	m, err := h.get(i)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if m != n {
+		return 0, 0, fmt.Errorf("%T: invalid handle %#x", h, n)
+	}
+
+	return i, cnt, nil
+}
+
+// up moves the item at i towards the root while it must be popped before its
+// parent and reports whether the item was moved.
+func (h *Heap) up(i int64) (bool, error) {
+	n, err := h.get(i)
+	if err != nil {
+		return false, err
+	}
+
+	j := i
+	for j > 0 {
+		p := (j - 1) / 2
+		pn, err := h.get(p)
+		if err != nil {
+			return false, err
+		}
+
+		c, err := h.cmp(n, pn)
+		if err != nil {
+			return false, err
+		}
+
+		if c >= 0 {
+			break
+		}
+
+		if err := h.set(j, pn); err != nil {
+			return false, err
+		}
+
+		j = p
+	}
+	return j != i, h.set(j, n)
+}
+
+// down moves the item at i towards the leaves while any of its children must
+// be popped before it.
+func (h *Heap) down(i, cnt int64) error {
+	n, err := h.get(i)
+	if err != nil {
+		return err
+	}
+
+	for {
+		j := 2*i + 1
+		if j >= cnt {
+			break
+		}
+
+		jn, err := h.get(j)
+		if err != nil {
+			return err
+		}
+
+		if r := j + 1; r < cnt {
+			rn, err := h.get(r)
+			if err != nil {
+				return err
+			}
+
+			c, err := h.cmp(rn, jn)
+			if err != nil {
+				return err
+			}
+
+			if c < 0 {
+				j, jn = r, rn
+			}
+		}
+
+		c, err := h.cmp(jn, n)
+		if err != nil {
+			return err
+		}
+
+		if c >= 0 {
+			break
+		}
+
+		if err := h.set(i, jn); err != nil {
+			return err
+		}
+
+		i = j
+	}
+	return h.set(i, n)
+}
+
+func (h *Heap) fix(i, cnt int64) error {
+	moved, err := h.up(i)
+	if err != nil || moved {
+		return err
+	}
+
+	return h.down(i, cnt)
+}
+
+// Clear removes and frees all items of h.
+//
+// The free function may be nil, otherwise it's called with the offset of the
+// value of every item before it is freed.
+func (h *Heap) Clear(free func(voff int64) error) error {
+	n, err := h.Len()
+	if err != nil {
+		return err
+	}
+
+	for i := int64(0); i < n; i++ {
+		m, err := h.get(i)
+		if err != nil {
+			return err
+		}
+
+		if free != nil {
+			if err := free(m); err != nil {
+				return err
+			}
+		}
+
+		if err := h.Free(m); err != nil {
+			return err
+		}
+	}
+
+	return h.a.Truncate(0)
+}
+
+// Drop frees all space used by h.
+//
+// For discussion of the free function see Clear.
+func (h *Heap) Drop(free func(voff int64) error) error {
+	if err := h.Clear(free); err != nil {
+		return err
+	}
+
+	if err := h.a.Remove(); err != nil {
+		return err
+	}
+
+	if err := h.Free(h.Off); err != nil {
+		return err
+	}
+
+	h.Off = 0
+	return nil
+}
+
+// Fix restores the heap ordering after the value of the item with handle n
+// was changed.
+func (h *Heap) Fix(n int64) error {
+	i, cnt, err := h.index(n)
+	if err != nil {
+		return err
+	}
+
+	return h.fix(i, cnt)
+}
+
+// Len returns the number of items in h or an error, if any.
+func (h *Heap) Len() (int64, error) { return h.a.Len() }
+
+// Peek returns the handle of the item of h which would be popped next and a
+// boolean value indicating h is not empty or an error, if any.
+func (h *Heap) Peek() (int64, bool, error) {
+	n, err := h.Len()
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+
+	m, err := h.get(0)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return m, true, nil
+}
+
+// Pop removes the first item from h and returns a copy of its value and a
+// boolean value indicating h was not empty or an error, if any.
+func (h *Heap) Pop() ([]byte, bool, error) {
+	n, ok, err := h.Peek()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	b := make([]byte, h.SzVal)
+	if len(b) != 0 {
+		if _, err := h.ReadAt(b, n); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := h.Remove(n); err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// Push adds an item with value v to h and returns its handle or an error, if
+// any. The length of v must be equal to SzVal.
+func (h *Heap) Push(v []byte) (int64, error) {
+	if int64(len(v)) != h.SzVal {
+		panic(fmt.Errorf("%T.Push: invalid argument", h))
+	}
+
+	cnt, err := h.Len()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := h.Alloc(h.SzVal + 8)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := h.push(n, v, cnt); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// push adds the new item n with value v to h having cnt items. The slots of
+// the items moved down to make room for n are found before the heap array is
+// changed. If an error occurs, the moved items are put back, the array is
+// shrunk back to cnt items and n is freed.
+func (h *Heap) push(n int64, v []byte, cnt int64) error {
+	if h.SzVal != 0 {
+		if _, err := h.WriteAt(v, n); err != nil {
+			h.Free(n)
+			return err
+		}
+	}
+
+	// path[0] is the new slot, path[k] is the parent of path[k-1] and
+	// items[k] is the item at path[k] moved down to path[k-1].
+	path, items := []int64{cnt}, []int64{n}
+	for j := cnt; j > 0; {
+		p := (j - 1) / 2
+		pn, err := h.get(p)
+		if err != nil {
+			h.Free(n)
+			return err
+		}
+
+		c, err := h.cmp(n, pn)
+		if err != nil {
+			h.Free(n)
+			return err
+		}
+
+		if c >= 0 {
+			break
+		}
+
+		path = append(path, p)
+		items = append(items, pn)
+		j = p
+	}
+
+	if err := h.a.Truncate(cnt + 1); err != nil {
+		if h.a.Truncate(cnt) == nil {
+			h.Free(n)
+		}
+		return err
+	}
+
+	for k, i := range path {
+		m := n
+		if k+1 < len(path) {
+			m = items[k+1]
+		}
+		if err := h.set(i, m); err != nil {
+			if h.unpush(path, items, cnt) == nil {
+				h.Free(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unpush puts the items moved by push back to their slots and shrinks the
+// heap array to cnt items.
+func (h *Heap) unpush(path, items []int64, cnt int64) error {
+	for k := 1; k < len(path); k++ {
+		if err := h.set(path[k], items[k]); err != nil {
+			return err
+		}
+	}
+
+	return h.a.Truncate(cnt)
+}
+
+// Remove removes the item with handle n from h and frees it.
+func (h *Heap) Remove(n int64) error {
+	i, cnt, err := h.index(n)
+	if err != nil {
+		return err
+	}
+
+	cnt--
+	if i != cnt {
+		m, err := h.get(cnt)
+		if err != nil {
+			return err
+		}
+
+		if err := h.set(i, m); err != nil {
+			return err
+		}
+	}
+
+	if err := h.a.Truncate(cnt); err != nil {
+		return err
+	}
+
+	if i != cnt {
+		if err := h.fix(i, cnt); err != nil {
+			return err
+		}
+	}
+
+	return h.Free(n)
+}
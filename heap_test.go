@@ -0,0 +1,300 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func (h *Heap) verify(tb testing.TB, m map[int64]int64) {
+	n, err := h.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	for i := int64(0); i < n; i++ {
+		x, err := h.get(i)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		j, err := h.r8(x + h.SzVal)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if j != i {
+			tb.Fatalf("item %#x: got index %v, expected %v", x, j, i)
+		}
+
+		v, err := h.r8(x)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if e, ok := m[x]; !ok || v != e {
+			tb.Fatalf("item %#x: got %v, expected %v %v", x, v, e, ok)
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		p, err := h.get((i - 1) / 2)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if c, err := h.cmp(p, x); err != nil || c > 0 {
+			tb.Fatalf("heap order violated at %v: %v %v", i, c, err)
+		}
+	}
+}
+
+func heapCmp(s Storage) func(a, b int64) (int, error) {
+	return func(a, b int64) (int, error) {
+		x, err := r8(s, a)
+		if err != nil {
+			return 0, err
+		}
+
+		y, err := r8(s, b)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+}
+
+func testHeap(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewHeap(8, heapCmp(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.Drop(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[int64]int64{}
+	var handles []int64
+	x := rng()
+	const N = 3 * arrayPage / 8
+	for i := 0; i < 8*N; i++ {
+		switch op := uint32(x.Next()) % 8; {
+		case op < 4 && len(m) < N || len(m) == 0:
+			v := int64(x.Next())
+			n, err := h.Push(batchVal(int(v)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m[n] = v
+			handles = append(handles, n)
+		case op < 5:
+			n, ok, err := h.Peek()
+			if err != nil || !ok {
+				t.Fatal(ok, err)
+			}
+
+			b, ok, err := h.Pop()
+			if err != nil || !ok {
+				t.Fatal(ok, err)
+			}
+
+			var min int64
+			first := true
+			for _, v := range m {
+				if first || v < min {
+					min, first = v, false
+				}
+			}
+			if g, e := heapVal(b), min; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			delete(m, n)
+		case op < 6:
+			n := handles[uint32(x.Next())%uint32(len(handles))]
+			if _, ok := m[n]; !ok {
+				break
+			}
+
+			v := int64(x.Next())
+			if err := h.w8(n, v); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.Fix(n); err != nil {
+				t.Fatal(err)
+			}
+
+			m[n] = v
+		default:
+			n := handles[uint32(x.Next())%uint32(len(handles))]
+			if _, ok := m[n]; !ok {
+				break
+			}
+
+			if err := h.Remove(n); err != nil {
+				t.Fatal(err)
+			}
+
+			delete(m, n)
+		}
+		if i%N == 0 {
+			h.verify(t, m)
+		}
+		if len(handles) > 2*N {
+			w := 0
+			for _, n := range handles {
+				if _, ok := m[n]; ok {
+					handles[w] = n
+					w++
+				}
+			}
+			handles = handles[:w]
+		}
+	}
+	if h, err = db.OpenHeap(h.Off, heapCmp(db)); err != nil {
+		t.Fatal(err)
+	}
+
+	h.verify(t, m)
+	var e []int64
+	for _, v := range m {
+		e = append(e, v)
+	}
+	sort.Slice(e, func(i, j int) bool { return e[i] < e[j] })
+	for i := 0; i < len(e)/2; i++ {
+		b, ok, err := h.Pop()
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		if g, e := heapVal(b), e[i]; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+
+	if err := h.Clear(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	h.verify(t, nil)
+	if _, ok, err := h.Pop(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+}
+
+func heapVal(b []byte) int64 {
+	var n int64
+	for _, v := range b {
+		n = n<<8 | int64(v)
+	}
+	return n
+}
+
+func TestHeap(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testHeap(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testHeapError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	// Creating the item array or writing the header fails.
+	if _, err := (&DB{&allocLimit{db, 1}}).NewHeap(8, heapCmp(db)); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	for w := 2; ; w++ {
+		h, err := (&DB{&ioLimit{db, -1, w}}).NewHeap(8, heapCmp(db))
+		if err == nil {
+			if h, err = db.OpenHeap(h.Off, heapCmp(db)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.Drop(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			break
+		}
+	}
+
+	h, err := db.NewHeap(8, heapCmp(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.Drop(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The new items move to the root of the heap. The heap array does
+	// not get a new page.
+	n, err := h.Push(batchVal(1 << 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := map[int64]int64{n: 1 << 20}
+	const N = 100
+	for i := 1; i < N; i++ {
+		v := int64(N - i)
+		for w := 0; ; w++ {
+			x, err := (&DB{&writeFault{Storage: db, w: w}}).OpenHeap(h.Off, heapCmp(db))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := x.Push(batchVal(int(v)))
+			if err == nil {
+				m[n] = v
+				break
+			}
+
+			h.verify(t, m)
+		}
+		h.verify(t, m)
+	}
+}
+
+func TestHeapError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testHeapError(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MergeOp is the set operation performed by BTreeMerge.
+type MergeOp int
+
+// Values of MergeOp.
+const (
+	MergeUnion        MergeOp = iota // Items found in a, b or both.
+	MergeIntersection                // Items found in both a and b.
+	MergeDifference                  // Items found in a but not in b.
+)
+
+// DiffOp is the kind of difference reported by Diff.
+type DiffOp int
+
+// Values of DiffOp.
+const (
+	DiffAdded   DiffOp = iota // The key is in b but not in a.
+	DiffRemoved               // The key is in a but not in b.
+	DiffChanged               // The key is in both trees with different values.
+)
+
+// BTreeMerge combines the items of two BTreeCursors enumerating trees with
+// the same key layout, possibly in different DBs, in a single pass over both
+// of them.
+type BTreeMerge struct {
+	AK       int64 // Item key offset in a or zero if the item is not in a. Not valid before calling Next.
+	AV       int64 // Item value offset in a or zero if the item is not in a. Not valid before calling Next.
+	BK       int64 // Item key offset in b or zero if the item is not in b. Not valid before calling Next.
+	BV       int64 // Item value offset in b or zero if the item is not in b. Not valid before calling Next.
+	a        *BTreeCursor
+	b        *BTreeCursor
+	cmp      func(akoff, bkoff int64) (int, error)
+	err      error
+	hasA     bool
+	hasB     bool
+	hasMoved bool
+	op       MergeOp
+}
+
+// NewBTreeMerge returns a BTreeMerge producing the items of a and b selected
+// by op. The cursors must not be moved before, they are advanced by the
+// returned BTreeMerge only.
+//
+// The cmp function compares the key at akoff in a with the key at bkoff in b.
+// It returns a negative value if the key in a collates before the key in b, a
+// zero if the keys are equal and a positive value otherwise. If cmp is nil,
+// keys are compared as byte strings and the trees must have equal key sizes.
+func NewBTreeMerge(op MergeOp, a, b *BTreeCursor, cmp func(akoff, bkoff int64) (int, error)) *BTreeMerge {
+	switch op {
+	case MergeUnion, MergeIntersection, MergeDifference:
+	default:
+		panic(fmt.Errorf("NewBTreeMerge: invalid argument"))
+	}
+
+	if cmp == nil && a.t != nil && b.t != nil && a.t.SzKey != b.t.SzKey {
+		panic(fmt.Errorf("NewBTreeMerge: key sizes differ"))
+	}
+
+	r := &BTreeMerge{a: a, b: b, cmp: cmp, op: op}
+	if r.cmp == nil {
+		r.cmp = r.cmpBytes
+	}
+	return r
+}
+
+func (m *BTreeMerge) cmpBytes(akoff, bkoff int64) (int, error) {
+	return cmpStorage(m.a.t, akoff, m.b.t, bkoff, m.a.t.SzKey)
+}
+
+func (m *BTreeMerge) nextA() bool {
+	if m.hasA = m.a.Next(); !m.hasA {
+		m.err = m.a.Err()
+	}
+	return m.err == nil
+}
+
+func (m *BTreeMerge) nextB() bool {
+	if m.hasB = m.b.Next(); !m.hasB {
+		m.err = m.b.Err()
+	}
+	return m.err == nil
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (m *BTreeMerge) Err() error { return m.err }
+
+// Next moves m to the next item and sets the AK, AV, BK and BV fields
+// accordingly. It returns true on success, or false if there is no next item
+// or an error happened while moving the cursors. Err should be consulted to
+// distinguish between the two cases.
+func (m *BTreeMerge) Next() bool {
+	if m.err != nil {
+		return false
+	}
+
+	switch {
+	case !m.hasMoved:
+		m.hasMoved = true
+		if !m.nextA() || !m.nextB() {
+			return false
+		}
+	default:
+		if m.AK != 0 && !m.nextA() {
+			return false
+		}
+
+		if m.BK != 0 && !m.nextB() {
+			return false
+		}
+	}
+
+	for {
+		m.AK, m.AV, m.BK, m.BV = 0, 0, 0, 0
+		switch {
+		case !m.hasA && !m.hasB:
+			return false
+		case !m.hasB:
+			if m.op == MergeIntersection {
+				return false
+			}
+
+			m.AK, m.AV = m.a.K, m.a.V
+			return true
+		case !m.hasA:
+			if m.op != MergeUnion {
+				return false
+			}
+
+			m.BK, m.BV = m.b.K, m.b.V
+			return true
+		}
+
+		c, err := m.cmp(m.a.K, m.b.K)
+		if err != nil {
+			m.err = err
+			return false
+		}
+
+		switch {
+		case c < 0:
+			if m.op == MergeIntersection {
+				if !m.nextA() {
+					return false
+				}
+
+				continue
+			}
+
+			m.AK, m.AV = m.a.K, m.a.V
+		case c > 0:
+			if m.op != MergeUnion {
+				if !m.nextB() {
+					return false
+				}
+
+				continue
+			}
+
+			m.BK, m.BV = m.b.K, m.b.V
+		default:
+			if m.op == MergeDifference {
+				if !m.nextA() || !m.nextB() {
+					return false
+				}
+
+				continue
+			}
+
+			m.AK, m.AV = m.a.K, m.a.V
+			m.BK, m.BV = m.b.K, m.b.V
+		}
+		return true
+	}
+}
+
+// Diff compares trees a and b, which may be in different DBs, and calls f in
+// key order for every key added, removed or changed in b with respect to a.
+// The offsets of a key or value not present in a tree are zero.
+//
+// For discussion of the cmp function see NewBTreeMerge. The eq function
+// reports whether the value at avoff in a equals the value at bvoff in b. If
+// eq is nil, values are compared as byte strings, for trees owning their
+// values the contents of the value blocks are compared.
+func Diff(a, b *BTree, cmp func(akoff, bkoff int64) (int, error), eq func(avoff, bvoff int64) (bool, error), f func(op DiffOp, akoff, avoff, bkoff, bvoff int64) error) error {
+	switch {
+	case eq == nil && a.owned && b.owned:
+		eq = func(avoff, bvoff int64) (bool, error) {
+			x, err := a.Value(avoff)
+			if err != nil {
+				return false, err
+			}
+
+			y, err := b.Value(bvoff)
+			if err != nil {
+				return false, err
+			}
+
+			return bytes.Equal(x, y), nil
+		}
+	case eq == nil:
+		if a.SzVal != b.SzVal {
+			return fmt.Errorf("Diff: value sizes differ")
+		}
+
+		eq = func(avoff, bvoff int64) (bool, error) {
+			c, err := cmpStorage(a, avoff, b, bvoff, a.SzVal)
+			return c == 0, err
+		}
+	}
+	if cmp == nil && a.SzKey != b.SzKey {
+		return fmt.Errorf("Diff: key sizes differ")
+	}
+
+	ea, err := a.SeekFirst()
+	if err != nil {
+		return err
+	}
+
+	eb, err := b.SeekFirst()
+	if err != nil {
+		return err
+	}
+
+	m := NewBTreeMerge(MergeUnion, ea, eb, cmp)
+	for m.Next() {
+		switch {
+		case m.BK == 0:
+			if err := f(DiffRemoved, m.AK, m.AV, 0, 0); err != nil {
+				return err
+			}
+		case m.AK == 0:
+			if err := f(DiffAdded, 0, 0, m.BK, m.BV); err != nil {
+				return err
+			}
+		default:
+			ok, err := eq(m.AV, m.BV)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				break
+			}
+
+			if err := f(DiffChanged, m.AK, m.AV, m.BK, m.BV); err != nil {
+				return err
+			}
+		}
+	}
+	return m.Err()
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func mergeFill(t testing.TB, db *testDB, keys []int, val func(int) int) *BTree {
+	bt, err := db.NewBTree(4, 4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range keys {
+		koff, voff, err := bt.Set(bt.bcmp(k), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, k); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(voff, val(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bt
+}
+
+func testBTreeMerge(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	db2, f2 := tmpDB(t, ts)
+
+	defer f2()
+
+	var ka, kb []int
+	for i := 0; i < 300; i++ {
+		if i%2 == 0 {
+			ka = append(ka, i)
+		}
+		if i%3 == 0 {
+			kb = append(kb, i)
+		}
+	}
+	a := mergeFill(t, db, ka, func(k int) int { return k })
+	b := mergeFill(t, db2, kb, func(k int) int {
+		if k%4 == 0 {
+			return k
+		}
+
+		return -k
+	})
+	empty, err := db.NewBTree(4, 4, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		a.bremove(t)
+		b.bremove(t)
+		empty.bremove(t)
+	}()
+
+	type item struct{ a, b int }
+	merge := func(op MergeOp, a, b *BTree) (r []item) {
+		m := NewBTreeMerge(op, a.seekFirst(t), b.seekFirst(t), nil)
+		for m.Next() {
+			var it item
+			if m.AK != 0 {
+				k, err := a.r4(m.AK)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				v, err := a.r4(m.AV)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if v < 0 {
+					v = -v
+				}
+				if v != k {
+					t.Fatal(k, v)
+				}
+
+				it.a = k
+			}
+			if m.BK != 0 {
+				k, err := b.r4(m.BK)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				v, err := b.r4(m.BV)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if v < 0 {
+					v = -v
+				}
+				if v != k {
+					t.Fatal(k, v)
+				}
+
+				if it.b = k; m.AK != 0 && it.a != it.b {
+					t.Fatal(it.a, it.b)
+				}
+			}
+			r = append(r, it)
+		}
+		if err := m.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	var union, inter, diff, diffr, all []item
+	for _, k := range ka {
+		all = append(all, item{a: k})
+	}
+	for i := 0; i < 300; i++ {
+		switch {
+		case i%6 == 0:
+			union = append(union, item{i, i})
+			inter = append(inter, item{i, i})
+		case i%2 == 0:
+			union = append(union, item{a: i})
+			diff = append(diff, item{a: i})
+		case i%3 == 0:
+			union = append(union, item{b: i})
+			diffr = append(diffr, item{a: i})
+		}
+	}
+	for i, v := range []struct {
+		op   MergeOp
+		a, b *BTree
+		e    []item
+	}{
+		{MergeUnion, a, b, union},
+		{MergeIntersection, a, b, inter},
+		{MergeDifference, a, b, diff},
+		{MergeDifference, b, a, diffr},
+		{MergeUnion, a, empty, all},
+		{MergeIntersection, a, empty, nil},
+		{MergeDifference, empty, a, nil},
+	} {
+		e := v.e
+		g := merge(v.op, v.a, v.b)
+		if len(g) != len(e) {
+			t.Fatal(i, len(g), len(e))
+		}
+
+		for j := range g {
+			if g[j] != e[j] {
+				t.Fatal(i, j, g[j], e[j])
+			}
+		}
+	}
+
+	var added, removed, changed int
+	if err := Diff(a, b, nil, nil, func(op DiffOp, akoff, avoff, bkoff, bvoff int64) error {
+		switch op {
+		case DiffAdded:
+			k, err := b.r4(bkoff)
+			if err != nil {
+				return err
+			}
+
+			if akoff != 0 || k%2 == 0 || k%3 != 0 {
+				t.Fatal(op, k)
+			}
+
+			added++
+		case DiffRemoved:
+			k, err := a.r4(akoff)
+			if err != nil {
+				return err
+			}
+
+			if bkoff != 0 || k%2 != 0 || k%3 == 0 {
+				t.Fatal(op, k)
+			}
+
+			removed++
+		case DiffChanged:
+			k, err := a.r4(akoff)
+			if err != nil {
+				return err
+			}
+
+			if k%6 != 0 || k%4 == 0 {
+				t.Fatal(op, k)
+			}
+
+			changed++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := added, len(diffr); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := removed, len(diff); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := changed, 25; g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestBTreeMerge(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeMerge(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testBTreeMergeKeySizes(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	a, err := db.NewBTree(0, 0, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer a.bremove(t)
+
+	b, err := db.NewBTree(0, 0, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer b.bremove(t)
+
+	merge := func(cmp func(akoff, bkoff int64) (int, error)) (panicked bool) {
+		ea, err := a.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		eb, err := b.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() { panicked = recover() != nil }()
+
+		NewBTreeMerge(MergeUnion, ea, eb, cmp)
+		return false
+	}
+
+	if !merge(nil) {
+		t.Fatal("expected panic")
+	}
+
+	if merge(func(akoff, bkoff int64) (int, error) { return 0, nil }) {
+		t.Fatal("unexpected panic")
+	}
+}
+
+func TestBTreeMergeKeySizes(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testBTreeMergeKeySizes(t, v.f) }) {
+			break
+		}
+	}
+}
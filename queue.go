@@ -0,0 +1,303 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	oQueueItemLen  = 8 * iota // int64		0	8
+	oQueueItemData            // [len]byte		8	len
+)
+
+// Deque is a persistent double ended queue of byte strings. Its items are
+// DList nodes linked by a DListHead found at Off.
+//
+// Deque and Queue never call Sync. Every operation writes all of its changes
+// before it returns, a new item is written completely before it is linked
+// and a removed item is copied before it is unlinked. If the Storage is
+// WAL-backed and Sync is called after every successful operation, the
+// committed state after a crash reflects exactly the operations performed
+// before the last Sync, in order, and never a partially linked item. When an
+// operation fails, Sync should not be called before the Storage is rolled
+// back to its committed state: a failed push restores the links of the
+// Deque, but a failed pop may leave them partially updated.
+type Deque struct {
+	*DB
+	Off int64
+}
+
+// NewDeque returns a newly allocated, empty Deque or an error, if any.
+func (db *DB) NewDeque() (Deque, error) {
+	h, err := db.NewDListHead()
+	if err != nil {
+		return Deque{}, err
+	}
+
+	return db.OpenDeque(h.Off)
+}
+
+// OpenDeque returns a Deque found at offset off.
+func (db *DB) OpenDeque(off int64) (Deque, error) { return Deque{db, off}, nil }
+
+func (d Deque) head() DListHead { return DListHead{d.DB, d.Off} }
+
+// Back returns a copy of the last item of d without removing it. The
+// returned boolean value is false if d is empty.
+func (d Deque) Back() ([]byte, bool, error) { return d.peek(d.head().Back) }
+
+// Front returns a copy of the first item of d without removing it. The
+// returned boolean value is false if d is empty.
+func (d Deque) Front() ([]byte, bool, error) { return d.peek(d.head().Front) }
+
+// Len returns the number of items in d.
+func (d Deque) Len() (int64, error) { return d.head().Len() }
+
+// PopBack removes the last item of d and returns its copy. The returned
+// boolean value is false if d is empty.
+func (d Deque) PopBack() ([]byte, bool, error) { return d.pop(d.head().Back) }
+
+// PopFront removes the first item of d and returns its copy. The returned
+// boolean value is false if d is empty.
+func (d Deque) PopFront() ([]byte, bool, error) { return d.pop(d.head().Front) }
+
+// PushBack appends a copy of data to d.
+func (d Deque) PushBack(data []byte) error {
+	_, err := d.push(data, false)
+	return err
+}
+
+// PushFront prepends a copy of data to d.
+func (d Deque) PushFront(data []byte) error {
+	_, err := d.push(data, true)
+	return err
+}
+
+// Remove frees all items of d and d itself.
+func (d Deque) Remove() error {
+	if err := d.head().RemoveAll(); err != nil {
+		return err
+	}
+
+	return d.Free(d.Off)
+}
+
+func (d Deque) peek(f func() (int64, error)) ([]byte, bool, error) {
+	off, err := f()
+	if err != nil || off == 0 {
+		return nil, false, err
+	}
+
+	n, err := d.OpenDList(off)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b, err := d.read(n)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+func (d Deque) pop(f func() (int64, error)) ([]byte, bool, error) {
+	off, err := f()
+	if err != nil || off == 0 {
+		return nil, false, err
+	}
+
+	n, err := d.OpenDList(off)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b, err := d.read(n)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := d.head().Remove(n); err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// push links a new item holding data at the front of d if front is true or
+// at its back otherwise. It returns the offset of the new node.
+func (d Deque) push(data []byte, front bool) (int64, error) {
+	n, err := d.NewDList(oQueueItemData + int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	h := d.head()
+	var first, last, cnt int64
+	if err := func() (err error) {
+		if err := d.write(n, data); err != nil {
+			return err
+		}
+
+		if first, err = h.Front(); err != nil {
+			return err
+		}
+
+		if last, err = h.Back(); err != nil {
+			return err
+		}
+
+		cnt, err = h.Len()
+		return err
+	}(); err != nil {
+		n.Free(n.Off)
+		return 0, err
+	}
+
+	link, end := h.PushBack, last
+	if front {
+		link, end = h.PushFront, first
+	}
+	if err := link(n); err != nil {
+		// n may be already reachable from the head or from its neighbor,
+		// it is freed only if they are restored.
+		if d.restore(first, last, cnt, end, front) == nil {
+			n.Free(n.Off)
+		}
+		return 0, err
+	}
+
+	return n.Off, nil
+}
+
+func (d Deque) write(n DList, data []byte) error {
+	if err := n.w8(n.DataOff()+oQueueItemLen, int64(len(data))); err != nil {
+		return err
+	}
+
+	if len(data) != 0 {
+		if _, err := n.WriteAt(data, n.DataOff()+oQueueItemData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restore sets the head of d back to first, last and cnt and clears the link
+// of the node at end, if any, towards the front if front is true or towards
+// the back otherwise.
+func (d Deque) restore(first, last, cnt, end int64, front bool) error {
+	h := d.head()
+	if err := h.setFront(first); err != nil {
+		return err
+	}
+
+	if err := h.setBack(last); err != nil {
+		return err
+	}
+
+	if err := h.setLen(cnt); err != nil {
+		return err
+	}
+
+	if end == 0 {
+		return nil
+	}
+
+	x, err := d.OpenDList(end)
+	if err != nil {
+		return err
+	}
+
+	if front {
+		return x.setPrev(0)
+	}
+
+	return x.setNext(0)
+}
+
+func (d Deque) read(n DList) ([]byte, error) {
+	sz, err := n.r8(n.DataOff() + oQueueItemLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if sz < 0 {
+		return nil, fmt.Errorf("%T.read: corrupted item at %#x", d, n.Off)
+	}
+
+	b := make([]byte, sz)
+	if sz == 0 {
+		return b, nil
+	}
+
+	if _, err := n.ReadAt(b, n.DataOff()+oQueueItemData); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Queue is a persistent FIFO queue of byte strings. It is a Deque restricted
+// to appending items at the back and removing them from the front. See the
+// Deque documentation for the consistency guarantees.
+type Queue struct {
+	*DB
+	Off int64
+}
+
+// NewQueue returns a newly allocated, empty Queue or an error, if any.
+func (db *DB) NewQueue() (Queue, error) {
+	d, err := db.NewDeque()
+	if err != nil {
+		return Queue{}, err
+	}
+
+	return db.OpenQueue(d.Off)
+}
+
+// OpenQueue returns a Queue found at offset off.
+func (db *DB) OpenQueue(off int64) (Queue, error) { return Queue{db, off}, nil }
+
+func (q Queue) deque() Deque { return Deque{q.DB, q.Off} }
+
+// Dequeue removes the oldest item of q and returns its copy. The returned
+// boolean value is false if q is empty.
+func (q Queue) Dequeue() ([]byte, bool, error) { return q.deque().PopFront() }
+
+// DequeueN removes up to n oldest items of q and returns their copies in
+// order. It does not wait for new items, if q has less than n items, all of
+// them are returned.
+func (q Queue) DequeueN(n int) ([][]byte, error) {
+	var r [][]byte
+	for len(r) < n {
+		b, ok, err := q.Dequeue()
+		if err != nil {
+			return r, err
+		}
+
+		if !ok {
+			break
+		}
+
+		r = append(r, b)
+	}
+	return r, nil
+}
+
+// Enqueue appends a copy of data to q.
+func (q Queue) Enqueue(data []byte) error { return q.deque().PushBack(data) }
+
+// Len returns the number of items in q.
+func (q Queue) Len() (int64, error) { return q.deque().Len() }
+
+// Peek returns a copy of the oldest item of q without removing it. The
+// returned boolean value is false if q is empty.
+func (q Queue) Peek() ([]byte, bool, error) { return q.deque().Front() }
+
+// Remove frees all items of q and q itself.
+func (q Queue) Remove() error { return q.deque().Remove() }
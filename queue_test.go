@@ -0,0 +1,512 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func queueItem(i int) []byte { return []byte(fmt.Sprintf("%0*d", i%17, i)[:i%17]) }
+
+func testDeque(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	d, err := db.NewDeque()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := d.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1000
+	var m [][]byte
+	x := rng()
+	for i := 0; i < N; i++ {
+		switch uint32(x.Next()) % 5 {
+		case 0, 1:
+			b := queueItem(i)
+			if err := d.PushBack(b); err != nil {
+				t.Fatal(err)
+			}
+
+			m = append(m, b)
+		case 2:
+			b := queueItem(i)
+			if err := d.PushFront(b); err != nil {
+				t.Fatal(err)
+			}
+
+			m = append([][]byte{b}, m...)
+		case 3:
+			b, ok, err := d.PopFront()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := ok, len(m) != 0; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			if ok {
+				if !bytes.Equal(b, m[0]) {
+					t.Fatalf("%v: got %q, expected %q", i, b, m[0])
+				}
+
+				m = m[1:]
+			}
+		case 4:
+			b, ok, err := d.PopBack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := ok, len(m) != 0; g != e {
+				t.Fatal(i, g, e)
+			}
+
+			if ok {
+				if !bytes.Equal(b, m[len(m)-1]) {
+					t.Fatalf("%v: got %q, expected %q", i, b, m[len(m)-1])
+				}
+
+				m = m[:len(m)-1]
+			}
+		}
+
+		n, err := d.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := n, int64(len(m)); g != e {
+			t.Fatal(i, g, e)
+		}
+
+		front, ok, err := d.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		back, ok2, err := d.Back()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := ok && ok2, len(m) != 0; g != e || ok != ok2 {
+			t.Fatal(i, ok, ok2, e)
+		}
+
+		if ok && (!bytes.Equal(front, m[0]) || !bytes.Equal(back, m[len(m)-1])) {
+			t.Fatalf("%v: got %q %q, expected %q %q", i, front, back, m[0], m[len(m)-1])
+		}
+	}
+}
+
+func TestDeque(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDeque(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testDequeError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	d, err := db.NewDeque()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := d.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	check := func(n int) {
+		if g, err := d.Len(); err != nil || g != int64(n) {
+			t.Fatal(g, n, err)
+		}
+
+		b, ok, err := d.Front()
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		if g, e := b, queueItem(0); !bytes.Equal(g, e) {
+			t.Fatalf("got %q, expected %q", g, e)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := d.PushBack(queueItem(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Writing the links and the item of the new node.
+	for w := 0; w < 4; w++ {
+		x, err := db.OpenDeque(d.Off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x.DB = &DB{&ioLimit{db, -1, w}}
+		if err := x.PushBack(queueItem(3)); err == nil {
+			t.Fatal(w)
+		}
+
+		check(3)
+	}
+	// Reading the head and the item.
+	for r := 0; r < 3; r++ {
+		x, err := db.OpenDeque(d.Off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x.DB = &DB{&ioLimit{db, r, -1}}
+		if _, _, err := x.PopFront(); err == nil {
+			t.Fatal(r)
+		}
+
+		check(3)
+	}
+}
+
+func TestDequeError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDequeError(t, v.f) }) {
+			break
+		}
+	}
+}
+
+// walSim is a Storage simulating a write ahead log. Writes, allocations and
+// frees since the last Sync are committed by Sync or rolled back by crash.
+// The write after the first w ones fails, w < 0 means no failure.
+type walSim struct {
+	Storage
+	allocs []int64
+	frees  []int64
+	undo   []walUndo
+	w      int
+}
+
+type walUndo struct {
+	b   []byte
+	off int64
+}
+
+func (s *walSim) Alloc(size int64) (int64, error) {
+	off, err := s.Storage.Alloc(size)
+	if err == nil {
+		s.allocs = append(s.allocs, off)
+	}
+	return off, err
+}
+
+func (s *walSim) Calloc(size int64) (int64, error) {
+	off, err := s.Storage.Calloc(size)
+	if err == nil {
+		s.allocs = append(s.allocs, off)
+	}
+	return off, err
+}
+
+func (s *walSim) Free(off int64) error {
+	s.frees = append(s.frees, off)
+	return nil
+}
+
+func (s *walSim) Realloc(off, size int64) (int64, error) { panic("not supported") }
+
+func (s *walSim) WriteAt(b []byte, off int64) (int, error) {
+	switch {
+	case s.w == 0:
+		s.w = -1
+		return 0, fmt.Errorf("write failed")
+	case s.w > 0:
+		s.w--
+	}
+	u := make([]byte, len(b))
+	n, _ := s.Storage.ReadAt(u, off)
+	s.undo = append(s.undo, walUndo{u[:n], off})
+	return s.Storage.WriteAt(b, off)
+}
+
+func (s *walSim) Sync() error {
+	for _, off := range s.frees {
+		if err := s.Storage.Free(off); err != nil {
+			return err
+		}
+	}
+
+	s.allocs, s.frees, s.undo = nil, nil, nil
+	return s.Storage.Sync()
+}
+
+func (s *walSim) crash() error {
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		u := s.undo[i]
+		if _, err := s.Storage.WriteAt(u.b, u.off); err != nil {
+			return err
+		}
+	}
+	for _, off := range s.allocs {
+		if err := s.Storage.Free(off); err != nil {
+			return err
+		}
+	}
+
+	s.allocs, s.frees, s.undo = nil, nil, nil
+	return nil
+}
+
+func testDequeWAL(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	d, err := db.NewDeque()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := d.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// check verifies the links of d in both directions and its items.
+	check := func(m [][]byte) {
+		h := d.head()
+		if g, err := h.Len(); err != nil || g != int64(len(m)) {
+			t.Fatal(g, len(m), err)
+		}
+
+		var prev int64
+		off, err := h.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range m {
+			n, err := d.OpenDList(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p, err := n.Prev(); err != nil || p != prev {
+				t.Fatal(i, p, prev, err)
+			}
+
+			b, err := d.read(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(b, m[i]) {
+				t.Fatalf("%v: got %q, expected %q", i, b, m[i])
+			}
+
+			prev = off
+			if off, err = n.Next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if off != 0 {
+			t.Fatal(off)
+		}
+
+		if g, err := h.Back(); err != nil || g != prev {
+			t.Fatal(g, prev, err)
+		}
+	}
+
+	s := &walSim{Storage: db, w: -1}
+	x, err := (&DB{s}).OpenDeque(d.Off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 200
+	var m [][]byte
+	r := rng()
+	for i := 0; i < N; i++ {
+		var op func() error
+		var e [][]byte
+		push := false
+		b := queueItem(i)
+		switch uint32(r.Next()) % 4 {
+		case 0:
+			op = func() error { return x.PushBack(b) }
+			push = true
+			e = append(append([][]byte(nil), m...), b)
+		case 1:
+			op = func() error { return x.PushFront(b) }
+			push = true
+			e = append([][]byte{b}, m...)
+		case 2:
+			op = func() error { _, _, err := x.PopFront(); return err }
+			if e = m; len(m) != 0 {
+				e = m[1:]
+			}
+		case 3:
+			op = func() error { _, _, err := x.PopBack(); return err }
+			if e = m; len(m) != 0 {
+				e = m[:len(m)-1]
+			}
+		}
+		for w := 0; ; w++ {
+			s.w = w
+			if err := op(); err == nil {
+				break
+			}
+
+			// A failed push restores d, every other failed
+			// operation is rolled back.
+			switch {
+			case push && i%2 == 0:
+				err = s.Sync()
+			default:
+				err = s.crash()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			check(m)
+		}
+		s.w = -1
+		if err := s.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		m = e
+		check(m)
+	}
+}
+
+func TestDequeWAL(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testDequeWAL(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testQueue(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	q, err := db.NewQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := q.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, ok, err := q.Peek(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	if _, ok, err := q.Dequeue(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		if err := q.Enqueue(queueItem(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q, err = db.OpenQueue(q.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	next := 0
+	for next < N/2 {
+		b, ok, err := q.Peek()
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		if g, e := b, queueItem(next); !bytes.Equal(g, e) {
+			t.Fatalf("got %q, expected %q", g, e)
+		}
+
+		if b, ok, err = q.Dequeue(); err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		if g, e := b, queueItem(next); !bytes.Equal(g, e) {
+			t.Fatalf("got %q, expected %q", g, e)
+		}
+
+		next++
+	}
+	for {
+		a, err := q.DequeueN(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(a) == 0 {
+			break
+		}
+
+		if len(a) != 7 && next+len(a) != N {
+			t.Fatal(next, len(a))
+		}
+
+		for _, b := range a {
+			if g, e := b, queueItem(next); !bytes.Equal(g, e) {
+				t.Fatalf("got %q, expected %q", g, e)
+			}
+
+			next++
+		}
+	}
+	if g, e := next, N; g != e {
+		t.Fatal(g, e)
+	}
+
+	n, err := q.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testQueue(t, v.f) }) {
+			break
+		}
+	}
+}
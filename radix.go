@@ -0,0 +1,782 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+const (
+	oRTRoot  = 8 * iota // int64
+	oRTLen              // int64
+	oRTSzVal            // int64
+
+	szRadixTree
+)
+
+const (
+	oRTNodeFlags     = 8 * iota // int64
+	oRTNodeChildren             // int64
+	oRTNodePrefixLen            // int64
+	oRTNodeVal                  // [szVal]byte, children of the node kind, [prefixLen]byte
+
+	rtHasVal = 1 // Flags bit, the node kind is stored in the next byte.
+)
+
+// Node kinds. A node4 and a node16 store up to 4 or 16 sorted labels followed
+// by as many child offsets. A node48 stores 256 bytes mapping a label to the
+// 1-based index of one of its 48 child offsets, which are kept in label
+// order. A node256 stores a child offset, possibly zero, for every label.
+const (
+	rtNode4 = iota
+	rtNode16
+	rtNode48
+	rtNode256
+)
+
+var rtNodeCap = [...]int{rtNode4: 4, rtNode16: 16, rtNode48: 48, rtNode256: 256}
+
+// rtKind returns the smallest node kind able to hold nc children.
+func rtKind(nc int) int {
+	for k, v := range rtNodeCap {
+		if nc <= v {
+			return k
+		}
+	}
+
+	panic("internal error")
+}
+
+// rtChildrenSize returns the size of the children of a node of kind.
+func rtChildrenSize(kind int) int64 {
+	switch kind {
+	case rtNode4, rtNode16:
+		return 9 * int64(rtNodeCap[kind])
+	case rtNode48:
+		return 256 + 8*48
+	default:
+		return 8 * 256
+	}
+}
+
+// RadixTree is a persistent adaptive radix tree mapping variable length byte
+// string keys to fixed size values. Chains of nodes with a single child are
+// compressed into one node holding the common part of their keys. A node is
+// allocated as a node4, node16, node48 or node256, the smallest kind able to
+// hold its children. Children are added and removed in place until the node
+// has to grow or shrink to another kind.
+//
+// Changing the shape of the tree reallocates nodes, the value offsets
+// returned by Get and LongestPrefix are valid only until the next Set or
+// Delete.
+type RadixTree struct {
+	*DB
+	Off   int64 // Location in the database.
+	SzVal int64 // The szVal argument of NewRadixTree.
+}
+
+// NewRadixTree allocates and returns a new, empty RadixTree or an error, if
+// any. The szVal argument is the size of the RadixTree values.
+func (db *DB) NewRadixTree(szVal int64) (*RadixTree, error) {
+	if szVal < 0 {
+		panic(fmt.Errorf("%T.NewRadixTree: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szRadixTree)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oRTSzVal, szVal); err != nil {
+		return nil, err
+	}
+
+	return &RadixTree{DB: db, Off: off, SzVal: szVal}, nil
+}
+
+// OpenRadixTree opens and returns an existing RadixTree or an error, if any.
+func (db *DB) OpenRadixTree(off int64) (*RadixTree, error) {
+	szVal, err := db.r8(off + oRTSzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if szVal < 0 {
+		return nil, fmt.Errorf("%T.OpenRadixTree: corrupted database", db)
+	}
+
+	return &RadixTree{DB: db, Off: off, SzVal: szVal}, nil
+}
+
+// rtNode is the decoded form of a RadixTree node.
+type rtNode struct {
+	off      int64
+	kind     int
+	hasVal   bool
+	val      []byte // Read only when the node is going to be rewritten.
+	children []int64
+	labels   []byte
+	prefix   []byte
+}
+
+// child returns the index of the child with label c and a boolean value
+// indicating if it was found, otherwise the index where it would be inserted.
+func (n *rtNode) child(c byte) (int, bool) {
+	i := sort.Search(len(n.labels), func(i int) bool { return n.labels[i] >= c })
+	return i, i < len(n.labels) && n.labels[i] == c
+}
+
+func (t *RadixTree) incLen(delta int64) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oRTLen, n+delta)
+}
+
+func (t *RadixTree) root() (int64, error)    { return t.r8(t.Off + oRTRoot) }
+func (t *RadixTree) setRoot(off int64) error { return t.w8(t.Off+oRTRoot, off) }
+
+// read decodes the node at off. The value is read only if val is true.
+func (t *RadixTree) read(off int64, val bool) (*rtNode, error) {
+	var h [oRTNodeVal]byte
+	if n, err := t.ReadAt(h[:], off); n != len(h) {
+		if err == nil {
+			panic("internal error")
+		}
+
+		return nil, err
+	}
+
+	flags := dec8(h[oRTNodeFlags:])
+	nc := int64(dec8(h[oRTNodeChildren:]))
+	pl := int64(dec8(h[oRTNodePrefixLen:]))
+	kind := int(flags >> 8)
+	if kind > rtNode256 || nc < 0 || nc > int64(rtNodeCap[kind]) || pl < 0 {
+		return nil, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	cs := rtChildrenSize(kind)
+	b := make([]byte, t.SzVal+cs+pl)
+	if n, err := t.ReadAt(b, off+oRTNodeVal); n != len(b) {
+		if err == nil {
+			panic("internal error")
+		}
+
+		return nil, err
+	}
+
+	r := &rtNode{off: off, kind: kind, hasVal: flags&rtHasVal != 0}
+	if val {
+		r.val = b[:t.SzVal]
+	}
+	b = b[t.SzVal:]
+	r.prefix = b[cs:]
+	b = b[:cs]
+	switch kind {
+	case rtNode4, rtNode16:
+		r.labels = b[:nc]
+		b = b[rtNodeCap[kind]:]
+		for i := 0; i < int(nc); i++ {
+			r.children = append(r.children, int64(dec8(b[8*i:])))
+		}
+	case rtNode48:
+		for l, x := range b[:256] {
+			if x != 0 {
+				r.labels = append(r.labels, byte(l))
+				r.children = append(r.children, int64(dec8(b[256+8*int(x-1):])))
+			}
+		}
+	default:
+		for l := 0; l < 256; l++ {
+			if c := int64(dec8(b[8*l:])); c != 0 {
+				r.labels = append(r.labels, byte(l))
+				r.children = append(r.children, c)
+			}
+		}
+	}
+	if int64(len(r.children)) != nc {
+		return nil, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	return r, nil
+}
+
+// encChildren returns the encoding of the children of n according to its
+// kind.
+func (t *RadixTree) encChildren(n *rtNode) []byte {
+	b := make([]byte, rtChildrenSize(n.kind))
+	switch n.kind {
+	case rtNode4, rtNode16:
+		copy(b, n.labels)
+		p := b[rtNodeCap[n.kind]:]
+		for i, c := range n.children {
+			enc8(p[8*i:], uint64(c))
+		}
+	case rtNode48:
+		for i, c := range n.children {
+			b[n.labels[i]] = byte(i + 1)
+			enc8(b[256+8*i:], uint64(c))
+		}
+	default:
+		for i, c := range n.children {
+			enc8(b[8*int(n.labels[i]):], uint64(c))
+		}
+	}
+	return b
+}
+
+func (t *RadixTree) flags(n *rtNode) int64 {
+	f := int64(n.kind) << 8
+	if n.hasVal {
+		f |= rtHasVal
+	}
+	return f
+}
+
+// write allocates a new node holding n, of the smallest kind able to hold its
+// children, and returns its offset.
+func (t *RadixTree) write(n *rtNode) (int64, error) {
+	n.kind = rtKind(len(n.children))
+	b := make([]byte, oRTNodeVal+t.SzVal)
+	enc8(b[oRTNodeFlags:], uint64(t.flags(n)))
+	enc8(b[oRTNodeChildren:], uint64(len(n.children)))
+	enc8(b[oRTNodePrefixLen:], uint64(len(n.prefix)))
+	copy(b[oRTNodeVal:], n.val)
+	b = append(append(b, t.encChildren(n)...), n.prefix...)
+	off, err := t.Alloc(int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := t.WriteAt(b, off); err != nil {
+		t.Free(off)
+		return 0, err
+	}
+
+	return off, nil
+}
+
+// update writes the children of n in place, if they still fit its kind, and
+// returns the offset of n. Otherwise n is rewritten as a node of another kind.
+func (t *RadixTree) update(n *rtNode) (int64, error) {
+	if rtKind(len(n.children)) != n.kind {
+		if n.val == nil {
+			n.val = make([]byte, t.SzVal)
+			if _, err := t.ReadAt(n.val, n.off+oRTNodeVal); err != nil {
+				return 0, err
+			}
+		}
+
+		return t.rewrite(n)
+	}
+
+	if _, err := t.WriteAt(t.encChildren(n), n.off+oRTNodeVal+t.SzVal); err != nil {
+		return 0, err
+	}
+
+	return n.off, t.w8(n.off+oRTNodeChildren, int64(len(n.children)))
+}
+
+// rewrite replaces the node n by a newly allocated copy of n, frees the old
+// one and returns the offset of the new one.
+func (t *RadixTree) rewrite(n *rtNode) (int64, error) {
+	off, err := t.write(n)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, t.Free(n.off)
+}
+
+// merge replaces the node n, which has no value and a single child, and its
+// child by a single node and returns its offset.
+func (t *RadixTree) merge(n *rtNode) (int64, error) {
+	c, err := t.read(n.children[0], true)
+	if err != nil {
+		return 0, err
+	}
+
+	c.prefix = append(append(append([]byte(nil), n.prefix...), n.labels[0]), c.prefix...)
+	off, err := t.rewrite(c)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, t.Free(n.off)
+}
+
+func (t *RadixTree) setChild(n *rtNode, i int, off int64) error {
+	p := n.off + oRTNodeVal + t.SzVal
+	switch n.kind {
+	case rtNode4, rtNode16:
+		p += int64(rtNodeCap[n.kind]) + 8*int64(i)
+	case rtNode48:
+		p += 256 + 8*int64(i)
+	default:
+		p += 8 * int64(n.labels[i])
+	}
+	return t.w8(p, off)
+}
+
+func (t *RadixTree) setFlags(n *rtNode) error { return t.w8(n.off+oRTNodeFlags, t.flags(n)) }
+
+func (t *RadixTree) clr(off int64, free func(voff int64) error) error {
+	n, err := t.read(off, false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range n.children {
+		if err := t.clr(c, free); err != nil {
+			return err
+		}
+	}
+
+	if n.hasVal && free != nil {
+		if err := free(off + oRTNodeVal); err != nil {
+			return err
+		}
+	}
+
+	return t.Free(off)
+}
+
+func (t *RadixTree) del(off int64, k []byte, free func(voff int64) error) (int64, bool, error) {
+	n, err := t.read(off, true)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !bytes.HasPrefix(k, n.prefix) {
+		return off, false, nil
+	}
+
+	k = k[len(n.prefix):]
+	if len(k) == 0 {
+		if !n.hasVal {
+			return off, false, nil
+		}
+
+		if free != nil {
+			if err := free(off + oRTNodeVal); err != nil {
+				return 0, false, err
+			}
+		}
+
+		n.hasVal = false
+		switch len(n.children) {
+		case 0:
+			return 0, true, t.Free(off)
+		case 1:
+			off, err := t.merge(n)
+			return off, true, err
+		}
+
+		return off, true, t.setFlags(n)
+	}
+
+	i, ok := n.child(k[0])
+	if !ok {
+		return off, false, nil
+	}
+
+	c, ok, err := t.del(n.children[i], k[1:], free)
+	if err != nil || !ok {
+		return off, false, err
+	}
+
+	switch {
+	case c == n.children[i]:
+		return off, true, nil
+	case c != 0:
+		return off, true, t.setChild(n, i, c)
+	}
+
+	n.children = append(n.children[:i:i], n.children[i+1:]...)
+	n.labels = append(n.labels[:i:i], n.labels[i+1:]...)
+	if !n.hasVal && len(n.children) == 1 {
+		off, err := t.merge(n)
+		return off, true, err
+	}
+
+	off, err = t.update(n)
+	return off, true, err
+}
+
+// find returns the node holding key k or nil if there's no such node.
+func (t *RadixTree) find(k []byte) (*rtNode, error) {
+	off, err := t.root()
+	if err != nil {
+		return nil, err
+	}
+
+	for off != 0 {
+		n, err := t.read(off, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(k, n.prefix) {
+			return nil, nil
+		}
+
+		if k = k[len(n.prefix):]; len(k) == 0 {
+			return n, nil
+		}
+
+		i, ok := n.child(k[0])
+		if !ok {
+			return nil, nil
+		}
+
+		k = k[1:]
+		off = n.children[i]
+	}
+	return nil, nil
+}
+
+func (t *RadixTree) set(off int64, k, v []byte) (int64, bool, error) {
+	if off == 0 {
+		off, err := t.write(&rtNode{hasVal: true, val: v, prefix: k})
+		return off, true, err
+	}
+
+	n, err := t.read(off, false)
+	if err != nil {
+		return 0, false, err
+	}
+
+	c := 0
+	for c < len(n.prefix) && c < len(k) && n.prefix[c] == k[c] {
+		c++
+	}
+	if c < len(n.prefix) {
+		// Split n.
+		n.val = make([]byte, t.SzVal)
+		if _, err := t.ReadAt(n.val, off+oRTNodeVal); err != nil {
+			return 0, false, err
+		}
+
+		label := n.prefix[c]
+		p := &rtNode{prefix: k[:c:c], val: make([]byte, t.SzVal)}
+		n.prefix = n.prefix[c+1:]
+		old, err := t.rewrite(n)
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch {
+		case c == len(k):
+			p.hasVal = true
+			p.val = v
+			p.children = []int64{old}
+			p.labels = []byte{label}
+		default:
+			leaf, err := t.write(&rtNode{hasVal: true, val: v, prefix: k[c+1:]})
+			if err != nil {
+				return 0, false, err
+			}
+
+			p.children = []int64{old, leaf}
+			p.labels = []byte{label, k[c]}
+			if k[c] < label {
+				p.children[0], p.children[1] = leaf, old
+				p.labels[0], p.labels[1] = k[c], label
+			}
+		}
+		off, err := t.write(p)
+		return off, true, err
+	}
+
+	if k = k[c:]; len(k) == 0 {
+		if _, err := t.WriteAt(v, off+oRTNodeVal); err != nil {
+			return 0, false, err
+		}
+
+		if n.hasVal {
+			return off, false, nil
+		}
+
+		n.hasVal = true
+		return off, true, t.setFlags(n)
+	}
+
+	i, ok := n.child(k[0])
+	if ok {
+		ch, added, err := t.set(n.children[i], k[1:], v)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ch != n.children[i] {
+			if err := t.setChild(n, i, ch); err != nil {
+				return 0, false, err
+			}
+		}
+		return off, added, nil
+	}
+
+	leaf, err := t.write(&rtNode{hasVal: true, val: v, prefix: k[1:]})
+	if err != nil {
+		return 0, false, err
+	}
+
+	n.children = append(n.children[:i:i], append([]int64{leaf}, n.children[i:]...)...)
+	n.labels = append(n.labels[:i:i], append([]byte{k[0]}, n.labels[i:]...)...)
+	off, err = t.update(n)
+	return off, true, err
+}
+
+// Clear deletes all items of t.
+//
+// The free function may be nil, otherwise it's called with the offset of the
+// value of an item that is being deleted from the tree.
+func (t *RadixTree) Clear(free func(voff int64) error) error {
+	r, err := t.root()
+	if err != nil || r == 0 {
+		return err
+	}
+
+	if err := t.clr(r, free); err != nil {
+		return err
+	}
+
+	if err := t.setRoot(0); err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oRTLen, 0)
+}
+
+// Delete removes the item with key k from t and returns a boolean value
+// indicating if the item was found.
+//
+// For discussion of the free function see Clear.
+func (t *RadixTree) Delete(k []byte, free func(voff int64) error) (bool, error) {
+	r, err := t.root()
+	if err != nil || r == 0 {
+		return false, err
+	}
+
+	n, ok, err := t.del(r, k, free)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if n != r {
+		if err := t.setRoot(n); err != nil {
+			return false, err
+		}
+	}
+
+	return true, t.incLen(-1)
+}
+
+// Get searches for the item with key k and returns the offset of its value
+// and a boolean value indicating success.
+func (t *RadixTree) Get(k []byte) (int64, bool, error) {
+	n, err := t.find(k)
+	if err != nil || n == nil || !n.hasVal {
+		return 0, false, err
+	}
+
+	return n.off + oRTNodeVal, true, nil
+}
+
+// Len returns the number of items in t or an error, if any.
+func (t *RadixTree) Len() (int64, error) { return t.r8(t.Off + oRTLen) }
+
+// LongestPrefix searches for the longest key of t which is a prefix of k. It
+// returns the length of the found key, the offset of its value and a boolean
+// value indicating success.
+func (t *RadixTree) LongestPrefix(k []byte) (int, int64, bool, error) {
+	off, err := t.root()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var rn int
+	var rv int64
+	var ok bool
+	for depth := 0; off != 0; depth++ {
+		n, err := t.read(off, false)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if !bytes.HasPrefix(k[depth:], n.prefix) {
+			break
+		}
+
+		if depth += len(n.prefix); n.hasVal {
+			rn, rv, ok = depth, off+oRTNodeVal, true
+		}
+		if depth == len(k) {
+			break
+		}
+
+		i, found := n.child(k[depth])
+		if !found {
+			break
+		}
+
+		off = n.children[i]
+	}
+	return rn, rv, ok, nil
+}
+
+// Remove frees all space used by t.
+//
+// For discussion of the free function see Clear.
+func (t *RadixTree) Remove(free func(voff int64) error) error {
+	if err := t.Clear(free); err != nil {
+		return err
+	}
+
+	if err := t.Free(t.Off); err != nil {
+		return err
+	}
+
+	t.Off = 0
+	return nil
+}
+
+// SeekFirst returns a cursor positioned before the first item of t or an
+// error, if any.
+func (t *RadixTree) SeekFirst() (*RadixTreeCursor, error) { return t.SeekPrefix(nil) }
+
+// SeekPrefix returns a cursor positioned before the first item of t with a key
+// having prefix p or an error, if any. The cursor enumerates, in key order,
+// only the items having that prefix. The cursor is invalidated by any Set or
+// Delete.
+func (t *RadixTree) SeekPrefix(p []byte) (*RadixTreeCursor, error) {
+	off, err := t.root()
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	for off != 0 {
+		n, err := t.read(off, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) <= len(n.prefix) {
+			if !bytes.HasPrefix(n.prefix, p) {
+				break
+			}
+
+			return &RadixTreeCursor{stack: []rtFrame{{n: n, i: -1, key: key}}, t: t}, nil
+		}
+
+		if !bytes.HasPrefix(p, n.prefix) {
+			break
+		}
+
+		p = p[len(n.prefix):]
+		i, ok := n.child(p[0])
+		if !ok {
+			break
+		}
+
+		key = append(append(key, n.prefix...), p[0])
+		p = p[1:]
+		off = n.children[i]
+	}
+	return &RadixTreeCursor{t: t}, nil
+}
+
+// Set adds or overwrites the item with key k and sets its value to v. The
+// length of v must be equal to SzVal.
+func (t *RadixTree) Set(k, v []byte) error {
+	if int64(len(v)) != t.SzVal {
+		panic(fmt.Errorf("%T.Set: invalid argument", t))
+	}
+
+	r, err := t.root()
+	if err != nil {
+		return err
+	}
+
+	n, added, err := t.set(r, k, v)
+	if err != nil {
+		return err
+	}
+
+	if n != r {
+		if err := t.setRoot(n); err != nil {
+			return err
+		}
+	}
+
+	if added {
+		return t.incLen(1)
+	}
+
+	return nil
+}
+
+type rtFrame struct {
+	n   *rtNode
+	i   int    // Next child to visit, -1 before visiting the node value.
+	key []byte // Key of the node up to its prefix.
+}
+
+// RadixTreeCursor provides enumerating RadixTree items in key order.
+type RadixTreeCursor struct {
+	K     []byte // Item key. Not valid before calling Next.
+	V     int64  // Item value offset. Not valid before calling Next.
+	err   error
+	stack []rtFrame
+	t     *RadixTree
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *RadixTreeCursor) Err() error { return c.err }
+
+// Next moves the cursor to the next item and sets the K and V fields
+// accordingly. It returns true on success, or false if there is no next item
+// or an error happened while moving the cursor. Err should be consulted to
+// distinguish between the two cases.
+func (c *RadixTreeCursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	for len(c.stack) != 0 {
+		f := &c.stack[len(c.stack)-1]
+		n := f.n
+		if f.i < 0 {
+			f.i = 0
+			if n.hasVal {
+				c.K = append(append([]byte(nil), f.key...), n.prefix...)
+				c.V = n.off + oRTNodeVal
+				return true
+			}
+		}
+
+		if f.i == len(n.children) {
+			c.stack = c.stack[:len(c.stack)-1]
+			continue
+		}
+
+		i := f.i
+		f.i++
+		ch, err := c.t.read(n.children[i], false)
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		key := append(append(append([]byte(nil), f.key...), n.prefix...), n.labels[i])
+		c.stack = append(c.stack, rtFrame{n: ch, i: -1, key: key})
+	}
+	return false
+}
@@ -0,0 +1,381 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func (t *RadixTree) verify(tb testing.TB, m map[string]int) {
+	r, err := t.root()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var n int64
+	var f func(off int64, root bool)
+	f = func(off int64, root bool) {
+		x, err := t.read(off, false)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if x.hasVal {
+			n++
+		}
+
+		if !root && !x.hasVal && len(x.children) < 2 {
+			tb.Fatalf("node %#x: not compressed", off)
+		}
+
+		if g, e := x.kind, rtKind(len(x.children)); g != e {
+			tb.Fatalf("node %#x: got kind %v, expected %v", off, g, e)
+		}
+
+		for i, c := range x.children {
+			if i != 0 && x.labels[i-1] >= x.labels[i] {
+				tb.Fatalf("node %#x: labels out of order", off)
+			}
+
+			f(c, false)
+		}
+	}
+	if r != 0 {
+		f(r, true)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got %v items, expected %v", g, e)
+	}
+
+	if g, e := t.tlen(tb), int64(len(m)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c, err := t.SeekFirst()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	i := 0
+	for ; c.Next(); i++ {
+		if i >= len(keys) {
+			tb.Fatalf("unexpected key %q", c.K)
+		}
+
+		if g, e := string(c.K), keys[i]; g != e {
+			tb.Fatalf("item #%v: got key %q, expected %q", i, g, e)
+		}
+
+		v, err := t.r4(c.V)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if g, e := v, m[keys[i]]; g != e {
+			tb.Fatalf("key %q: got %v, expected %v", keys[i], g, e)
+		}
+	}
+	if err := c.Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := i, len(keys); g != e {
+		tb.Fatalf("got %v items, expected %v", g, e)
+	}
+}
+
+func (t *RadixTree) tlen(tb testing.TB) int64 {
+	c, err := t.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return c
+}
+
+func radixKey(x interface{ Next() int }) string {
+	var a []string
+	for n := int(uint32(x.Next()) % 4); n != 0; n-- {
+		a = append(a, [...]string{"a", "ab", "abc", "b", "usr", "user", "x"}[uint32(x.Next())%7])
+	}
+	return strings.Join(a, "/")
+}
+
+func testRadixTree(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	rt, err := db.NewRadixTree(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := rt.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[string]int{}
+	x := rng()
+	for i := 0; i < 2000; i++ {
+		k := radixKey(x)
+		switch {
+		case x.Next()%3 == 0:
+			ok, err := rt.Delete([]byte(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, e := m[k]
+			if ok != e {
+				t.Fatal(i, k, ok, e)
+			}
+
+			delete(m, k)
+		default:
+			if err := rt.Set([]byte(k), batchKey(i)); err != nil {
+				t.Fatal(err)
+			}
+
+			m[k] = i
+		}
+		if i%100 == 0 {
+			rt.verify(t, m)
+		}
+	}
+	if rt, err = db.OpenRadixTree(rt.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	rt.verify(t, m)
+	for i := 0; i < 200; i++ {
+		k := radixKey(x)
+		if i%2 == 0 {
+			k += "/u"
+		}
+
+		voff, ok, err := rt.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, e := m[k]
+		if ok != e {
+			t.Fatal(k, ok, e)
+		}
+
+		if ok {
+			w, err := rt.r4(voff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w != v {
+				t.Fatal(k, w, v)
+			}
+		}
+
+		en, ev, eok := -1, 0, false
+		for p, v := range m {
+			if strings.HasPrefix(k, p) && len(p) > en {
+				en, ev, eok = len(p), v, true
+			}
+		}
+		n, voff, ok, err := rt.LongestPrefix([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != eok || ok && n != en {
+			t.Fatalf("%q: got %v %v, expected %v %v", k, n, ok, en, eok)
+		}
+
+		if ok {
+			w, err := rt.r4(voff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w != ev {
+				t.Fatal(k, w, ev)
+			}
+		}
+
+		p := k[:len(k)/2]
+		var e2 []string
+		for k := range m {
+			if strings.HasPrefix(k, p) {
+				e2 = append(e2, k)
+			}
+		}
+		sort.Strings(e2)
+		c, err := rt.SeekPrefix([]byte(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var g []string
+		for c.Next() {
+			if !bytes.HasPrefix(c.K, []byte(p)) {
+				t.Fatalf("%q: unexpected key %q", p, c.K)
+			}
+
+			g = append(g, string(c.K))
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(g, "|") != strings.Join(e2, "|") {
+			t.Fatalf("%q: got %q, expected %q", p, g, e2)
+		}
+	}
+
+	for k := range m {
+		if ok, err := rt.Delete([]byte(k), nil); !ok || err != nil {
+			t.Fatal(k, ok, err)
+		}
+
+		delete(m, k)
+		if len(m)%50 == 0 {
+			rt.verify(t, m)
+		}
+	}
+	rt.verify(t, m)
+}
+
+func TestRadixTree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRadixTree(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testRadixTreeFree(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	rt, err := db.NewRadixTree(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := func(voff int64) error {
+		p, err := rt.r8(voff)
+		if err != nil {
+			return err
+		}
+
+		return rt.Free(p)
+	}
+
+	defer func() {
+		if err := rt.Remove(free); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	x := rng()
+	m := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		k := radixKey(x)
+		if m[k] {
+			if ok, err := rt.Delete([]byte(k), free); !ok || err != nil {
+				t.Fatal(k, ok, err)
+			}
+
+			delete(m, k)
+			continue
+		}
+
+		p, err := rt.Alloc(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := rt.Set([]byte(k), batchVal(int(p))); err != nil {
+			t.Fatal(err)
+		}
+
+		m[k] = true
+	}
+}
+
+func TestRadixTreeFree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRadixTreeFree(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testRadixTreeKinds(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	rt, err := db.NewRadixTree(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := rt.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	x := rng()
+	perm := func() []int {
+		a := make([]int, 256)
+		for i := range a {
+			j := int(uint32(x.Next()) % uint32(i+1))
+			a[i], a[j] = a[j], i
+		}
+		return a
+	}
+	m := map[string]int{}
+	for _, v := range perm() {
+		k := string([]byte{'p', byte(v)})
+		if err := rt.Set([]byte(k), batchKey(v)); err != nil {
+			t.Fatal(err)
+		}
+
+		m[k] = v
+		rt.verify(t, m)
+	}
+	for _, v := range perm() {
+		k := string([]byte{'p', byte(v)})
+		if ok, err := rt.Delete([]byte(k), nil); !ok || err != nil {
+			t.Fatal(k, ok, err)
+		}
+
+		delete(m, k)
+		rt.verify(t, m)
+	}
+}
+
+func TestRadixTreeKinds(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRadixTreeKinds(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Record maps a Go struct type to a fixed size encoding suitable for BTree
+// keys and values, list node data or Table records. The struct fields are
+// encoded in declaration order. The mapping of a field is controlled by a
+// struct tag
+//
+//	`db:"name,size=32"`
+//
+// where name overrides the field name and size sets the encoded size of a
+// string or []byte field, which is required. A field tagged `db:"-"` and
+// unexported fields are skipped.
+//
+// Supported field types are bool, integers, floats, strings, byte slices,
+// byte arrays and structs consisting of supported fields. The fields of a
+// nested struct are named by the path of the field, eg. "Pos.X". Numbers are
+// encoded such that the encodings collate as the numbers, int and uint are
+// encoded as int64 and uint64. Strings and byte slices are padded by zeros,
+// so trailing zero bytes are not preserved.
+type Record struct {
+	Size   int64 // Size of the encoding.
+	fields []recordField
+	typ    reflect.Type
+}
+
+type recordField struct {
+	index []int
+	kind  reflect.Kind
+	name  string
+	off   int64
+	size  int64
+	typ   string
+}
+
+// NewRecord returns the mapping of the struct type of v, which must be a
+// struct or a pointer to a struct, or an error, if any.
+func NewRecord(v interface{}) (*Record, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("NewRecord: %T is not a struct", v)
+	}
+
+	r := &Record{typ: t}
+	if err := r.add(t, nil, ""); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Record) add(t reflect.Type, index []int, prefix string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+
+		a := strings.Split(tag, ",")
+		name := a[0]
+		if name == "" {
+			name = f.Name
+		}
+		name = prefix + name
+		var size int64
+		for _, v := range a[1:] {
+			if !strings.HasPrefix(v, "size=") {
+				return fmt.Errorf("NewRecord: field %s: invalid tag %q", name, tag)
+			}
+
+			n, err := strconv.ParseInt(v[len("size="):], 10, 63)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("NewRecord: field %s: invalid tag %q", name, tag)
+			}
+
+			size = n
+		}
+
+		x := append(index[:len(index):len(index)], i)
+		k := f.Type.Kind()
+		var typ string
+		switch k {
+		case reflect.Bool:
+			typ = "bool"
+			size = recordSize(size, 1)
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			typ = "int"
+			size = recordSize(size, int64(f.Type.Size()))
+		case reflect.Int:
+			typ = "int"
+			size = recordSize(size, 8)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			typ = "uint"
+			size = recordSize(size, int64(f.Type.Size()))
+		case reflect.Uint:
+			typ = "uint"
+			size = recordSize(size, 8)
+		case reflect.Float32, reflect.Float64:
+			typ = "float"
+			size = recordSize(size, int64(f.Type.Size()))
+		case reflect.String:
+			typ = "string"
+		case reflect.Slice:
+			if f.Type.Elem().Kind() != reflect.Uint8 {
+				return fmt.Errorf("NewRecord: field %s: unsupported type %v", name, f.Type)
+			}
+
+			typ = "bytes"
+		case reflect.Array:
+			if f.Type.Elem().Kind() != reflect.Uint8 {
+				return fmt.Errorf("NewRecord: field %s: unsupported type %v", name, f.Type)
+			}
+
+			typ = "bytes"
+			size = recordSize(size, int64(f.Type.Len()))
+		case reflect.Struct:
+			if size != 0 {
+				return fmt.Errorf("NewRecord: field %s: invalid tag %q", name, tag)
+			}
+
+			if err := r.add(f.Type, x, name+"."); err != nil {
+				return err
+			}
+
+			continue
+		default:
+			return fmt.Errorf("NewRecord: field %s: unsupported type %v", name, f.Type)
+		}
+
+		if size <= 0 {
+			return fmt.Errorf("NewRecord: field %s: invalid or missing size", name)
+		}
+
+		for _, v := range r.fields {
+			if v.name == name {
+				return fmt.Errorf("NewRecord: duplicate field %s", name)
+			}
+		}
+
+		r.fields = append(r.fields, recordField{index: x, kind: k, name: name, off: r.Size, size: size, typ: typ})
+		r.Size += size
+	}
+	return nil
+}
+
+// recordSize returns the size of a fixed size field. A size set by a tag must
+// match.
+func recordSize(tag, size int64) int64 {
+	if tag != 0 && tag != size {
+		return -1
+	}
+
+	return size
+}
+
+func (r *Record) value(v interface{}, method string) reflect.Value {
+	x := reflect.ValueOf(v)
+	if x.Kind() == reflect.Ptr && !x.IsNil() {
+		x = x.Elem()
+	}
+	if !x.IsValid() || x.Type() != r.typ {
+		panic(fmt.Errorf("%T.%s: invalid argument", r, method))
+	}
+
+	return x
+}
+
+// Decode sets the fields of the struct pointed to by v from the encoding in
+// b. The length of b must be equal to Size.
+func (r *Record) Decode(b []byte, v interface{}) {
+	x := reflect.ValueOf(v)
+	if x.Kind() != reflect.Ptr || x.IsNil() || int64(len(b)) != r.Size {
+		panic(fmt.Errorf("%T.Decode: invalid argument", r))
+	}
+
+	x = r.value(v, "Decode")
+	for _, f := range r.fields {
+		r.decode(b[f.off:f.off+f.size], x.FieldByIndex(f.index), &f)
+	}
+}
+
+func (r *Record) decode(b []byte, x reflect.Value, f *recordField) {
+	switch f.typ {
+	case "bool":
+		x.SetBool(b[0] != 0)
+	case "int":
+		n := decN(b)
+		x.SetInt(int64(n^1<<uint(8*f.size-1)) << uint(64-8*f.size) >> uint(64-8*f.size))
+	case "uint":
+		x.SetUint(decN(b))
+	case "float":
+		switch n := decN(b); f.size {
+		case 4:
+			if n&(1<<31) != 0 {
+				n &^= 1 << 31
+			} else {
+				n = ^n & (1<<32 - 1)
+			}
+			x.SetFloat(float64(math.Float32frombits(uint32(n))))
+		default:
+			x.SetFloat(decScore(n))
+		}
+	case "string":
+		x.SetString(string(bytes.TrimRight(b, "\x00")))
+	case "bytes":
+		switch f.kind {
+		case reflect.Array:
+			reflect.Copy(x, reflect.ValueOf(b))
+		default:
+			x.SetBytes(append([]byte(nil), bytes.TrimRight(b, "\x00")...))
+		}
+	}
+}
+
+// Encode returns the encoding of v, which must be a struct or a pointer to a
+// struct of the type used by NewRecord, or an error, if any.
+func (r *Record) Encode(v interface{}) ([]byte, error) {
+	x := r.value(v, "Encode")
+	b := make([]byte, r.Size)
+	for _, f := range r.fields {
+		if err := r.encode(b[f.off:f.off+f.size], x.FieldByIndex(f.index), &f); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (r *Record) encode(b []byte, x reflect.Value, f *recordField) error {
+	switch f.typ {
+	case "bool":
+		if x.Bool() {
+			b[0] = 1
+		}
+	case "int":
+		encN(b, uint64(x.Int())^1<<uint(8*f.size-1))
+	case "uint":
+		encN(b, x.Uint())
+	case "float":
+		switch f.size {
+		case 4:
+			n := math.Float32bits(float32(x.Float()))
+			if n&(1<<31) != 0 {
+				n = ^n
+			} else {
+				n |= 1 << 31
+			}
+			encN(b, uint64(n))
+		default:
+			encN(b, encScore(x.Float()))
+		}
+	case "string", "bytes":
+		var s []byte
+		switch {
+		case f.kind == reflect.String:
+			s = []byte(x.String())
+		case f.kind == reflect.Array:
+			s = make([]byte, x.Len())
+			reflect.Copy(reflect.ValueOf(s), x)
+		default:
+			s = x.Bytes()
+		}
+		if int64(len(s)) > f.size {
+			return fmt.Errorf("%T.Encode: field %s: value too long", r, f.name)
+		}
+
+		copy(b, s)
+	}
+	return nil
+}
+
+// Field returns the offset and size of the encoding of the named field. The
+// returned boolean value is false if there is no such field.
+func (r *Record) Field(name string) (int64, int64, bool) {
+	for _, v := range r.fields {
+		if v.name == name {
+			return v.off, v.size, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Read decodes the Size bytes of s at off into the struct pointed to by v.
+func (r *Record) Read(s Storage, off int64, v interface{}) error {
+	b := make([]byte, r.Size)
+	if n, err := s.ReadAt(b, off); n != len(b) {
+		if err == nil {
+			err = fmt.Errorf("%T.Read: short storage read", r)
+		}
+		return err
+	}
+
+	r.Decode(b, v)
+	return nil
+}
+
+// Schema returns a description of the encoding, which is stored by
+// StoreRecord and compared by OpenRecord. Records with equal schemas have
+// compatible encodings.
+func (r *Record) Schema() string {
+	var a []string
+	for _, v := range r.fields {
+		a = append(a, fmt.Sprintf("%s %s %d", v.name, v.typ, v.size))
+	}
+	return strings.Join(a, "\n")
+}
+
+// Write encodes v and writes it to s at off.
+func (r *Record) Write(s Storage, off int64, v interface{}) error {
+	b, err := r.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.WriteAt(b, off)
+	return err
+}
+
+func decN(b []byte) uint64 {
+	var n uint64
+	for _, v := range b {
+		n = n<<8 | uint64(v)
+	}
+	return n
+}
+
+func encN(b []byte, n uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+}
+
+// StoreRecord stores the schema of r in db and returns its offset or an error,
+// if any. The storage block can be freed using Free.
+func (db *DB) StoreRecord(r *Record) (int64, error) {
+	b := []byte(r.Schema())
+	off, err := db.Alloc(oPayloadData + int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	return off, initPayload(db, off, b)
+}
+
+// OpenRecord returns the mapping of the struct type of v, like NewRecord, and
+// verifies its schema matches the one stored by StoreRecord at off. Mismatching
+// schemas are reported as an error.
+func (db *DB) OpenRecord(off int64, v interface{}) (*Record, error) {
+	r, err := NewRecord(v)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok, err := readPayload(db, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%T.OpenRecord: corrupted database", db)
+	}
+
+	if g, e := r.Schema(), string(b); g != e {
+		return nil, fmt.Errorf("%T.OpenRecord: schema mismatch: got\n%s\nexpected\n%s", db, g, e)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+type recordTestPos struct {
+	X, Y float32
+}
+
+type recordTest struct {
+	ID      int64  `db:"id"`
+	Name    string `db:"name,size=16"`
+	Flag    bool
+	Small   int8
+	Count   uint16
+	N       int
+	Score   float64
+	Pos     recordTestPos
+	Digest  [4]byte
+	Data    []byte `db:",size=8"`
+	Skipped string `db:"-"`
+	private int
+}
+
+func TestRecordEncoding(t *testing.T) {
+	r, err := NewRecord(recordTest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := r.Size, int64(8+16+1+1+2+8+8+4+4+4+8); g != e {
+		t.Fatal(g, e)
+	}
+
+	if off, size, ok := r.Field("Pos.Y"); !ok || off != 8+16+1+1+2+8+8+4 || size != 4 {
+		t.Fatal(off, size, ok)
+	}
+
+	if _, _, ok := r.Field("Skipped"); ok {
+		t.Fatal(ok)
+	}
+
+	v := recordTest{
+		ID:     -42,
+		Name:   "foo",
+		Flag:   true,
+		Small:  -3,
+		Count:  1234,
+		N:      math.MaxInt64,
+		Score:  -1.5,
+		Pos:    recordTestPos{1.25, -7},
+		Digest: [4]byte{1, 2, 3, 4},
+		Data:   []byte("bar"),
+	}
+	b, err := r.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w recordTest
+	r.Decode(b, &w)
+	if !reflect.DeepEqual(v, w) {
+		t.Fatalf("got %+v, expected %+v", w, v)
+	}
+
+	// The encodings of numbers collate as the numbers.
+	var prev []byte
+	for i, v := range []recordTest{
+		{ID: math.MinInt64},
+		{ID: -1, Score: math.Inf(1)},
+		{ID: 0, Score: math.Inf(-1)},
+		{ID: 0, Score: -1},
+		{ID: 0, Score: 0, Pos: recordTestPos{-1, 0}},
+		{ID: 0, Score: 0, Pos: recordTestPos{0, 0}},
+		{ID: 0, Score: 0.5},
+		{ID: 1},
+		{ID: math.MaxInt64},
+	} {
+		b, err := r.Encode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prev != nil && bytes.Compare(prev, b) >= 0 {
+			t.Fatal(i)
+		}
+
+		prev = b
+	}
+
+	if _, err := r.Encode(recordTest{Name: "01234567890123456"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, v := range []interface{}{
+		42,
+		struct{ S string }{},
+		struct{ F []int }{},
+		struct {
+			N int32 `db:",size=8"`
+		}{},
+		struct {
+			N int32 `db:",foo"`
+		}{},
+		struct {
+			A int32 `db:"x"`
+			B int32 `db:"x"`
+		}{},
+	} {
+		if _, err := NewRecord(v); err == nil {
+			t.Fatalf("%T: expected error", v)
+		}
+	}
+}
+
+func testRecord(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	r, err := NewRecord(&recordTest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := db.StoreRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := db.Free(off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if r, err = db.OpenRecord(off, recordTest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.OpenRecord(off, recordTestPos{}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	bt, err := db.NewBTree(0, 0, 4, r.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := bt.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1 << 10
+	for i := 0; i < N; i++ {
+		koff, voff, err := bt.Set(bt.bcmp(i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt.w4(koff, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Write(bt, voff, &recordTest{ID: int64(i), Name: "x", Score: float64(i) / 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		voff, ok, err := bt.Get(bt.bcmp(i))
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+
+		var v recordTest
+		if err := r.Read(bt, voff, &v); err != nil {
+			t.Fatal(err)
+		}
+
+		if v.ID != int64(i) || v.Name != "x" || v.Score != float64(i)/2 {
+			t.Fatalf("%v: %+v", i, v)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRecord(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,843 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"math"
+
+	"github.com/cznic/internal/buffer"
+	"github.com/cznic/mathutil"
+)
+
+const (
+	rtreeM = 32
+)
+
+const (
+	oRTreeRoot   = 8 * iota // int64
+	oRTreeLen               // int64
+	oRTreeHeight            // int64
+	oRTreeM                 // int64
+	oRTreeSzVal             // int64
+
+	szRTree
+)
+
+const (
+	oRTreePageTag   = 4 * iota // int32
+	oRTreePageLen              // int32
+	oRTreePageItems            // [M]struct{Rect, [max(8, szVal)]byte}
+)
+
+const (
+	rtreeTagIndexPage = iota
+	rtreeTagLeafPage
+)
+
+// Rect is an axis aligned rectangle. Min must not be greater than Max in
+// any dimension.
+type Rect struct {
+	Min, Max [2]float64
+}
+
+func (r Rect) area() float64 { return (r.Max[0] - r.Min[0]) * (r.Max[1] - r.Min[1]) }
+
+func (r Rect) contains(s Rect) bool {
+	return r.Min[0] <= s.Min[0] && r.Min[1] <= s.Min[1] && r.Max[0] >= s.Max[0] && r.Max[1] >= s.Max[1]
+}
+
+// dist2 returns the squared distance of the point p from r.
+func (r Rect) dist2(p [2]float64) float64 {
+	var d float64
+	for i, v := range p {
+		var x float64
+		switch {
+		case v < r.Min[i]:
+			x = r.Min[i] - v
+		case v > r.Max[i]:
+			x = v - r.Max[i]
+		}
+		d += x * x
+	}
+	return d
+}
+
+func (r Rect) intersects(s Rect) bool {
+	return r.Min[0] <= s.Max[0] && r.Min[1] <= s.Max[1] && r.Max[0] >= s.Min[0] && r.Max[1] >= s.Min[1]
+}
+
+func (r Rect) union(s Rect) Rect {
+	for i := range r.Min {
+		r.Min[i] = math.Min(r.Min[i], s.Min[i])
+		r.Max[i] = math.Max(r.Max[i], s.Max[i])
+	}
+	return r
+}
+
+// RTree is a persistent R-tree indexing fixed size values by rectangles.
+// Overflowing pages are split using Guttman's quadratic split and deleting an
+// item reinserts the entries of underflowing pages.
+//
+// Splitting or condensing pages moves items, the value offsets returned by
+// cursors are valid only until the next Insert or Delete.
+type RTree struct {
+	*DB
+	Off   int64 // Location in the database.
+	SzVal int64 // The szVal argument of NewRTree.
+	m     int   // Maximum number of entries in a page.
+}
+
+type rtreeEntry struct {
+	r     Rect
+	child int64  // Page offset in index pages.
+	val   []byte // Value in leaf pages.
+}
+
+type rtreePage struct {
+	off  int64
+	leaf bool
+	e    []rtreeEntry
+}
+
+func (p *rtreePage) bbox() Rect {
+	r := p.e[0].r
+	for _, v := range p.e[1:] {
+		r = r.union(v.r)
+	}
+	return r
+}
+
+// NewRTree allocates and returns a new, empty RTree or an error, if any. The m
+// argument is the desired maximum number of entries in a page, passing zero
+// will use the default value. The szVal argument is the size of the RTree
+// values.
+func (db *DB) NewRTree(m int, szVal int64) (*RTree, error) {
+	if m < 0 || m > math.MaxInt32 || szVal < 0 {
+		panic(fmt.Errorf("%T.NewRTree: invalid argument", db))
+	}
+
+	if m == 0 {
+		m = rtreeM
+	}
+	m = mathutil.Max(m, 4)
+	off, err := db.Calloc(szRTree)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oRTreeM, int64(m)); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oRTreeSzVal, szVal); err != nil {
+		return nil, err
+	}
+
+	return &RTree{DB: db, Off: off, SzVal: szVal, m: m}, nil
+}
+
+// OpenRTree opens and returns an existing RTree or an error, if any.
+func (db *DB) OpenRTree(off int64) (*RTree, error) {
+	m, err := db.r8(off + oRTreeM)
+	if err != nil {
+		return nil, err
+	}
+
+	szVal, err := db.r8(off + oRTreeSzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if m < 4 || m > math.MaxInt32 || szVal < 0 {
+		return nil, fmt.Errorf("%T.OpenRTree: corrupted database", db)
+	}
+
+	return &RTree{DB: db, Off: off, SzVal: szVal, m: int(m)}, nil
+}
+
+func (t *RTree) min() int                { return mathutil.Max(t.m*2/5, 2) }
+func (t *RTree) root() (int64, error)    { return t.r8(t.Off + oRTreeRoot) }
+func (t *RTree) setHeight(n int) error   { return t.w8(t.Off+oRTreeHeight, int64(n)) }
+func (t *RTree) setRoot(off int64) error { return t.w8(t.Off+oRTreeRoot, off) }
+func (t *RTree) szItem() int64           { return 32 + mathutil.MaxInt64(8, t.SzVal) }
+func (t *RTree) szPage() int64           { return oRTreePageItems + int64(t.m)*t.szItem() }
+func (t *RTree) val(page int64, i int) int64 {
+	return page + oRTreePageItems + int64(i)*t.szItem() + 32
+}
+
+func (t *RTree) height() (int, error) {
+	n, err := t.r8(t.Off + oRTreeHeight)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	return int(n), nil
+}
+
+func (t *RTree) incLen(delta int64) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oRTreeLen, n+delta)
+}
+
+func (t *RTree) read(off int64) (*rtreePage, error) {
+	p := buffer.Get(oRTreePageItems)
+	defer buffer.Put(p)
+
+	if n, err := t.ReadAt(*p, off); n != len(*p) {
+		if err == nil {
+			panic("internal error")
+		}
+
+		return nil, err
+	}
+
+	b := *p
+	tag := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	n := int(b[4])<<24 | int(b[5])<<16 | int(b[6])<<8 | int(b[7])
+	if n < 0 || n > t.m {
+		return nil, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	r := &rtreePage{off: off, leaf: tag == rtreeTagLeafPage, e: make([]rtreeEntry, n)}
+	sz := t.szItem()
+	q := buffer.Get(n * int(sz))
+	defer buffer.Put(q)
+
+	if n != 0 {
+		if n, err := t.ReadAt(*q, off+oRTreePageItems); n != len(*q) {
+			if err == nil {
+				panic("internal error")
+			}
+
+			return nil, err
+		}
+	}
+
+	for i := range r.e {
+		e := &r.e[i]
+		b := (*q)[int64(i)*sz:]
+		for j := 0; j < 4; j++ {
+			v := math.Float64frombits(dec8(b[8*j:]))
+			switch j {
+			case 0, 1:
+				e.r.Min[j] = v
+			default:
+				e.r.Max[j-2] = v
+			}
+		}
+		b = b[32:]
+		switch {
+		case r.leaf:
+			e.val = append([]byte(nil), b[:t.SzVal]...)
+		default:
+			e.child = int64(dec8(b))
+		}
+	}
+	return r, nil
+}
+
+func (t *RTree) write(p *rtreePage) error {
+	sz := t.szItem()
+	q := buffer.Get(int(oRTreePageItems + int64(len(p.e))*sz))
+	defer buffer.Put(q)
+
+	b := *q
+	for i := range b {
+		b[i] = 0
+	}
+	tag := rtreeTagIndexPage
+	if p.leaf {
+		tag = rtreeTagLeafPage
+	}
+	b[3] = byte(tag)
+	n := len(p.e)
+	b[4], b[5], b[6], b[7] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+	b = b[oRTreePageItems:]
+	for i, e := range p.e {
+		b := b[int64(i)*sz:]
+		for j, v := range []float64{e.r.Min[0], e.r.Min[1], e.r.Max[0], e.r.Max[1]} {
+			enc8(b[8*j:], math.Float64bits(v))
+		}
+		b = b[32:]
+		switch {
+		case p.leaf:
+			copy(b, e.val)
+		default:
+			enc8(b, uint64(e.child))
+		}
+	}
+	_, err := t.WriteAt(*q, p.off)
+	return err
+}
+
+func (t *RTree) newPage(leaf bool) (*rtreePage, error) {
+	off, err := t.Alloc(t.szPage())
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtreePage{off: off, leaf: leaf}, nil
+}
+
+// insert adds e to a page at level, counting from zero at the leaves.
+func (t *RTree) insert(e rtreeEntry, level int) error {
+	r, err := t.root()
+	if err != nil {
+		return err
+	}
+
+	h, err := t.height()
+	if err != nil {
+		return err
+	}
+
+	if r == 0 {
+		p, err := t.newPage(true)
+		if err != nil {
+			return err
+		}
+
+		p.e = []rtreeEntry{e}
+		if err := t.write(p); err != nil {
+			return err
+		}
+
+		if err := t.setRoot(p.off); err != nil {
+			return err
+		}
+
+		return t.setHeight(1)
+	}
+
+	type step struct {
+		p *rtreePage
+		i int
+	}
+	var path []step
+	p, err := t.read(r)
+	if err != nil {
+		return err
+	}
+
+	for l := h - 1; l > level; l-- {
+		best := 0
+		var bestGrow, bestArea float64
+		for i, v := range p.e {
+			a := v.r.area()
+			g := v.r.union(e.r).area() - a
+			if i == 0 || g < bestGrow || g == bestGrow && a < bestArea {
+				best, bestGrow, bestArea = i, g, a
+			}
+		}
+		path = append(path, step{p, best})
+		if p, err = t.read(p.e[best].child); err != nil {
+			return err
+		}
+	}
+
+	p.e = append(p.e, e)
+	var split *rtreePage
+	if len(p.e) > t.m {
+		if split, err = t.split(p); err != nil {
+			return err
+		}
+	}
+
+	if err := t.write(p); err != nil {
+		return err
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		s := path[i]
+		s.p.e[s.i].r = p.bbox()
+		if split != nil {
+			s.p.e = append(s.p.e, rtreeEntry{r: split.bbox(), child: split.off})
+			split = nil
+			if len(s.p.e) > t.m {
+				if split, err = t.split(s.p); err != nil {
+					return err
+				}
+			}
+		}
+		if err := t.write(s.p); err != nil {
+			return err
+		}
+
+		p = s.p
+	}
+
+	if split == nil {
+		return nil
+	}
+
+	nr, err := t.newPage(false)
+	if err != nil {
+		return err
+	}
+
+	nr.e = []rtreeEntry{{r: p.bbox(), child: p.off}, {r: split.bbox(), child: split.off}}
+	if err := t.write(nr); err != nil {
+		return err
+	}
+
+	if err := t.setRoot(nr.off); err != nil {
+		return err
+	}
+
+	return t.setHeight(h + 1)
+}
+
+// split moves some entries of the overflowing page p to a new page, which is
+// written and returned. The caller must write p.
+func (t *RTree) split(p *rtreePage) (*rtreePage, error) {
+	q, err := t.newPage(p.leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	e := p.e
+	var s0, s1 int
+	worst := math.Inf(-1)
+	for i := range e {
+		for j := i + 1; j < len(e); j++ {
+			if d := e[i].r.union(e[j].r).area() - e[i].r.area() - e[j].r.area(); d > worst {
+				worst, s0, s1 = d, i, j
+			}
+		}
+	}
+
+	a := []rtreeEntry{e[s0]}
+	b := []rtreeEntry{e[s1]}
+	ra, rb := e[s0].r, e[s1].r
+	rest := make([]rtreeEntry, 0, len(e)-2)
+	for i, v := range e {
+		if i != s0 && i != s1 {
+			rest = append(rest, v)
+		}
+	}
+	min := t.min()
+	for len(rest) != 0 {
+		switch {
+		case len(a)+len(rest) == min:
+			a = append(a, rest...)
+			rest = nil
+			continue
+		case len(b)+len(rest) == min:
+			b = append(b, rest...)
+			rest = nil
+			continue
+		}
+
+		next := 0
+		var nd, na, nb float64
+		for i, v := range rest {
+			da := ra.union(v.r).area() - ra.area()
+			db := rb.union(v.r).area() - rb.area()
+			if d := math.Abs(da - db); i == 0 || d > nd {
+				next, nd, na, nb = i, d, da, db
+			}
+		}
+		v := rest[next]
+		rest = append(rest[:next], rest[next+1:]...)
+		toA := na < nb || na == nb && (ra.area() < rb.area() || ra.area() == rb.area() && len(a) <= len(b))
+		switch {
+		case toA:
+			a = append(a, v)
+			ra = ra.union(v.r)
+		default:
+			b = append(b, v)
+			rb = rb.union(v.r)
+		}
+	}
+	p.e = a
+	q.e = b
+	return q, t.write(q)
+}
+
+func (t *RTree) clr(off int64, free func(voff int64) error) error {
+	p, err := t.read(off)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range p.e {
+		switch {
+		case p.leaf:
+			if free != nil {
+				if err := free(t.val(off, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := t.clr(v.child, free); err != nil {
+				return err
+			}
+		}
+	}
+	return t.Free(off)
+}
+
+// Clear deletes all items of t.
+//
+// The free function may be nil, otherwise it's called with the offset of the
+// value of an item that is being deleted from the tree.
+func (t *RTree) Clear(free func(voff int64) error) error {
+	r, err := t.root()
+	if err != nil || r == 0 {
+		return err
+	}
+
+	if err := t.clr(r, free); err != nil {
+		return err
+	}
+
+	if err := t.setRoot(0); err != nil {
+		return err
+	}
+
+	if err := t.setHeight(0); err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oRTreeLen, 0)
+}
+
+// Delete removes an item with rectangle r and value v from t and returns a
+// boolean value indicating if such an item was found. Pages left with too few
+// entries are removed and their entries are inserted again.
+func (t *RTree) Delete(r Rect, v []byte) (bool, error) {
+	if int64(len(v)) != t.SzVal {
+		panic(fmt.Errorf("%T.Delete: invalid argument", t))
+	}
+
+	root, err := t.root()
+	if err != nil || root == 0 {
+		return false, err
+	}
+
+	type step struct {
+		p *rtreePage
+		i int
+	}
+	var path []step
+	var find func(off int64) (bool, error)
+	find = func(off int64) (bool, error) {
+		p, err := t.read(off)
+		if err != nil {
+			return false, err
+		}
+
+		for i, e := range p.e {
+			switch {
+			case p.leaf:
+				if e.r == r && bytes.Equal(e.val, v) {
+					path = append(path, step{p, i})
+					return true, nil
+				}
+			case e.r.contains(r):
+				path = append(path, step{p, i})
+				ok, err := find(e.child)
+				if err != nil || ok {
+					return ok, err
+				}
+
+				path = path[:len(path)-1]
+			}
+		}
+		return false, nil
+	}
+	if ok, err := find(root); err != nil || !ok {
+		return false, err
+	}
+
+	type orphan struct {
+		e     rtreeEntry
+		level int
+	}
+	var orphans []orphan
+	leaf := path[len(path)-1]
+	p := leaf.p
+	p.e = append(p.e[:leaf.i], p.e[leaf.i+1:]...)
+	path = path[:len(path)-1]
+	for level := 0; len(path) != 0; level++ {
+		s := path[len(path)-1]
+		path = path[:len(path)-1]
+		switch {
+		case len(p.e) < t.min():
+			for _, e := range p.e {
+				orphans = append(orphans, orphan{e, level})
+			}
+			if err := t.Free(p.off); err != nil {
+				return false, err
+			}
+
+			s.p.e = append(s.p.e[:s.i], s.p.e[s.i+1:]...)
+		default:
+			if err := t.write(p); err != nil {
+				return false, err
+			}
+
+			s.p.e[s.i].r = p.bbox()
+		}
+		p = s.p
+	}
+
+	// p is the root.
+	switch {
+	case len(p.e) == 0:
+		if err := t.Free(p.off); err != nil {
+			return false, err
+		}
+
+		if err := t.setRoot(0); err != nil {
+			return false, err
+		}
+
+		if err := t.setHeight(0); err != nil {
+			return false, err
+		}
+	default:
+		if err := t.write(p); err != nil {
+			return false, err
+		}
+	}
+
+	for _, v := range orphans {
+		if err := t.insert(v.e, v.level); err != nil {
+			return false, err
+		}
+	}
+
+	for {
+		if root, err = t.root(); err != nil || root == 0 {
+			break
+		}
+
+		h, err := t.height()
+		if err != nil {
+			return false, err
+		}
+
+		p, err := t.read(root)
+		if err != nil {
+			return false, err
+		}
+
+		if p.leaf || len(p.e) != 1 {
+			break
+		}
+
+		if err := t.setRoot(p.e[0].child); err != nil {
+			return false, err
+		}
+
+		if err := t.setHeight(h - 1); err != nil {
+			return false, err
+		}
+
+		if err := t.Free(root); err != nil {
+			return false, err
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, t.incLen(-1)
+}
+
+// Insert adds an item with rectangle r and value v to t. The length of v must
+// be equal to SzVal. Multiple items may have the same rectangle and value.
+func (t *RTree) Insert(r Rect, v []byte) error {
+	if int64(len(v)) != t.SzVal || r.Min[0] > r.Max[0] || r.Min[1] > r.Max[1] {
+		panic(fmt.Errorf("%T.Insert: invalid argument", t))
+	}
+
+	if err := t.insert(rtreeEntry{r: r, val: append([]byte(nil), v...)}, 0); err != nil {
+		return err
+	}
+
+	return t.incLen(1)
+}
+
+// Len returns the number of items in t or an error, if any.
+func (t *RTree) Len() (int64, error) { return t.r8(t.Off + oRTreeLen) }
+
+// Nearest returns a cursor enumerating all items of t in the order of
+// increasing distance of their rectangles from the point p or an error, if
+// any. The cursor is invalidated by any Insert or Delete.
+func (t *RTree) Nearest(p [2]float64) (*RTreeCursor, error) {
+	r, err := t.root()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RTreeCursor{t: t, nearest: true, p: p}
+	if r != 0 {
+		c.heap = rtreeHeap{{page: r}}
+	}
+	return c, nil
+}
+
+// Remove frees all space used by t.
+//
+// For discussion of the free function see Clear.
+func (t *RTree) Remove(free func(voff int64) error) error {
+	if err := t.Clear(free); err != nil {
+		return err
+	}
+
+	if err := t.Free(t.Off); err != nil {
+		return err
+	}
+
+	t.Off = 0
+	return nil
+}
+
+// Search returns a cursor enumerating the items of t with rectangles
+// intersecting r or an error, if any. The cursor is invalidated by any Insert
+// or Delete.
+func (t *RTree) Search(r Rect) (*RTreeCursor, error) {
+	root, err := t.root()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RTreeCursor{t: t, r: r}
+	if root != 0 {
+		c.stack = []int64{root}
+	}
+	return c, nil
+}
+
+type rtreeHeapItem struct {
+	dist float64
+	page int64 // Zero for items.
+	r    Rect
+	voff int64
+}
+
+type rtreeHeap []rtreeHeapItem
+
+func (h rtreeHeap) Len() int            { return len(h) }
+func (h rtreeHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h rtreeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rtreeHeap) Push(x interface{}) { *h = append(*h, x.(rtreeHeapItem)) }
+
+func (h *rtreeHeap) Pop() interface{} {
+	n := len(*h)
+	r := (*h)[n-1]
+	*h = (*h)[:n-1]
+	return r
+}
+
+// RTreeCursor provides enumerating RTree items.
+type RTreeCursor struct {
+	R       Rect    // Item rectangle. Not valid before calling Next.
+	V       int64   // Item value offset. Not valid before calling Next.
+	Dist    float64 // Distance of R from the point passed to Nearest. Not valid before calling Next.
+	err     error
+	heap    rtreeHeap
+	i       int
+	nearest bool
+	p       [2]float64
+	page    *rtreePage
+	r       Rect
+	stack   []int64
+	t       *RTree
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *RTreeCursor) Err() error { return c.err }
+
+// Next moves the cursor to the next item and sets the R, V and Dist fields
+// accordingly. It returns true on success, or false if there is no next item
+// or an error happened while moving the cursor. Err should be consulted to
+// distinguish between the two cases.
+func (c *RTreeCursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	if c.nearest {
+		return c.nextNearest()
+	}
+
+	for {
+		if c.page != nil {
+			for c.i < len(c.page.e) {
+				i := c.i
+				c.i++
+				e := c.page.e[i]
+				if !e.r.intersects(c.r) {
+					continue
+				}
+
+				if c.page.leaf {
+					c.R = e.r
+					c.V = c.t.val(c.page.off, i)
+					return true
+				}
+
+				c.stack = append(c.stack, e.child)
+			}
+			c.page = nil
+		}
+
+		if len(c.stack) == 0 {
+			return false
+		}
+
+		off := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		if c.page, c.err = c.t.read(off); c.err != nil {
+			return false
+		}
+
+		c.i = 0
+	}
+}
+
+func (c *RTreeCursor) nextNearest() bool {
+	for c.heap.Len() != 0 {
+		it := heap.Pop(&c.heap).(rtreeHeapItem)
+		if it.page == 0 {
+			c.R = it.r
+			c.V = it.voff
+			c.Dist = math.Sqrt(it.dist)
+			return true
+		}
+
+		p, err := c.t.read(it.page)
+		if err != nil {
+			c.err = err
+			return false
+		}
+
+		for i, e := range p.e {
+			x := rtreeHeapItem{dist: e.r.dist2(c.p), r: e.r}
+			switch {
+			case p.leaf:
+				x.voff = c.t.val(p.off, i)
+			default:
+				x.page = e.child
+			}
+			heap.Push(&c.heap, x)
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+	"github.com/cznic/mathutil"
+)
+
+type rtreeItem struct {
+	r Rect
+	v int
+}
+
+func (t *RTree) verify(tb testing.TB, items []rtreeItem) {
+	n, err := t.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(items)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	root, err := t.root()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	h, err := t.height()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if root == 0 {
+		if h != 0 || n != 0 {
+			tb.Fatalf("empty tree: height %v, len %v", h, n)
+		}
+		return
+	}
+
+	var cnt int64
+	var walk func(off int64, level int) Rect
+	walk = func(off int64, level int) Rect {
+		p, err := t.read(off)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if g, e := p.leaf, level == 0; g != e {
+			tb.Fatalf("page %#x at level %v: leaf %v", off, level, g)
+		}
+
+		if len(p.e) == 0 || len(p.e) > t.m || off != root && len(p.e) < t.min() {
+			tb.Fatalf("page %#x: %v entries", off, len(p.e))
+		}
+
+		if off == root && !p.leaf && len(p.e) < 2 {
+			tb.Fatalf("root %#x: %v entries", off, len(p.e))
+		}
+
+		for _, e := range p.e {
+			switch {
+			case p.leaf:
+				cnt++
+			default:
+				if g, e := walk(e.child, level-1), e.r; g != e {
+					tb.Fatalf("page %#x: child bounding box %v, expected %v", off, g, e)
+				}
+			}
+		}
+		return p.bbox()
+	}
+	walk(root, h-1)
+	if g, e := cnt, n; g != e {
+		tb.Fatalf("got %v leaf items, expected %v", g, e)
+	}
+}
+
+func rtreeRect(x *mathutil.FC32) Rect {
+	const w = 1000
+	a := float64(uint32(x.Next()) % w)
+	b := float64(uint32(x.Next()) % w)
+	return Rect{Min: [2]float64{a, b}, Max: [2]float64{a + float64(uint32(x.Next())%20), b + float64(uint32(x.Next())%20)}}
+}
+
+func testRTree(t *testing.T, ts func(t testing.TB) (file.File, func()), m int, szVal int64, n int) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	tr, err := db.NewRTree(m, szVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := tr.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	val := func(v int) []byte {
+		b := make([]byte, szVal)
+		copy(b, batchKey(v))
+		return b
+	}
+	x := rng()
+	var items []rtreeItem
+	for i := 0; i < n; i++ {
+		r := rtreeRect(x)
+		if err := tr.Insert(r, val(i)); err != nil {
+			t.Fatal(err)
+		}
+
+		items = append(items, rtreeItem{r, i})
+	}
+	if tr, err = db.OpenRTree(tr.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.verify(t, items)
+	search := func() {
+		for i := 0; i < 20; i++ {
+			q := rtreeRect(x)
+			q.Max[0] += 100
+			q.Max[1] += 100
+			c, err := tr.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var g []int
+			for c.Next() {
+				v, err := tr.r4(c.V)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !c.R.intersects(q) || c.R != items[sort.Search(len(items), func(i int) bool { return items[i].v >= v })].r {
+					t.Fatal(v, c.R, q)
+				}
+
+				g = append(g, v)
+			}
+			if err := c.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			var e []int
+			for _, v := range items {
+				if v.r.intersects(q) {
+					e = append(e, v.v)
+				}
+			}
+			sort.Ints(g)
+			if len(g) != len(e) {
+				t.Fatalf("got %v items, expected %v", len(g), len(e))
+			}
+
+			for i := range g {
+				if g[i] != e[i] {
+					t.Fatal(i, g[i], e[i])
+				}
+			}
+		}
+	}
+	search()
+
+	p := [2]float64{500, 500}
+	c, err := tr.Nearest(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dists []float64
+	for c.Next() {
+		dists = append(dists, c.Dist)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := len(dists), len(items); g != e {
+		t.Fatalf("got %v items, expected %v", g, e)
+	}
+
+	e := make([]float64, len(items))
+	for i, v := range items {
+		e[i] = math.Sqrt(v.r.dist2(p))
+	}
+	sort.Float64s(e)
+	for i := range dists {
+		if dists[i] != e[i] {
+			t.Fatal(i, dists[i], e[i])
+		}
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		if uint32(x.Next())%2 == 0 {
+			continue
+		}
+
+		v := items[i]
+		if ok, err := tr.Delete(v.r, val(v.v)); !ok || err != nil {
+			t.Fatal(i, ok, err)
+		}
+
+		items = append(items[:i], items[i+1:]...)
+	}
+	tr.verify(t, items)
+	search()
+	if ok, err := tr.Delete(Rect{Max: [2]float64{-1, -1}}, val(0)); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	for len(items) != 0 {
+		v := items[0]
+		if ok, err := tr.Delete(v.r, val(v.v)); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		items = items[1:]
+	}
+	tr.verify(t, nil)
+}
+
+func TestRTree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRTree(t, v.f, 0, 4, 1<<12) }) {
+			break
+		}
+	}
+}
+
+func TestRTreeSmallPages(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testRTree(t, v.f, 4, 16, 1<<10) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,586 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	slMaxLevel = 32
+	slSeed     = 0x2545f4914f6cdd1d
+)
+
+const (
+	oSLLen   = 8 * iota // int64
+	oSLLevel            // int64
+	oSLSeed             // int64
+	oSLSzKey            // int64
+	oSLSzVal            // int64
+	oSLNext             // [slMaxLevel]int64
+
+	szSkipList = oSLNext + 8*slMaxLevel
+)
+
+const (
+	oSLNodeLevel = 8 * iota // int64
+	oSLNodePrev             // int64
+	oSLNodeNext             // int64
+	oSLNodeData             // struct{[szKey]byte, [szVal]byte, [level-1]int64}
+)
+
+// SkipList is a persistent, ordered skip list. Every item is a single
+// SkipListNode. Its data are the key followed by the value of the item and
+// they are followed by the links to the next nodes on the levels above the
+// lowest one the node is part of. Nodes are never moved, so the key and value
+// offsets of an item are stable for its lifetime.
+//
+// Inserting an item writes the node first and then links it to its
+// predecessors starting at the lowest level, so a reader following the
+// lowest level links sees every item either fully present or absent. Readers
+// still have to be synchronized with writers by the user of SkipList as the
+// Storage itself is not safe for concurrent use.
+type SkipList struct {
+	*DB
+	Off   int64 // Location in the database.
+	SzKey int64 // The szKey argument of NewSkipList.
+	SzVal int64 // The szVal argument of NewSkipList.
+}
+
+// NewSkipList allocates and returns a new, empty SkipList or an error, if
+// any. The szKey and szVal arguments are the sizes of the SkipList keys and
+// values.
+func (db *DB) NewSkipList(szKey, szVal int64) (*SkipList, error) {
+	if szKey < 0 || szVal < 0 {
+		panic(fmt.Errorf("%T.NewSkipList: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szSkipList)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSLSeed, slSeed); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSLSzKey, szKey); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSLSzVal, szVal); err != nil {
+		return nil, err
+	}
+
+	return &SkipList{DB: db, Off: off, SzKey: szKey, SzVal: szVal}, nil
+}
+
+// OpenSkipList opens and returns an existing SkipList or an error, if any.
+func (db *DB) OpenSkipList(off int64) (*SkipList, error) {
+	szKey, err := db.r8(off + oSLSzKey)
+	if err != nil {
+		return nil, err
+	}
+
+	szVal, err := db.r8(off + oSLSzVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if szKey < 0 || szVal < 0 {
+		return nil, fmt.Errorf("%T.OpenSkipList: corrupted database", db)
+	}
+
+	return &SkipList{DB: db, Off: off, SzKey: szKey, SzVal: szVal}, nil
+}
+
+func (t *SkipList) level() (int, error) {
+	n, err := t.r8(t.Off + oSLLevel)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 || n > slMaxLevel {
+		return 0, fmt.Errorf("%T: corrupted database", t)
+	}
+
+	return int(n), nil
+}
+
+// link returns the offset of the link to the next node on level i of node.
+func (t *SkipList) link(node int64, i int) int64 {
+	if i == 0 {
+		return node + oSLNodeNext
+	}
+
+	return node + oSLNodeData + t.SzKey + t.SzVal + 8*int64(i-1)
+}
+
+func (t *SkipList) node(off int64) SkipListNode { return SkipListNode{t.DB, off} }
+
+// pred returns the node owning the link at lnk on the lowest level, zero for
+// the head of t.
+func (t *SkipList) pred(lnk int64) int64 {
+	if lnk == t.Off+oSLNext {
+		return 0
+	}
+
+	return lnk - oSLNodeNext
+}
+
+func (t *SkipList) setLevel(n int) error { return t.w8(t.Off+oSLLevel, int64(n)) }
+
+// find searches for the key used by cmp and returns the offsets of the links
+// pointing to the searched position on every level below the current level
+// of t, the offset of the found node and a boolean value indicating the key
+// was found.
+func (t *SkipList) find(cmp func(koff int64) (int, error)) (update [slMaxLevel]int64, level int, node int64, ok bool, err error) {
+	if level, err = t.level(); err != nil {
+		return update, 0, 0, false, err
+	}
+
+	head := true
+	var x int64
+	for i := level - 1; i >= 0; i-- {
+		for {
+			lnk := t.Off + oSLNext + 8*int64(i)
+			if !head {
+				lnk = t.link(x, i)
+			}
+			update[i] = lnk
+			n, err := t.r8(lnk)
+			if err != nil {
+				return update, 0, 0, false, err
+			}
+
+			if n == 0 {
+				break
+			}
+
+			c, err := cmp(t.node(n).DataOff())
+			if err != nil {
+				return update, 0, 0, false, err
+			}
+
+			if c > 0 {
+				head = false
+				x = n
+				continue
+			}
+
+			if c == 0 && i == 0 {
+				node = n
+				ok = true
+			}
+			break
+		}
+	}
+	return update, level, node, ok, nil
+}
+
+func (t *SkipList) incLen(delta int64) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oSLLen, n+delta)
+}
+
+// randomLevel returns the level of a new node. The pseudo random generator
+// state is kept in the database, so the shape of the list is a function of
+// the sequence of operations only.
+func (t *SkipList) randomLevel() (int, error) {
+	x, err := t.r8(t.Off + oSLSeed)
+	if err != nil {
+		return 0, err
+	}
+
+	u := uint64(x)
+	u ^= u >> 12
+	u ^= u << 25
+	u ^= u >> 27
+	if err := t.w8(t.Off+oSLSeed, int64(u)); err != nil {
+		return 0, err
+	}
+
+	u *= 0x2545f4914f6cdd1d
+	n := 1
+	for ; n < slMaxLevel && u&3 == 0; u >>= 2 {
+		n++
+	}
+	return n, nil
+}
+
+// Clear deletes all items of t.
+//
+// For discussion of the free function see BTree.Clear.
+func (t *SkipList) Clear(free func(koff, voff int64) error) error {
+	n, err := t.r8(t.Off + oSLNext)
+	if err != nil {
+		return err
+	}
+
+	for n != 0 {
+		next, err := t.r8(n + oSLNodeNext)
+		if err != nil {
+			return err
+		}
+
+		if free != nil {
+			koff := t.node(n).DataOff()
+			if err := free(koff, koff+t.SzKey); err != nil {
+				return err
+			}
+		}
+
+		if err := t.Free(n); err != nil {
+			return err
+		}
+
+		n = next
+	}
+
+	level, err := t.level()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < level; i++ {
+		if err := t.w8(t.Off+oSLNext+8*int64(i), 0); err != nil {
+			return err
+		}
+	}
+
+	if err := t.setLevel(0); err != nil {
+		return err
+	}
+
+	return t.w8(t.Off+oSLLen, 0)
+}
+
+// Delete removes an item from t and returns a boolean value indicating if the
+// item was found.
+//
+// For discussion of the cmp function see BTree.Delete. For discussion of the
+// free function see BTree.Clear.
+func (t *SkipList) Delete(cmp func(koff int64) (int, error), free func(koff, voff int64) error) (bool, error) {
+	update, level, n, ok, err := t.find(cmp)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	for i := 0; i < level; i++ {
+		p, err := t.r8(update[i])
+		if err != nil {
+			return false, err
+		}
+
+		if p != n {
+			break
+		}
+
+		next, err := t.r8(t.link(n, i))
+		if err != nil {
+			return false, err
+		}
+
+		if err := t.w8(update[i], next); err != nil {
+			return false, err
+		}
+	}
+
+	next, err := t.r8(n + oSLNodeNext)
+	if err != nil {
+		return false, err
+	}
+
+	if next != 0 {
+		if err := t.w8(next+oSLNodePrev, t.pred(update[0])); err != nil {
+			return false, err
+		}
+	}
+
+	for ; level > 0; level-- {
+		first, err := t.r8(t.Off + oSLNext + 8*int64(level-1))
+		if err != nil {
+			return false, err
+		}
+
+		if first != 0 {
+			break
+		}
+	}
+	if err := t.setLevel(level); err != nil {
+		return false, err
+	}
+
+	if free != nil {
+		koff := t.node(n).DataOff()
+		if err := free(koff, koff+t.SzKey); err != nil {
+			return false, err
+		}
+	}
+
+	if err := t.Free(n); err != nil {
+		return false, err
+	}
+
+	return true, t.incLen(-1)
+}
+
+// Get searches for a key in t and returns the offset of its associated value
+// and a boolean value indicating success.
+//
+// For discussion of the cmp function see BTree.Delete.
+func (t *SkipList) Get(cmp func(koff int64) (int, error)) (int64, bool, error) {
+	_, _, n, ok, err := t.find(cmp)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	return t.node(n).DataOff() + t.SzKey, true, nil
+}
+
+// Len returns the number of items in t or an error, if any.
+func (t *SkipList) Len() (int64, error) { return t.r8(t.Off + oSLLen) }
+
+// Remove frees all space used by t.
+//
+// For discussion of the free function see BTree.Clear.
+func (t *SkipList) Remove(free func(koff, voff int64) error) error {
+	if err := t.Clear(free); err != nil {
+		return err
+	}
+
+	if err := t.Free(t.Off); err != nil {
+		return err
+	}
+
+	t.Off = 0
+	return nil
+}
+
+// Seek searches t for a key collating after the key used by the cmp function
+// and returns a cursor positioned before the found item and a boolean value
+// indicating the desired and found keys are equal.
+//
+// For discussion of the cmp function see BTree.Delete.
+func (t *SkipList) Seek(cmp func(koff int64) (int, error)) (*SkipListCursor, bool, error) {
+	update, _, _, ok, err := t.find(cmp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if update[0] == 0 {
+		// Empty list.
+		return &SkipListCursor{t: t}, false, nil
+	}
+
+	n, err := t.r8(update[0])
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &SkipListCursor{hit: ok, n: n, p: t.pred(update[0]), t: t}, ok, nil
+}
+
+// SeekFirst returns a cursor positioned before the first item of t or an
+// error, if any.
+func (t *SkipList) SeekFirst() (*SkipListCursor, error) {
+	n, err := t.r8(t.Off + oSLNext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SkipListCursor{n: n, t: t}, nil
+}
+
+// SeekLast returns a cursor positioned after the last item of t or an error,
+// if any.
+func (t *SkipList) SeekLast() (*SkipListCursor, error) {
+	update, _, _, _, err := t.find(func(int64) (int, error) { return 1, nil })
+	if err != nil {
+		return nil, err
+	}
+
+	if update[0] == 0 {
+		// Empty list.
+		return &SkipListCursor{t: t}, nil
+	}
+
+	return &SkipListCursor{p: t.pred(update[0]), t: t}, nil
+}
+
+// Set adds or overwrites an item in t and returns the offsets of its key and
+// value or an error, if any.
+//
+// For discussion of the cmp function see BTree.Delete. For discussion of the
+// free function see BTree.Set.
+func (t *SkipList) Set(cmp func(koff int64) (int, error), free func(voff int64) error) (int64, int64, error) {
+	update, level, n, ok, err := t.find(cmp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if ok {
+		koff := t.node(n).DataOff()
+		if free != nil {
+			if err := free(koff + t.SzKey); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		return koff, koff + t.SzKey, nil
+	}
+
+	nl, err := t.randomLevel()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if nl > level {
+		for i := level; i < nl; i++ {
+			update[i] = t.Off + oSLNext + 8*int64(i)
+		}
+		if err := t.setLevel(nl); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if n, err = t.Alloc(oSLNodeData + t.SzKey + t.SzVal + 8*int64(nl-1)); err != nil {
+		return 0, 0, err
+	}
+
+	if err := t.w8(n+oSLNodeLevel, int64(nl)); err != nil {
+		return 0, 0, err
+	}
+
+	if err := t.w8(n+oSLNodePrev, t.pred(update[0])); err != nil {
+		return 0, 0, err
+	}
+
+	for i := 0; i < nl; i++ {
+		next, err := t.r8(update[i])
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if err := t.w8(t.link(n, i), next); err != nil {
+			return 0, 0, err
+		}
+	}
+	next, err := t.r8(n + oSLNodeNext)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for i := 0; i < nl; i++ {
+		if err := t.w8(update[i], n); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if next != 0 {
+		if err := t.w8(next+oSLNodePrev, n); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := t.incLen(1); err != nil {
+		return 0, 0, err
+	}
+
+	koff := t.node(n).DataOff()
+	return koff, koff + t.SzKey, nil
+}
+
+// SkipListNode is a node of a SkipList. Its data are the key of the item
+// followed by its value.
+type SkipListNode struct {
+	*DB
+	Off int64
+}
+
+// OpenSkipListNode returns a SkipListNode found at offset off.
+func (db *DB) OpenSkipListNode(off int64) (SkipListNode, error) { return SkipListNode{db, off}, nil }
+
+// DataOff returns the offset in db at which data of n are located.
+func (n SkipListNode) DataOff() int64 { return n.Off + oSLNodeData }
+
+// Next returns the offset of the next node of n or zero if n is the last one.
+func (n SkipListNode) Next() (int64, error) { return n.r8(n.Off + oSLNodeNext) }
+
+// Prev returns the offset of the previous node of n or zero if n is the first
+// one.
+func (n SkipListNode) Prev() (int64, error) { return n.r8(n.Off + oSLNodePrev) }
+
+// SkipListCursor provides enumerating SkipList items in key order.
+type SkipListCursor struct {
+	K        int64 // Item key offset. Not valid before calling Next or Prev.
+	V        int64 // Item value offset. Not valid before calling Next or Prev.
+	Node     int64 // Item node offset. Not valid before calling Next or Prev.
+	err      error
+	hasMoved bool
+	hit      bool
+	n        int64 // The current node.
+	p        int64 // The node preceding the position of Seek or SeekLast.
+	t        *SkipList
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *SkipListCursor) Err() error { return c.err }
+
+func (c *SkipListCursor) set() bool {
+	if c.err != nil || c.n == 0 {
+		return false
+	}
+
+	c.Node = c.n
+	c.K = c.t.node(c.n).DataOff()
+	c.V = c.K + c.t.SzKey
+	return true
+}
+
+// Next moves the cursor to the next item and sets the K, V and Node fields
+// accordingly. It returns true on success, or false if there is no next item
+// or an error happened while moving the cursor. Err should be consulted to
+// distinguish between the two cases.
+//
+// Every use of the K/V/Node fields, even the first one, must be preceded by a
+// call to Next or Prev.
+func (c *SkipListCursor) Next() bool {
+	if c.err != nil || c.hasMoved && c.n == 0 {
+		return false
+	}
+
+	if c.hasMoved {
+		c.n, c.err = c.t.node(c.n).Next()
+	}
+	c.hasMoved = true
+	return c.set()
+}
+
+// Prev moves the cursor to the previous item and sets the K, V and Node fields
+// accordingly. It returns true on success, or false if there is no previous
+// item or an error happened while moving the cursor. Err should be consulted
+// to distinguish between the two cases.
+//
+// Every use of the K/V/Node fields, even the first one, must be preceded by a
+// call to Next or Prev.
+func (c *SkipListCursor) Prev() bool {
+	if c.err != nil || c.hasMoved && c.n == 0 {
+		return false
+	}
+
+	switch {
+	case c.hasMoved:
+		c.n, c.err = c.t.node(c.n).Prev()
+	case !c.hit:
+		c.n = c.p
+	}
+	c.hasMoved = true
+	return c.set()
+}
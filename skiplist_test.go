@@ -0,0 +1,434 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+func (t *SkipList) cmp(n int) func(off int64) (int, error) {
+	return func(off int64) (int, error) {
+		m, err := t.r4(off)
+		if err != nil {
+			return 0, err
+		}
+
+		if n < m {
+			return -1, nil
+		}
+
+		if n > m {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+}
+
+func (t *SkipList) verify(tb testing.TB) {
+	level, err := t.level()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var below map[int64]bool
+	for i := 0; i < slMaxLevel; i++ {
+		n, err := t.r8(t.Off + oSLNext + 8*int64(i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if i >= level {
+			if n != 0 {
+				tb.Fatalf("level %v: unexpected link %#x", i, n)
+			}
+
+			continue
+		}
+
+		if n == 0 {
+			tb.Fatalf("level %v: empty", i)
+		}
+
+		m := map[int64]bool{}
+		var last int
+		var prev int64
+		for ; n != 0; n, err = t.r8(t.link(n, i)) {
+			nl, err := t.r8(n + oSLNodeLevel)
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			if nl <= int64(i) {
+				tb.Fatalf("level %v: node %#x has level %v", i, n, nl)
+			}
+
+			if below != nil && !below[n] {
+				tb.Fatalf("level %v: node %#x not on the level below", i, n)
+			}
+
+			if i == 0 {
+				p, err := t.node(n).Prev()
+				if err != nil {
+					tb.Fatal(err)
+				}
+
+				if p != prev {
+					tb.Fatalf("node %#x: got prev %#x, expected %#x", n, p, prev)
+				}
+
+				prev = n
+			}
+
+			k, err := t.r4(t.node(n).DataOff())
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			if len(m) != 0 && k <= last {
+				tb.Fatalf("level %v: keys out of order %v %v", i, last, k)
+			}
+
+			last = k
+			m[n] = true
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if i == 0 {
+			c, err := t.Len()
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			if g, e := c, int64(len(m)); g != e {
+				tb.Fatalf("got len %v, expected %v", g, e)
+			}
+		}
+		below = m
+	}
+}
+
+func testSkipList(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	sl, err := db.NewSkipList(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := sl.Remove(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1 << 11
+	m := map[int]int{}
+	x := rng()
+	for i := 0; i < 4*N; i++ {
+		k := x.Next() & (N - 1)
+		switch {
+		case x.Next()%3 == 0:
+			ok, err := sl.Delete(sl.cmp(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, e := m[k]
+			if ok != e {
+				t.Fatal(i, k, ok, e)
+			}
+
+			delete(m, k)
+		default:
+			koff, voff, err := sl.Set(sl.cmp(k), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sl.w4(koff, k); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sl.w4(voff, i); err != nil {
+				t.Fatal(err)
+			}
+
+			m[k] = i
+		}
+	}
+	sl.verify(t)
+	if sl, err = db.OpenSkipList(sl.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []int
+	for k, v := range m {
+		keys = append(keys, k)
+		voff, ok, err := sl.Get(sl.cmp(k))
+		if err != nil || !ok {
+			t.Fatal(k, ok, err)
+		}
+
+		w, err := sl.r4(voff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := w, v; g != e {
+			t.Fatal(k, g, e)
+		}
+	}
+	sort.Ints(keys)
+
+	c, err := sl.SeekFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	for ; c.Next(); i++ {
+		k, err := sl.r4(c.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := k, keys[i]; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := i, len(keys); g != e {
+		t.Fatal(g, e)
+	}
+
+	if c, err = sl.SeekLast(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i = len(keys) - 1; c.Prev(); i-- {
+		k, err := sl.r4(c.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := k, keys[i]; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := i, -1; g != e {
+		t.Fatal(g, e)
+	}
+
+	for k := -1; k <= N; k++ {
+		c, hit, err := sl.Seek(sl.cmp(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j := sort.SearchInts(keys, k)
+		if g, e := hit, j < len(keys) && keys[j] == k; g != e {
+			t.Fatal(k, g, e)
+		}
+
+		switch {
+		case j < len(keys):
+			if !c.Next() {
+				t.Fatal(k, c.Err())
+			}
+
+			g, err := sl.r4(c.K)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e := keys[j]; g != e {
+				t.Fatal(k, g, e)
+			}
+		default:
+			if c.Next() {
+				t.Fatal(k)
+			}
+		}
+
+		if c, _, err = sl.Seek(sl.cmp(k)); err != nil {
+			t.Fatal(err)
+		}
+
+		if hit {
+			j++
+		}
+		switch {
+		case j > 0:
+			if !c.Prev() {
+				t.Fatal(k, c.Err())
+			}
+
+			g, err := sl.r4(c.K)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e := keys[j-1]; g != e {
+				t.Fatal(k, g, e)
+			}
+		default:
+			if c.Prev() {
+				t.Fatal(k)
+			}
+		}
+	}
+
+	if err := sl.Clear(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sl.verify(t)
+	if c, _, err = sl.Seek(sl.cmp(42)); err != nil || c.Next() {
+		t.Fatal(err)
+	}
+
+	if c, err = sl.SeekLast(); err != nil || c.Prev() {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSkipList(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testSkipListFree(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	sl, err := db.NewSkipList(4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := func(koff, voff int64) error {
+		p, err := sl.r8(voff)
+		if err != nil {
+			return err
+		}
+
+		return sl.Free(p)
+	}
+
+	defer func() {
+		if err := sl.Remove(free); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 1 << 10
+	for round := 0; round < 3; round++ {
+		for i := 0; i < N; i++ {
+			if round == 2 && i%2 == 0 {
+				if _, err := sl.Delete(sl.cmp(i), free); err != nil {
+					t.Fatal(err)
+				}
+
+				continue
+			}
+
+			p, err := sl.Alloc(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			koff, voff, err := sl.Set(sl.cmp(i), func(voff int64) error { return free(0, voff) })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sl.w4(koff, i); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sl.w8(voff, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sl.verify(t)
+	}
+}
+
+func TestSkipListFree(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSkipListFree(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func benchmarkSkipListSetSeq(b *testing.B, ts func(t testing.TB) (file.File, func()), n int) {
+	b.ResetTimer()
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		func() {
+			db, f := tmpDB(b, ts)
+
+			defer f()
+
+			sl, err := db.NewSkipList(4, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer func() {
+				if err := sl.Remove(nil); err != nil {
+					b.Fatal(err)
+				}
+			}()
+
+			b.StartTimer()
+			for j := 0; j < n; j++ {
+				koff, _, err := sl.Set(sl.cmp(j), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := sl.w4(koff, j); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+		}()
+	}
+}
+
+func BenchmarkSkipListSetSeq(b *testing.B) {
+	for _, v := range ctors {
+		var n int
+		for _, e := range []int{2, 3, 4, 5} {
+			n = 1
+			for i := 0; i < e; i++ {
+				n *= 10
+			}
+			b.Run(fmt.Sprintf("%s1e%d", v.s, e), func(b *testing.B) { benchmarkSkipListSetSeq(b, v.f, n) })
+		}
+	}
+}
@@ -4,11 +4,23 @@
 
 package db
 
+import (
+	"fmt"
+)
+
 const (
 	oSListNext = 8 * iota // int64		0	8
 	oSListData            // [dataSize]byte	8	dataSize
 )
 
+const (
+	oSListHeadFirst = 8 * iota // int64		0	8
+	oSListHeadLast             // int64		8	8
+	oSListHeadLen              // int64		16	8
+
+	szSListHead
+)
+
 // SList is a node of a single linked list.
 type SList struct {
 	*DB
@@ -33,7 +45,31 @@ func (db *DB) NewSList(dataSize int64) (SList, error) {
 		return SList{}, err
 	}
 
-	return r, r.setNext(0)
+	if err := r.setNext(0); err != nil {
+		db.Free(off)
+		return SList{}, err
+	}
+
+	return r, nil
+}
+
+// NewSListData returns a newly allocated SList with a variable sized payload
+// initialized to a copy of data or an error, if any. The node records the
+// length of its payload, use the Data and SetData methods to access it.
+//
+// The result of NewSListData is not a part of any list.
+func (db *DB) NewSListData(data []byte) (SList, error) {
+	r, err := db.NewSList(oPayloadData + int64(len(data)))
+	if err != nil {
+		return SList{}, err
+	}
+
+	if err := initPayload(r, r.DataOff(), data); err != nil {
+		db.Free(r.Off)
+		return SList{}, err
+	}
+
+	return r, nil
 }
 
 func (l SList) setNext(off int64) error { return l.w8(l.Off+oSListNext, off) }
@@ -44,9 +80,60 @@ func (db *DB) OpenSList(off int64) (SList, error) { return SList{db, off}, nil }
 // DataOff returns the offset in db at which data of l are located.
 func (l SList) DataOff() int64 { return l.Off + oSListData }
 
+// Data returns a copy of the payload of l, which must have been created by
+// NewSListData.
+func (l SList) Data() ([]byte, error) {
+	b, ok, err := readPayload(l, l.DataOff())
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%T.Data: corrupted node at %#x", l, l.Off)
+	}
+
+	return b, nil
+}
+
 // Next returns the offset of the next node of l.
 func (l SList) Next() (int64, error) { return l.r8(l.Off + oSListNext) }
 
+// SetData sets the payload of l, which must have been created by
+// NewSListData, to a copy of data. If data does not fit the space allocated
+// for the payload, the node is reallocated and its new offset is returned in
+// the Off field of the result. If l is linked to from an SList node at prev,
+// the prev argument must reflect that, otherwise prev must be zero. The link
+// from prev is then updated. Use SListHead.SetData for nodes of a list with a
+// header.
+func (l SList) SetData(prev int64, data []byte) (SList, error) {
+	ok, err := writePayload(l, l.DataOff(), data)
+	if err != nil || ok {
+		return l, err
+	}
+
+	off, err := l.Realloc(l.Off, oSListData+oPayloadData+int64(len(data)))
+	if err != nil {
+		return l, err
+	}
+
+	r := SList{l.DB, off}
+	if err := initPayload(r, r.DataOff(), data); err != nil {
+		return r, err
+	}
+
+	if prev != 0 && off != l.Off {
+		p, err := l.OpenSList(prev)
+		if err != nil {
+			return r, err
+		}
+
+		if err := p.setNext(off); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
 // InsertAfter inserts l after the SList node at off. Node l must not be
 // already a part of any list.
 func (l SList) InsertAfter(off int64) error {
@@ -139,3 +226,442 @@ func (l SList) RemoveToLast(prev int64) error {
 	}
 	return nil
 }
+
+// Sort sorts the list starting at l, which must be its first node, using a
+// stable bottom-up merge sort and returns the new first node. Only the links
+// of the nodes are rewritten, node data are never copied or moved and the
+// memory used does not depend on the list length.
+//
+// The less function reports whether the node at aoff must sort before the
+// node at boff.
+func (l SList) Sort(less func(aoff, boff int64) (bool, error)) (SList, error) {
+	first, _, err := sortChain(l.DB, l.Off, oSListNext, less)
+	if err != nil {
+		return SList{}, err
+	}
+
+	return l.OpenSList(first)
+}
+
+// SListHead is a persistent header of a single linked list of SList nodes. It
+// records the first and last node of the list and the number of its nodes.
+type SListHead struct {
+	*DB
+	Off int64
+}
+
+// NewSListHead returns a newly allocated, empty SListHead or an error, if
+// any.
+func (db *DB) NewSListHead() (SListHead, error) {
+	off, err := db.Calloc(szSListHead)
+	if err != nil {
+		return SListHead{}, err
+	}
+
+	return db.OpenSListHead(off)
+}
+
+// OpenSListHead returns an SListHead found at offset off.
+func (db *DB) OpenSListHead(off int64) (SListHead, error) { return SListHead{db, off}, nil }
+
+func (h SListHead) setBack(off int64) error  { return h.w8(h.Off+oSListHeadLast, off) }
+func (h SListHead) setFront(off int64) error { return h.w8(h.Off+oSListHeadFirst, off) }
+func (h SListHead) setLen(n int64) error     { return h.w8(h.Off+oSListHeadLen, n) }
+
+// Back returns the offset of the last node of the list or zero if the list is
+// empty.
+func (h SListHead) Back() (int64, error) { return h.r8(h.Off + oSListHeadLast) }
+
+// Front returns the offset of the first node of the list or zero if the list
+// is empty.
+func (h SListHead) Front() (int64, error) { return h.r8(h.Off + oSListHeadFirst) }
+
+// Len returns the number of nodes in the list.
+func (h SListHead) Len() (int64, error) { return h.r8(h.Off + oSListHeadLen) }
+
+func (h SListHead) add(delta int64) error {
+	n, err := h.Len()
+	if err != nil {
+		return err
+	}
+
+	return h.setLen(n + delta)
+}
+
+// prev returns the offset of the node linking to the node at off. It walks
+// the list from its first node.
+func (h SListHead) prev(off int64) (int64, error) {
+	n, err := h.Front()
+	if err != nil {
+		return 0, err
+	}
+
+	var prev int64
+	for n != off {
+		if n == 0 {
+			return 0, fmt.Errorf("%T: node %#x is not in the list", h, off)
+		}
+
+		l, err := h.OpenSList(n)
+		if err != nil {
+			return 0, err
+		}
+
+		prev = n
+		if n, err = l.Next(); err != nil {
+			return 0, err
+		}
+	}
+	return prev, nil
+}
+
+// InsertAfter inserts n after the node at off, which must be a part of the
+// list. Node n must not be already a part of any list.
+func (h SListHead) InsertAfter(n SList, off int64) error {
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	if err := n.InsertAfter(off); err != nil {
+		return err
+	}
+
+	if off == last {
+		if err := h.setBack(n.Off); err != nil {
+			return err
+		}
+	}
+
+	return h.add(1)
+}
+
+// PopBack unlinks the last node of the list and returns it. The returned node
+// is not freed. If the list is empty, the Off field of the result is zero.
+// PopBack has to walk the list to find the node before the last one.
+func (h SListHead) PopBack() (SList, error) {
+	last, err := h.Back()
+	if err != nil || last == 0 {
+		return SList{}, err
+	}
+
+	prev, err := h.prev(last)
+	if err != nil {
+		return SList{}, err
+	}
+
+	switch {
+	case prev == 0:
+		if err := h.setFront(0); err != nil {
+			return SList{}, err
+		}
+	default:
+		p, err := h.OpenSList(prev)
+		if err != nil {
+			return SList{}, err
+		}
+
+		if err := p.setNext(0); err != nil {
+			return SList{}, err
+		}
+	}
+
+	if err := h.setBack(prev); err != nil {
+		return SList{}, err
+	}
+
+	if err := h.add(-1); err != nil {
+		return SList{}, err
+	}
+
+	return h.OpenSList(last)
+}
+
+// PopFront unlinks the first node of the list and returns it. The returned
+// node is not freed. If the list is empty, the Off field of the result is
+// zero.
+func (h SListHead) PopFront() (SList, error) {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return SList{}, err
+	}
+
+	n, err := h.OpenSList(first)
+	if err != nil {
+		return SList{}, err
+	}
+
+	next, err := n.Next()
+	if err != nil {
+		return SList{}, err
+	}
+
+	if err := h.setFront(next); err != nil {
+		return SList{}, err
+	}
+
+	if next == 0 {
+		if err := h.setBack(0); err != nil {
+			return SList{}, err
+		}
+	}
+
+	if err := n.setNext(0); err != nil {
+		return SList{}, err
+	}
+
+	if err := h.add(-1); err != nil {
+		return SList{}, err
+	}
+
+	return n, nil
+}
+
+// PushBack appends n to the list. Node n must not be already a part of any
+// list.
+func (h SListHead) PushBack(n SList) error {
+	last, err := h.Back()
+	if err != nil {
+		return err
+	}
+
+	if err := n.setNext(0); err != nil {
+		return err
+	}
+
+	switch {
+	case last == 0:
+		if err := h.setFront(n.Off); err != nil {
+			return err
+		}
+	default:
+		l, err := h.OpenSList(last)
+		if err != nil {
+			return err
+		}
+
+		if err := l.setNext(n.Off); err != nil {
+			return err
+		}
+	}
+
+	if err := h.setBack(n.Off); err != nil {
+		return err
+	}
+
+	return h.add(1)
+}
+
+// PushFront prepends n to the list. Node n must not be already a part of any
+// list.
+func (h SListHead) PushFront(n SList) error {
+	first, err := h.Front()
+	if err != nil {
+		return err
+	}
+
+	if err := n.setNext(first); err != nil {
+		return err
+	}
+
+	if err := h.setFront(n.Off); err != nil {
+		return err
+	}
+
+	if first == 0 {
+		if err := h.setBack(n.Off); err != nil {
+			return err
+		}
+	}
+
+	return h.add(1)
+}
+
+// Remove removes n from the list and frees it. Remove has to walk the list to
+// find the node before n.
+func (h SListHead) Remove(n SList) error {
+	prev, err := h.prev(n.Off)
+	if err != nil {
+		return err
+	}
+
+	next, err := n.Next()
+	if err != nil {
+		return err
+	}
+
+	if prev == 0 {
+		if err := h.setFront(next); err != nil {
+			return err
+		}
+	}
+
+	if next == 0 {
+		if err := h.setBack(prev); err != nil {
+			return err
+		}
+	}
+
+	if err := n.Remove(prev); err != nil {
+		return err
+	}
+
+	return h.add(-1)
+}
+
+// RemoveAll removes and frees all nodes of the list.
+func (h SListHead) RemoveAll() error {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return err
+	}
+
+	n, err := h.OpenSList(first)
+	if err != nil {
+		return err
+	}
+
+	if err := n.RemoveToLast(0); err != nil {
+		return err
+	}
+
+	if err := h.setFront(0); err != nil {
+		return err
+	}
+
+	if err := h.setBack(0); err != nil {
+		return err
+	}
+
+	return h.setLen(0)
+}
+
+// SetData sets the payload of n, which must be a part of the list and must
+// have been created by NewSListData, to a copy of data. If n is reallocated,
+// the link from its predecessor and the list header are updated. The
+// predecessor of n is found by walking the list from its front.
+func (h SListHead) SetData(n SList, data []byte) (SList, error) {
+	first, err := h.Front()
+	if err != nil {
+		return n, err
+	}
+
+	last, err := h.Back()
+	if err != nil {
+		return n, err
+	}
+
+	var prev int64
+	if n.Off != first {
+		if prev, err = h.prev(n.Off); err != nil {
+			return n, err
+		}
+	}
+
+	r, err := n.SetData(prev, data)
+	if err != nil || r.Off == n.Off {
+		return r, err
+	}
+
+	if n.Off == first {
+		if err := h.setFront(r.Off); err != nil {
+			return r, err
+		}
+	}
+
+	if n.Off == last {
+		if err := h.setBack(r.Off); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// Sort sorts the list. For details see SList.Sort.
+func (h SListHead) Sort(less func(aoff, boff int64) (bool, error)) error {
+	first, err := h.Front()
+	if err != nil || first == 0 {
+		return err
+	}
+
+	first, last, err := sortChain(h.DB, first, oSListNext, less)
+	if err != nil {
+		return err
+	}
+
+	if err := h.setFront(first); err != nil {
+		return err
+	}
+
+	return h.setBack(last)
+}
+
+// sortChain sorts the nodes linked by the int64 offsets of the next node
+// found at offset next in the nodes, starting at the node at off. It returns
+// the first and the last node of the sorted chain.
+func sortChain(db *DB, off, next int64, less func(aoff, boff int64) (bool, error)) (first, last int64, err error) {
+	for n := 1; ; n *= 2 {
+		p := off
+		off = 0
+		last = 0
+		merges := 0
+		for p != 0 {
+			merges++
+			q := p
+			pn := 0
+			for pn < n && q != 0 {
+				pn++
+				if q, err = db.r8(q + next); err != nil {
+					return 0, 0, err
+				}
+			}
+
+			qn := n
+			for pn > 0 || qn > 0 && q != 0 {
+				fromQ := pn == 0
+				if !fromQ && qn > 0 && q != 0 {
+					if fromQ, err = less(q, p); err != nil {
+						return 0, 0, err
+					}
+				}
+
+				var e int64
+				switch {
+				case fromQ:
+					e = q
+					qn--
+					if q, err = db.r8(q + next); err != nil {
+						return 0, 0, err
+					}
+				default:
+					e = p
+					pn--
+					if p, err = db.r8(p + next); err != nil {
+						return 0, 0, err
+					}
+				}
+
+				switch {
+				case last == 0:
+					off = e
+				default:
+					if err := db.w8(last+next, e); err != nil {
+						return 0, 0, err
+					}
+				}
+				last = e
+			}
+			p = q
+		}
+		if last != 0 {
+			if err := db.w8(last+next, 0); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if merges <= 1 {
+			return off, last, nil
+		}
+	}
+}
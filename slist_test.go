@@ -5,6 +5,8 @@
 package db
 
 import (
+	"bytes"
+	"sort"
 	"testing"
 
 	"github.com/cznic/file"
@@ -296,6 +298,475 @@ func TestSListRemoveToEnd(t *testing.T) {
 	}
 }
 
+func sListHeadVerify(t testing.TB, h SListHead, out []int) {
+	n, err := h.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := n, int64(len(out)); g != e {
+		t.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	off, err := h.Front()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	for i, ev := range out {
+		l, err := h.OpenSList(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := h.r8(l.DataOff())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := v, int64(ev); g != e {
+			t.Fatalf("list item #%v, got %v, expected %v", i, g, e)
+		}
+
+		last = off
+		if off, err = l.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if off != 0 {
+		t.Fatalf("unexpected list item %#x", off)
+	}
+
+	back, err := h.Back()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := back, last; g != e {
+		t.Fatalf("got back %#x, expected %#x", g, e)
+	}
+}
+
+func testSListHead(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewSListHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	node := func(v int) SList {
+		n, err := db.NewSList(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := n.w8(n.DataOff(), int64(v)); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+	pop := func(n SList, err error) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n.Off == 0 {
+			return -1
+		}
+
+		v, err := n.r8(n.DataOff())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := n.Free(n.Off); err != nil {
+			t.Fatal(err)
+		}
+
+		return int(v)
+	}
+
+	sListHeadVerify(t, h, nil)
+	if g, e := pop(h.PopFront()), -1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := pop(h.PopBack()), -1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := h.PushBack(node(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{20})
+	if err := h.PushFront(node(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{10, 20})
+	if err := h.PushBack(node(40)); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{10, 20, 40})
+	first, err := h.Front()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.OpenSList(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := l.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.InsertAfter(node(30), second); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{10, 20, 30, 40})
+	back, err := h.Back()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.InsertAfter(node(50), back); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{10, 20, 30, 40, 50})
+	if l, err = h.OpenSList(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Remove(l); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{10, 30, 40, 50})
+	if g, e := pop(h.PopBack()), 50; g != e {
+		t.Fatal(g, e)
+	}
+
+	sListHeadVerify(t, h, []int{10, 30, 40})
+	if g, e := pop(h.PopFront()), 10; g != e {
+		t.Fatal(g, e)
+	}
+
+	sListHeadVerify(t, h, []int{30, 40})
+	if back, err = h.Back(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = h.OpenSList(back); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Remove(l); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{30})
+	if g, e := pop(h.PopBack()), 30; g != e {
+		t.Fatal(g, e)
+	}
+
+	sListHeadVerify(t, h, nil)
+	for i := 0; i < 10; i++ {
+		if err := h.PushBack(node(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, err = db.OpenSListHead(h.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	sListHeadVerify(t, h, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+}
+
+func TestSListHead(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSListHead(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testSListData(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	h, err := db.NewSListHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const N = 5
+	payload := func(i, sz int) []byte {
+		b := make([]byte, sz)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+		return b
+	}
+	sizes := make([]int, N)
+	check := func() {
+		off, err := h.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var last int64
+		for i := 0; i < N; i++ {
+			l, err := h.OpenSList(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := l.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := b, payload(i, sizes[i]); !bytes.Equal(g, e) {
+				t.Fatalf("node #%v: got %v, expected %v", i, g, e)
+			}
+
+			last = off
+			if off, err = l.Next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if off != 0 {
+			t.Fatalf("unexpected list item %#x", off)
+		}
+
+		back, err := h.Back()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if back != last {
+			t.Fatalf("got back %#x, expected %#x", back, last)
+		}
+	}
+
+	// Writing the links or the payload of the new node fails.
+	for w := 0; w < 4; w++ {
+		if _, err := (&DB{&ioLimit{db, -1, w}}).NewSListData(payload(1, 1)); err == nil {
+			t.Fatal(w)
+		}
+	}
+	for i := 0; i < N; i++ {
+		n, err := db.NewSListData(payload(i, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.PushBack(n); err != nil {
+			t.Fatal(err)
+		}
+
+		sizes[i] = i
+	}
+	check()
+	for _, sz := range []int{3, 100, 10, 0, 1000} {
+		for i := 0; i < N; i++ {
+			off, err := h.Front()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := h.OpenSList(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for j := 0; j < i; j++ {
+				if l.Off, err = l.Next(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := h.SetData(l, payload(i, sz+i)); err != nil {
+				t.Fatal(err)
+			}
+
+			sizes[i] = sz + i
+			check()
+		}
+	}
+}
+
+func TestSListData(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSListData(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testSListSort(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	x := rng()
+	less := func(aoff, boff int64) (bool, error) {
+		a, err := db.r8(aoff + oSListData)
+		if err != nil {
+			return false, err
+		}
+
+		b, err := db.r8(boff + oSListData)
+		if err != nil {
+			return false, err
+		}
+
+		return a/1000 < b/1000, nil
+	}
+	for _, n := range []int{0, 1, 2, 3, 17, 999} {
+		h, err := db.NewSListHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e []int
+		for i := 0; i < n; i++ {
+			v := int(uint32(x.Next())%16)*1000 + i
+			l, err := db.NewSList(8)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := l.w8(l.DataOff(), int64(v)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.PushBack(l); err != nil {
+				t.Fatal(err)
+			}
+
+			e = append(e, v)
+		}
+		sort.Ints(e)
+		if err := h.Sort(less); err != nil {
+			t.Fatal(err)
+		}
+
+		sListHeadVerify(t, h, e)
+		if n != 0 {
+			for i := range e {
+				e[i] = e[i]%1000*1000 + e[i]/1000
+			}
+			sort.Ints(e)
+			for i := range e {
+				e[i] = e[i]%1000*1000 + e[i]/1000
+			}
+			first, err := h.Front()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := h.OpenSList(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if l, err = l.Sort(func(aoff, boff int64) (bool, error) {
+				a, err := db.r8(aoff + oSListData)
+				if err != nil {
+					return false, err
+				}
+
+				b, err := db.r8(boff + oSListData)
+				if err != nil {
+					return false, err
+				}
+
+				return a%1000 < b%1000, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.setFront(l.Off); err != nil {
+				t.Fatal(err)
+			}
+
+			last := l.Off
+			for {
+				next, err := db.OpenSList(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				off, err := next.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if off == 0 {
+					break
+				}
+
+				last = off
+			}
+			if err := h.setBack(last); err != nil {
+				t.Fatal(err)
+			}
+
+			sListHeadVerify(t, h, e)
+		}
+
+		if err := h.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Free(h.Off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSListSort(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSListSort(t, v.f) }) {
+			break
+		}
+	}
+}
+
 func benchmarkNewSList(b *testing.B, ts func(t testing.TB) (file.File, func()), dataSize int64) {
 	db, f := tmpDB(b, ts)
 
@@ -0,0 +1,486 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	oSortedSetSzMember = 8 * iota // int64		0	8
+	oSortedSetMembers             // int64		8	8
+	oSortedSetScores              // int64		16	8
+
+	szSortedSet
+)
+
+// SortedSet is a persistent set of fixed size members ordered by their
+// float64 scores, similar to the Redis sorted sets. It maintains two BTrees,
+// one keyed by member with the score as a value and one keyed by the score
+// and member, which defines the order of the set. Members with equal scores
+// are ordered lexicographically.
+//
+// Changing a score first inserts the new score key, then updates the member
+// and only then deletes the old score key. If a step fails, the steps already
+// done are undone on a best effort basis, so the indexes disagree only when
+// undoing fails as well. SortedSet never calls Sync.
+//
+// The BTrees keep no per subtree counts, so Rank and RangeByRank are linear in
+// the number of data pages preceding the ranked member.
+type SortedSet struct {
+	*DB
+	Off      int64 // Location in the database.
+	SzMember int64 // The szMember argument of NewSortedSet.
+	members  *BTree
+	scores   *BTree
+}
+
+// NewSortedSet allocates and returns a new, empty SortedSet or an error, if
+// any. The szMember argument is the size of the set members, it must be
+// positive.
+func (db *DB) NewSortedSet(szMember int64) (*SortedSet, error) {
+	if szMember <= 0 {
+		panic(fmt.Errorf("%T.NewSortedSet: invalid argument", db))
+	}
+
+	off, err := db.Calloc(szSortedSet)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := db.NewBTree(0, 0, szMember, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	scores, err := db.NewBTree(0, 0, 8+szMember, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSortedSetSzMember, szMember); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSortedSetMembers, members.Off); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oSortedSetScores, scores.Off); err != nil {
+		return nil, err
+	}
+
+	return &SortedSet{DB: db, Off: off, SzMember: szMember, members: members, scores: scores}, nil
+}
+
+// OpenSortedSet opens and returns an existing SortedSet or an error, if any.
+func (db *DB) OpenSortedSet(off int64) (*SortedSet, error) {
+	szMember, err := db.r8(off + oSortedSetSzMember)
+	if err != nil {
+		return nil, err
+	}
+
+	if szMember <= 0 {
+		return nil, fmt.Errorf("%T.OpenSortedSet: corrupted database", db)
+	}
+
+	members, err := db.r8(off + oSortedSetMembers)
+	if err != nil {
+		return nil, err
+	}
+
+	scores, err := db.r8(off + oSortedSetScores)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := db.OpenBTree(members)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := db.OpenBTree(scores)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SortedSet{DB: db, Off: off, SzMember: szMember, members: m, scores: t}, nil
+}
+
+// encScore returns the encoding of score, which collates as score. Negative
+// zero is encoded as zero.
+func encScore(score float64) uint64 {
+	if score == 0 {
+		score = 0
+	}
+	n := math.Float64bits(score)
+	if n&(1<<63) != 0 {
+		return ^n
+	}
+
+	return n | 1<<63
+}
+
+// decScore is the inverse of encScore.
+func decScore(n uint64) float64 {
+	if n&(1<<63) != 0 {
+		return math.Float64frombits(n &^ (1 << 63))
+	}
+
+	return math.Float64frombits(^n)
+}
+
+func (s *SortedSet) check(member []byte, score float64, method string) {
+	if int64(len(member)) != s.SzMember || math.IsNaN(score) {
+		panic(fmt.Errorf("%T.%s: invalid argument", s, method))
+	}
+}
+
+func (s *SortedSet) cmp(k []byte) func(koff int64) (int, error) { return keyCmp(s, k) }
+
+func (s *SortedSet) scoreKey(member []byte, score float64) []byte {
+	k := make([]byte, 8+len(member))
+	enc8(k, encScore(score))
+	copy(k[8:], member)
+	return k
+}
+
+// score returns the score of member, if it is in s.
+func (s *SortedSet) score(member []byte) (float64, bool, error) {
+	voff, ok, err := s.members.Get(s.cmp(member))
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	n, err := s.r8(voff)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return decScore(uint64(n)), true, nil
+}
+
+// set sets the score of member to score. The old argument is the existing
+// score of member, if ok is true.
+func (s *SortedSet) set(member []byte, score, old float64, ok bool) error {
+	if ok && old == score {
+		return nil
+	}
+
+	k := s.scoreKey(member, score)
+	koff, _, err := s.scores.Set(s.cmp(k), nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.WriteAt(k, koff); err != nil {
+		if s.scores.discard(s.cmp(k), koff) == nil {
+			s.scores.incLen(-1)
+		}
+		return err
+	}
+
+	if err := s.setMember(member, score, ok); err != nil {
+		s.scores.Delete(s.cmp(k), nil)
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	if _, err := s.scores.Delete(s.cmp(s.scoreKey(member, old)), nil); err != nil {
+		if s.setMember(member, old, true) == nil {
+			s.scores.Delete(s.cmp(k), nil)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// setMember sets the score of member in the member index. The ok argument
+// reports member is already in the index, a new member entry is deleted
+// again on error.
+func (s *SortedSet) setMember(member []byte, score float64, ok bool) error {
+	koff, voff, err := s.members.Set(s.cmp(member), nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if _, err := s.WriteAt(member, koff); err != nil {
+			if s.members.discard(s.cmp(member), koff) == nil {
+				s.members.incLen(-1)
+			}
+			return err
+		}
+	}
+
+	if err := s.w8(voff, int64(encScore(score))); err != nil {
+		if !ok {
+			s.members.Delete(s.cmp(member), nil)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Add adds member with score to s or updates the score of an existing member.
+// It returns a boolean value indicating the member was added or an error, if
+// any. The length of member must be equal to SzMember and score must not be a
+// NaN.
+func (s *SortedSet) Add(member []byte, score float64) (bool, error) {
+	s.check(member, score, "Add")
+	old, ok, err := s.score(member)
+	if err != nil {
+		return false, err
+	}
+
+	return !ok, s.set(member, score, old, ok)
+}
+
+// Clear removes all members of s.
+func (s *SortedSet) Clear() error {
+	if err := s.members.Clear(nil); err != nil {
+		return err
+	}
+
+	return s.scores.Clear(nil)
+}
+
+// Drop frees all space used by s.
+func (s *SortedSet) Drop() error {
+	if err := s.members.Remove(nil); err != nil {
+		return err
+	}
+
+	if err := s.scores.Remove(nil); err != nil {
+		return err
+	}
+
+	if err := s.Free(s.Off); err != nil {
+		return err
+	}
+
+	s.Off = 0
+	return nil
+}
+
+// IncrBy adds delta to the score of member and returns the new score or an
+// error, if any. A member not in s is added with score delta. The length of
+// member must be equal to SzMember and delta must not be a NaN.
+func (s *SortedSet) IncrBy(member []byte, delta float64) (float64, error) {
+	s.check(member, delta, "IncrBy")
+	old, ok, err := s.score(member)
+	if err != nil {
+		return 0, err
+	}
+
+	score := old + delta
+	if math.IsNaN(score) {
+		return 0, fmt.Errorf("%T.IncrBy: resulting score is not a number", s)
+	}
+
+	return score, s.set(member, score, old, ok)
+}
+
+// Len returns the number of members in s or an error, if any.
+func (s *SortedSet) Len() (int64, error) { return s.members.Len() }
+
+// RangeByRank returns a cursor enumerating the members of s with ranks in
+// [start, stop) in ascending order of their scores or an error, if any. The
+// rank of the member with the lowest score is zero. The range is clipped to
+// the bounds of s.
+//
+// Locating start walks the data pages of the score index from the first one,
+// so the cost is linear in the number of pages preceding start.
+func (s *SortedSet) RangeByRank(start, stop int64) (*SortedSetCursor, error) {
+	if start < 0 {
+		start = 0
+	}
+
+	n, err := s.Len()
+	if err != nil {
+		return nil, err
+	}
+
+	if stop > n {
+		stop = n
+	}
+
+	if start >= stop {
+		return &SortedSetCursor{}, nil
+	}
+
+	p, err := s.scores.first()
+	if err != nil {
+		return nil, err
+	}
+
+	d := s.scores.openDPage(p)
+	for i := start; ; {
+		dc, err := s.scores.len(d)
+		if err != nil {
+			return nil, err
+		}
+
+		if i < int64(dc) {
+			return &SortedSetCursor{s: s, c: s.scores.newEnumerator(d, dc, int(i), true), n: stop - start}, nil
+		}
+
+		i -= int64(dc)
+		if d, err = s.scores.next(d); err != nil {
+			return nil, err
+		}
+
+		if d == 0 {
+			return nil, fmt.Errorf("%T.RangeByRank: corrupted database", s)
+		}
+	}
+}
+
+// RangeByScore returns a cursor enumerating the members of s with scores in
+// [min, max] in ascending order of their scores or an error, if any.
+func (s *SortedSet) RangeByScore(min, max float64) (*SortedSetCursor, error) {
+	if math.IsNaN(min) || math.IsNaN(max) {
+		panic(fmt.Errorf("%T.RangeByScore: invalid argument", s))
+	}
+
+	if min > max {
+		return &SortedSetCursor{}, nil
+	}
+
+	lo := encScore(min)
+	c, _, err := s.scores.Seek(func(koff int64) (int, error) {
+		n, err := s.r8(koff)
+		if err != nil {
+			return 0, err
+		}
+
+		if lo <= uint64(n) {
+			return -1, nil
+		}
+
+		return 1, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SortedSetCursor{s: s, c: c, n: -1, max: encScore(max)}, nil
+}
+
+// Rank returns the rank of member, zero for the member with the lowest score,
+// and a boolean value indicating member is in s or an error, if any. The
+// length of member must be equal to SzMember.
+//
+// Rank sums the item counts of the score index data pages preceding member,
+// so its cost is linear in their number.
+func (s *SortedSet) Rank(member []byte) (int64, bool, error) {
+	s.check(member, 0, "Rank")
+	score, ok, err := s.score(member)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	c, ok, err := s.scores.Seek(s.cmp(s.scoreKey(member, score)))
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !ok {
+		return 0, false, fmt.Errorf("%T.Rank: corrupted database", s)
+	}
+
+	n := int64(c.i)
+	for d := c.btDPage; ; {
+		if d, err = s.scores.prev(d); err != nil {
+			return 0, false, err
+		}
+
+		if d == 0 {
+			return n, true, nil
+		}
+
+		dc, err := s.scores.len(d)
+		if err != nil {
+			return 0, false, err
+		}
+
+		n += int64(dc)
+	}
+}
+
+// Remove removes member from s. It returns a boolean value indicating member
+// was in s or an error, if any. The length of member must be equal to
+// SzMember.
+func (s *SortedSet) Remove(member []byte) (bool, error) {
+	s.check(member, 0, "Remove")
+	score, ok, err := s.score(member)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if _, err := s.scores.Delete(s.cmp(s.scoreKey(member, score)), nil); err != nil {
+		return false, err
+	}
+
+	return s.members.Delete(s.cmp(member), nil)
+}
+
+// Score returns the score of member and a boolean value indicating member is
+// in s or an error, if any. The length of member must be equal to SzMember.
+func (s *SortedSet) Score(member []byte) (float64, bool, error) {
+	s.check(member, 0, "Score")
+	return s.score(member)
+}
+
+// SortedSetCursor provides enumerating SortedSet members.
+type SortedSetCursor struct {
+	Member []byte  // Not valid before calling Next.
+	Score  float64 // Not valid before calling Next.
+	c      *BTreeCursor
+	err    error
+	max    uint64
+	n      int64 // Remaining members or -1 if bounded by max.
+	s      *SortedSet
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *SortedSetCursor) Err() error { return c.err }
+
+// Next moves the cursor to the next member and sets the Member and Score
+// fields accordingly. It returns true on success, or false if there is no
+// next member or an error happened while moving the cursor. Err should be
+// consulted to distinguish between the two cases.
+func (c *SortedSetCursor) Next() bool {
+	if c.err != nil || c.c == nil || c.n == 0 || !c.c.Next() {
+		if c.c != nil && c.err == nil {
+			c.err = c.c.Err()
+		}
+		return false
+	}
+
+	k := make([]byte, 8+c.s.SzMember)
+	if _, c.err = c.s.ReadAt(k, c.c.K); c.err != nil {
+		return false
+	}
+
+	n := dec8(k)
+	if c.n < 0 && n > c.max {
+		c.c = nil
+		return false
+	}
+
+	if c.n > 0 {
+		c.n--
+	}
+	c.Member = k[8:]
+	c.Score = decScore(n)
+	return true
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+type sortedSetItem struct {
+	member []byte
+	score  float64
+}
+
+func sortedSetItems(m map[string]float64) []sortedSetItem {
+	var a []sortedSetItem
+	for k, v := range m {
+		a = append(a, sortedSetItem{[]byte(k), v})
+	}
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].score != a[j].score {
+			return a[i].score < a[j].score
+		}
+
+		return bytes.Compare(a[i].member, a[j].member) < 0
+	})
+	return a
+}
+
+func (c *SortedSetCursor) verify(tb testing.TB, e []sortedSetItem) {
+	i := 0
+	for ; c.Next(); i++ {
+		if i >= len(e) || !bytes.Equal(c.Member, e[i].member) || c.Score != e[i].score {
+			tb.Fatalf("item %v: got %x %v", i, c.Member, c.Score)
+		}
+	}
+	if err := c.Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if i != len(e) {
+		tb.Fatalf("got %v items, expected %v", i, len(e))
+	}
+}
+
+func (s *SortedSet) verify(tb testing.TB, m map[string]float64) {
+	n, err := s.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	if n, err = s.scores.Len(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got score index len %v, expected %v", g, e)
+	}
+
+	e := sortedSetItems(m)
+	c, err := s.RangeByRank(0, n)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	c.verify(tb, e)
+	for i, v := range e {
+		if i%7 != 0 {
+			continue
+		}
+
+		r, ok, err := s.Rank(v.member)
+		if err != nil || !ok || r != int64(i) {
+			tb.Fatalf("rank of %x: got %v %v %v, expected %v", v.member, r, ok, err, i)
+		}
+	}
+}
+
+func testSortedSet(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	s, err := db.NewSortedSet(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := s.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[string]float64{}
+	x := rng()
+	const N = 1 << 12
+	for i := 0; i < 4*N; i++ {
+		k := batchKey(int(uint32(x.Next()) % N))
+		score := float64(int(uint32(x.Next())%200)-100) / 4
+		switch op := uint32(x.Next()) % 8; {
+		case op < 4:
+			ok, err := s.Add(k, score)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok2 := m[string(k)]; ok == ok2 {
+				t.Fatal(i, ok)
+			}
+
+			m[string(k)] = score
+		case op < 6:
+			n, err := s.IncrBy(k, score)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m[string(k)] += score
+			if g, e := n, m[string(k)]; g != e {
+				t.Fatal(i, g, e)
+			}
+		default:
+			ok, err := s.Remove(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok2 := m[string(k)]; ok != ok2 {
+				t.Fatal(i, ok)
+			}
+
+			delete(m, string(k))
+		}
+		if i%N == 0 {
+			s.verify(t, m)
+		}
+	}
+	if s, err = db.OpenSortedSet(s.Off); err != nil {
+		t.Fatal(err)
+	}
+
+	s.verify(t, m)
+	e := sortedSetItems(m)
+	for _, v := range []struct{ start, stop int64 }{
+		{-5, 3},
+		{10, 20},
+		{int64(len(e)) - 3, int64(len(e)) + 10},
+		{7, 7},
+	} {
+		c, err := s.RangeByRank(v.start, v.stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lo, hi := v.start, v.stop
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(e)) {
+			hi = int64(len(e))
+		}
+		c.verify(t, e[lo:hi])
+	}
+
+	for _, v := range []struct{ min, max float64 }{
+		{-1000, 1000},
+		{-3, 3},
+		{0, 0},
+		{2.25, 2.25},
+		{5, -5},
+	} {
+		c, err := s.RangeByScore(v.min, v.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r []sortedSetItem
+		for _, w := range e {
+			if w.score >= v.min && w.score <= v.max {
+				r = append(r, w)
+			}
+		}
+		c.verify(t, r)
+	}
+
+	if _, ok, err := s.Rank(batchKey(N)); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.verify(t, nil)
+}
+
+func TestSortedSet(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSortedSet(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testSortedSetError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	s, err := db.NewSortedSet(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := s.Drop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Adding to a full page of one of the indexes fails to allocate.
+	x, err := (&DB{&allocLimit{db, 0}}).OpenSortedSet(s.Off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := map[string]float64{}
+	const N = 1000
+	var errs int
+	for i := 0; i < N; i++ {
+		k := batchKey(N - i)
+		score := float64(i % 10)
+		if _, err := x.Add(k, score); err != nil {
+			errs++
+			s.verify(t, m)
+			if _, err := s.Add(k, score); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		m[string(k)] = score
+		if _, err := x.Add(k, score+100); err != nil {
+			errs++
+			s.verify(t, m)
+			continue
+		}
+
+		m[string(k)] = score + 100
+	}
+	s.verify(t, m)
+	if errs == 0 {
+		t.Fatal("no allocation failed")
+	}
+}
+
+func TestSortedSetError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testSortedSetError(t, v.f) }) {
+			break
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	oTablePrimary = 8 * iota // int64		0	8
+	oTableIndexes            // int64		8	8
+	oTableIndex              // [Indexes]int64	16	8*Indexes
+)
+
+// TableIndex defines a secondary index of a Table.
+type TableIndex struct {
+	Name  string                  // Name of the index, must be unique and not empty.
+	SzKey int64                   // Size of the index keys.
+	Key   func(rec []byte) []byte // Returns the index key, of size SzKey, of rec.
+}
+
+// TableLayout defines the records of a Table, its primary key and its
+// secondary indexes. Only the number and key sizes of the indexes are stored
+// in the database, the key extractors must be provided whenever the Table is
+// opened.
+type TableLayout struct {
+	SzKey   int64                   // Size of the primary keys.
+	Key     func(rec []byte) []byte // Returns the primary key, of size SzKey, of rec.
+	Indexes []TableIndex
+}
+
+func (l *TableLayout) check() {
+	if l.SzKey <= 0 || l.Key == nil {
+		panic(fmt.Errorf("%T: invalid primary key", l))
+	}
+
+	m := map[string]bool{}
+	for _, v := range l.Indexes {
+		if v.Name == "" || m[v.Name] || v.SzKey <= 0 || v.Key == nil {
+			panic(fmt.Errorf("%T: invalid index %q", l, v.Name))
+		}
+
+		m[v.Name] = true
+	}
+}
+
+// Table is a persistent collection of variable sized records identified by a
+// primary key. The records are values of an owned BTree keyed by the primary
+// key. Every secondary index is a BTree keyed by the index key followed by the
+// primary key, so the index keys need not be unique.
+//
+// Insert and Update extract and check all primary and index keys of a record
+// before the first write, so a key of a wrong size panics with the Table
+// unchanged. When the Storage returns an error, Insert deletes the primary
+// item and the index items it already added. Table never calls Sync and
+// Update does not undo the indexes already updated, the secondary indexes may
+// then disagree with the primary one.
+type Table struct {
+	*DB
+	Off     int64       // Location in the database.
+	Layout  TableLayout // The layout argument of NewTable or OpenTable.
+	indexes []*BTree
+	primary *BTree
+}
+
+// NewTable allocates and returns a new, empty Table or an error, if any.
+func (db *DB) NewTable(layout TableLayout) (*Table, error) {
+	layout.check()
+	off, err := db.Calloc(oTableIndex + 8*int64(len(layout.Indexes)))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Table{DB: db, Off: off, Layout: layout}
+	if t.primary, err = db.NewOwnedBTree(0, 0, layout.SzKey); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oTablePrimary, t.primary.Off); err != nil {
+		return nil, err
+	}
+
+	if err := db.w8(off+oTableIndexes, int64(len(layout.Indexes))); err != nil {
+		return nil, err
+	}
+
+	for i, v := range layout.Indexes {
+		x, err := db.NewBTree(0, 0, v.SzKey+layout.SzKey, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := db.w8(off+oTableIndex+8*int64(i), x.Off); err != nil {
+			return nil, err
+		}
+
+		t.indexes = append(t.indexes, x)
+	}
+	return t, nil
+}
+
+// OpenTable opens and returns an existing Table or an error, if any. The
+// layout must define the same number of indexes, in the same order and with
+// the same key sizes as the one used to create the Table.
+func (db *DB) OpenTable(off int64, layout TableLayout) (*Table, error) {
+	layout.check()
+	n, err := db.r8(off + oTableIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != int64(len(layout.Indexes)) {
+		return nil, fmt.Errorf("%T.OpenTable: layout has %v indexes, table has %v", db, len(layout.Indexes), n)
+	}
+
+	p, err := db.r8(off + oTablePrimary)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Table{DB: db, Off: off, Layout: layout}
+	if t.primary, err = db.OpenBTree(p); err != nil {
+		return nil, err
+	}
+
+	if t.primary.SzKey != layout.SzKey || !t.primary.Owned() {
+		return nil, fmt.Errorf("%T.OpenTable: primary key size mismatch", db)
+	}
+
+	for i, v := range layout.Indexes {
+		p, err := db.r8(off + oTableIndex + 8*int64(i))
+		if err != nil {
+			return nil, err
+		}
+
+		x, err := db.OpenBTree(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if x.SzKey != v.SzKey+layout.SzKey {
+			return nil, fmt.Errorf("%T.OpenTable: index %q key size mismatch", db, v.Name)
+		}
+
+		t.indexes = append(t.indexes, x)
+	}
+	return t, nil
+}
+
+func (t *Table) key(rec []byte) []byte {
+	k := t.Layout.Key(rec)
+	if int64(len(k)) != t.Layout.SzKey {
+		panic(fmt.Errorf("%T: invalid primary key of record", t))
+	}
+
+	return k
+}
+
+// indexKey returns the key of the i-th secondary index item of rec with
+// primary key pk.
+func (t *Table) indexKey(i int, rec, pk []byte) []byte {
+	x := &t.Layout.Indexes[i]
+	k := x.Key(rec)
+	if int64(len(k)) != x.SzKey {
+		panic(fmt.Errorf("%T: invalid key of index %q", t, x.Name))
+	}
+
+	return append(append(make([]byte, 0, len(k)+len(pk)), k...), pk...)
+}
+
+// indexKeys returns the keys of all secondary index items of rec with primary
+// key pk.
+func (t *Table) indexKeys(rec, pk []byte) [][]byte {
+	r := make([][]byte, len(t.indexes))
+	for i := range r {
+		r[i] = t.indexKey(i, rec, pk)
+	}
+	return r
+}
+
+func (t *Table) addIndexKey(i int, k []byte) error {
+	x := t.indexes[i]
+	koff, _, err := x.Set(keyCmp(t, k), nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.WriteAt(k, koff); err != nil {
+		if x.discard(keyCmp(t, k), koff) == nil {
+			x.incLen(-1)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (t *Table) get(pk []byte) (int64, []byte, bool, error) {
+	voff, ok, err := t.primary.Get(keyCmp(t, pk))
+	if err != nil || !ok {
+		return 0, nil, false, err
+	}
+
+	rec, err := t.primary.Value(voff)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	return voff, rec, true, nil
+}
+
+// Clear deletes all records of t.
+func (t *Table) Clear() error {
+	for _, v := range t.indexes {
+		if err := v.Clear(nil); err != nil {
+			return err
+		}
+	}
+
+	return t.primary.Clear(nil)
+}
+
+// Delete deletes the record with primary key pk. It returns a boolean value
+// indicating the record was found or an error, if any.
+func (t *Table) Delete(pk []byte) (bool, error) {
+	if int64(len(pk)) != t.Layout.SzKey {
+		panic(fmt.Errorf("%T.Delete: invalid argument", t))
+	}
+
+	_, rec, ok, err := t.get(pk)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	for i, v := range t.indexes {
+		if _, err := v.Delete(keyCmp(t, t.indexKey(i, rec, pk)), nil); err != nil {
+			return false, err
+		}
+	}
+
+	return t.primary.Delete(keyCmp(t, pk), nil)
+}
+
+// Get returns a copy of the record with primary key pk and a boolean value
+// indicating the record was found or an error, if any.
+func (t *Table) Get(pk []byte) ([]byte, bool, error) {
+	if int64(len(pk)) != t.Layout.SzKey {
+		panic(fmt.Errorf("%T.Get: invalid argument", t))
+	}
+
+	_, rec, ok, err := t.get(pk)
+	return rec, ok, err
+}
+
+// Insert adds rec to t. It returns a boolean value indicating the record was
+// added or an error, if any. A record with the same primary key as an existing
+// one is not added.
+func (t *Table) Insert(rec []byte) (bool, error) {
+	pk := t.key(rec)
+	keys := t.indexKeys(rec, pk)
+	koff, voff, ok, err := t.primary.SetIfAbsent(keyCmp(t, pk))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if _, err := t.WriteAt(pk, koff); err != nil {
+		if t.primary.discard(keyCmp(t, pk), koff) == nil {
+			t.primary.incLen(-1)
+		}
+		return false, err
+	}
+
+	if err := t.primary.WriteValue(voff, rec); err != nil {
+		t.primary.Delete(keyCmp(t, pk), nil)
+		return false, err
+	}
+
+	for i, k := range keys {
+		if err := t.addIndexKey(i, k); err != nil {
+			for j, k := range keys[:i] {
+				t.indexes[j].Delete(keyCmp(t, k), nil)
+			}
+			t.primary.Delete(keyCmp(t, pk), nil)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Len returns the number of records in t or an error, if any.
+func (t *Table) Len() (int64, error) { return t.primary.Len() }
+
+// Remove frees all space used by t.
+func (t *Table) Remove() error {
+	for _, v := range t.indexes {
+		if err := v.Remove(nil); err != nil {
+			return err
+		}
+	}
+
+	if err := t.primary.Remove(nil); err != nil {
+		return err
+	}
+
+	if err := t.Free(t.Off); err != nil {
+		return err
+	}
+
+	t.Off = 0
+	return nil
+}
+
+// Seek returns a cursor enumerating the records of t in the order of the
+// named index, starting at the first record with an index key collating
+// after or equal to key, or an error, if any. The empty name denotes the
+// primary key. The key may be a prefix of the index keys, a nil key starts
+// at the first record.
+func (t *Table) Seek(index string, key []byte) (*TableCursor, error) {
+	x, sz := t.primary, t.Layout.SzKey
+	if index != "" {
+		x = nil
+		for i, v := range t.Layout.Indexes {
+			if v.Name == index {
+				x, sz = t.indexes[i], v.SzKey
+				break
+			}
+		}
+		if x == nil {
+			panic(fmt.Errorf("%T.Seek: unknown index %q", t, index))
+		}
+	}
+
+	if int64(len(key)) > sz {
+		panic(fmt.Errorf("%T.Seek: invalid argument", t))
+	}
+
+	c, _, err := x.Seek(func(koff int64) (int, error) {
+		switch c, err := keyCmp(t, key)(koff); {
+		case err != nil:
+			return 0, err
+		case c == 0:
+			return -1, nil
+		default:
+			return c, nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TableCursor{c: c, szKey: sz, t: t, x: x}, nil
+}
+
+// Update replaces the record having the primary key of rec with rec and
+// updates the secondary index items whose keys changed. It returns a boolean
+// value indicating the record was found or an error, if any.
+func (t *Table) Update(rec []byte) (bool, error) {
+	pk := t.key(rec)
+	keys := t.indexKeys(rec, pk)
+	voff, old, ok, err := t.get(pk)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	oldKeys := t.indexKeys(old, pk)
+	for i, v := range t.indexes {
+		k, nk := oldKeys[i], keys[i]
+		if bytes.Equal(k, nk) {
+			continue
+		}
+
+		if _, err := v.Delete(keyCmp(t, k), nil); err != nil {
+			return false, err
+		}
+
+		if err := t.addIndexKey(i, nk); err != nil {
+			return false, err
+		}
+	}
+
+	return true, t.primary.WriteValue(voff, rec)
+}
+
+// TableCursor provides enumerating Table records.
+type TableCursor struct {
+	Key    []byte // Index key of Record. Not valid before calling Next.
+	Record []byte // Not valid before calling Next.
+	c      *BTreeCursor
+	err    error
+	szKey  int64
+	t      *Table
+	x      *BTree
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *TableCursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.c.Err()
+}
+
+// Next moves the cursor to the next record and sets the Key and Record
+// fields accordingly. It returns true on success, or false if there is no
+// next record or an error happened while moving the cursor. Err should be
+// consulted to distinguish between the two cases.
+func (c *TableCursor) Next() bool {
+	if c.err != nil || !c.c.Next() {
+		return false
+	}
+
+	k := make([]byte, c.x.SzKey)
+	if _, c.err = c.t.ReadAt(k, c.c.K); c.err != nil {
+		return false
+	}
+
+	if c.x == c.t.primary {
+		if c.Record, c.err = c.x.Value(c.c.V); c.err != nil {
+			return false
+		}
+
+		c.Key = k
+		return true
+	}
+
+	var ok bool
+	if _, c.Record, ok, c.err = c.t.get(k[c.szKey:]); c.err != nil {
+		return false
+	}
+
+	if !ok {
+		c.err = fmt.Errorf("%T.Next: corrupted database", c)
+		return false
+	}
+
+	c.Key = k[:c.szKey]
+	return true
+}
@@ -0,0 +1,314 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/cznic/file"
+)
+
+// Test records are [id 4][group 4][data].
+var tableTestLayout = TableLayout{
+	SzKey: 4,
+	Key:   func(rec []byte) []byte { return rec[:4] },
+	Indexes: []TableIndex{
+		{Name: "group", SzKey: 4, Key: func(rec []byte) []byte { return rec[4:8] }},
+		{Name: "len", SzKey: 1, Key: func(rec []byte) []byte { return []byte{byte(len(rec))} }},
+	},
+}
+
+func tableRecord(id, group, n int) []byte {
+	b := append(batchKey(id), batchKey(group)...)
+	for i := 0; i < n; i++ {
+		b = append(b, byte(id+i))
+	}
+	return b
+}
+
+func (c *TableCursor) verify(tb testing.TB, e [][]byte) {
+	i := 0
+	for ; c.Next(); i++ {
+		if i >= len(e) || !bytes.Equal(c.Record, e[i]) {
+			tb.Fatalf("record %v: got %x", i, c.Record)
+		}
+	}
+	if err := c.Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	if i != len(e) {
+		tb.Fatalf("got %v records, expected %v", i, len(e))
+	}
+}
+
+func (t *Table) verify(tb testing.TB, m map[string][]byte) {
+	n, err := t.Len()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if g, e := n, int64(len(m)); g != e {
+		tb.Fatalf("got len %v, expected %v", g, e)
+	}
+
+	var e [][]byte
+	for _, v := range m {
+		e = append(e, v)
+	}
+	for _, name := range []string{"", "group", "len"} {
+		key := t.Layout.Key
+		for _, v := range t.Layout.Indexes {
+			if v.Name == name {
+				k := v.Key
+				key = func(rec []byte) []byte {
+					b := k(rec)
+					return append(b[:len(b):len(b)], rec[:4]...)
+				}
+			}
+		}
+		sort.Slice(e, func(i, j int) bool { return bytes.Compare(key(e[i]), key(e[j])) < 0 })
+		c, err := t.Seek(name, nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		c.verify(tb, e)
+	}
+}
+
+func testTable(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	tab, err := db.NewTable(tableTestLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := tab.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[string][]byte{}
+	x := rng()
+	const N = 1 << 11
+	for i := 0; i < 4*N; i++ {
+		id := int(uint32(x.Next()) % N)
+		rec := tableRecord(id, int(uint32(x.Next())%16), int(uint32(x.Next())%32))
+		pk := string(rec[:4])
+		switch op := uint32(x.Next()) % 8; {
+		case op < 4:
+			ok, err := tab.Insert(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok2 := m[pk]; ok == ok2 {
+				t.Fatal(i, ok)
+			}
+
+			if ok {
+				m[pk] = rec
+			}
+		case op < 6:
+			ok, err := tab.Update(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok2 := m[pk]; ok != ok2 {
+				t.Fatal(i, ok)
+			}
+
+			if ok {
+				m[pk] = rec
+			}
+		case op < 7:
+			ok, err := tab.Delete([]byte(pk))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok2 := m[pk]; ok != ok2 {
+				t.Fatal(i, ok)
+			}
+
+			delete(m, pk)
+		default:
+			b, ok, err := tab.Get([]byte(pk))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e, ok2 := m[pk]; ok != ok2 || !bytes.Equal(b, e) {
+				t.Fatal(i, ok, b, e)
+			}
+		}
+		if i%N == 0 {
+			tab.verify(t, m)
+		}
+	}
+	if _, err := db.OpenTable(tab.Off, TableLayout{SzKey: 4, Key: tableTestLayout.Key}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if tab, err = db.OpenTable(tab.Off, tableTestLayout); err != nil {
+		t.Fatal(err)
+	}
+
+	tab.verify(t, m)
+	c, err := tab.Seek("group", batchKey(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e [][]byte
+	for _, v := range m {
+		if bytes.Compare(v[4:8], batchKey(7)) >= 0 {
+			e = append(e, v)
+		}
+	}
+	sort.Slice(e, func(i, j int) bool {
+		return bytes.Compare(append(e[i][4:8:8], e[i][:4]...), append(e[j][4:8:8], e[j][:4]...)) < 0
+	})
+	c.verify(t, e)
+
+	if err := tab.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	tab.verify(t, nil)
+}
+
+func TestTable(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testTable(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testTableInvalidKey(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	// The len index key of records longer than 20 bytes is invalid.
+	layout := tableTestLayout
+	layout.Indexes = append([]TableIndex(nil), layout.Indexes...)
+	layout.Indexes[1].Key = func(rec []byte) []byte {
+		if len(rec) > 20 {
+			return nil
+		}
+
+		return []byte{byte(len(rec))}
+	}
+	tab, err := db.NewTable(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := tab.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	mustPanic := func(f func() (bool, error)) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+
+		f()
+	}
+
+	m := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		rec := tableRecord(i, i%3, 5)
+		if ok, err := tab.Insert(rec); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		m[string(rec[:4])] = rec
+	}
+	mustPanic(func() (bool, error) { return tab.Insert(tableRecord(10, 0, 20)) })
+	tab.verify(t, m)
+	mustPanic(func() (bool, error) { return tab.Update(tableRecord(3, 2, 20)) })
+	tab.verify(t, m)
+}
+
+func TestTableInvalidKey(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testTableInvalidKey(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testTableError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	tab, err := db.NewTable(tableTestLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := tab.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	m := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		rec := tableRecord(0x5a5a00+2*i, i%3, 5)
+		if ok, err := tab.Insert(rec); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		m[string(rec[:4])] = rec
+	}
+	for i := 0; i < 20; i++ {
+		rec := tableRecord(0x5a5a00+2*i+1, i%3, 5+i)
+		pk := rec[:4]
+		// Writing the primary key or an index key fails.
+		for _, k := range append([][]byte{pk}, tab.indexKeys(rec, pk)...) {
+			x, err := (&DB{&writeFault{Storage: db, b: k}}).OpenTable(tab.Off, tableTestLayout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := x.Insert(rec); ok || err == nil {
+				t.Fatal(i, ok, err)
+			}
+
+			tab.verify(t, m)
+		}
+		if ok, err := tab.Insert(rec); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+
+		m[string(pk)] = rec
+		tab.verify(t, m)
+	}
+}
+
+func TestTableError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testTableError(t, v.f) }) {
+			break
+		}
+	}
+}
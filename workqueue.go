@@ -0,0 +1,307 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	oWorkQueueReady    = 0                      // DListHead	0	24
+	oWorkQueueInFlight = szDListHead            // int64		24	8
+	oWorkQueueLease    = oWorkQueueInFlight + 8 // int64		32	8
+
+	szWorkQueue = oWorkQueueLease + 8
+)
+
+// Job is a unit of work handed out by WorkQueue.Lease.
+type Job struct {
+	Data     []byte    // A copy of the job data.
+	Deadline time.Time // The lease expires at Deadline.
+	ID       int64     // The job identifier.
+	Lease    int64     // The lease number, unique within the queue.
+}
+
+// WorkQueue is a persistent, at-least-once job queue. Ready jobs are kept in
+// a FIFO list. Leased jobs are kept in a BTree keyed by their lease deadline,
+// lease number and ID until they are acknowledged. When a lease expires
+// before the job is acknowledged, the job is put back to the front of the
+// ready list and will be handed out again under a new lease number.
+//
+// The ready list is a Deque. A job is an item of the Deque and its ID is the
+// offset of the item's DList node, it does not change when the job is
+// re-queued. The offset of an acknowledged job may be
+// reused by a new job.
+//
+// Lease writes the in-flight entry of a job before unlinking it from the ready
+// list and re-queueing links a job before deleting its in-flight entry, so a
+// failing operation does not lose a job, but it may be handed out once more.
+// WorkQueue never calls Sync, see also the Deque documentation.
+type WorkQueue struct {
+	*DB
+	Off int64
+}
+
+// NewWorkQueue returns a newly allocated, empty WorkQueue or an error, if
+// any.
+func (db *DB) NewWorkQueue() (WorkQueue, error) {
+	off, err := db.Calloc(szWorkQueue)
+	if err != nil {
+		return WorkQueue{}, err
+	}
+
+	t, err := db.NewBTree(0, 0, 24, 0)
+	if err != nil {
+		db.Free(off)
+		return WorkQueue{}, err
+	}
+
+	if err := db.w8(off+oWorkQueueInFlight, t.Off); err != nil {
+		t.Remove(nil)
+		db.Free(off)
+		return WorkQueue{}, err
+	}
+
+	return db.OpenWorkQueue(off)
+}
+
+// OpenWorkQueue returns a WorkQueue found at offset off.
+func (db *DB) OpenWorkQueue(off int64) (WorkQueue, error) { return WorkQueue{db, off}, nil }
+
+func (q WorkQueue) deque() Deque { return Deque{q.DB, q.Off + oWorkQueueReady} }
+
+func (q WorkQueue) ready() DListHead { return q.deque().head() }
+
+func (q WorkQueue) inFlight() (*BTree, error) {
+	off, err := q.r8(q.Off + oWorkQueueInFlight)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.OpenBTree(off)
+}
+
+// cmp compares the in-flight key at koff, consisting of the lease deadline,
+// lease number and job ID, to the key made of the arguments.
+func (q WorkQueue) cmp(deadline, lease, id int64) func(koff int64) (int, error) {
+	return func(koff int64) (int, error) {
+		for i, v := range []int64{deadline, lease, id} {
+			n, err := q.r8(koff + 8*int64(i))
+			if err != nil {
+				return 0, err
+			}
+
+			switch {
+			case v < n:
+				return -1, nil
+			case v > n:
+				return 1, nil
+			}
+		}
+		return 0, nil
+	}
+}
+
+// Ack removes the leased job j from q and frees it. It returns false if the
+// lease of j is no longer current, for example when it has expired and the
+// job was re-queued, even if the job was leased again since.
+func (q WorkQueue) Ack(j Job) (bool, error) {
+	t, err := q.inFlight()
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := t.Delete(q.cmp(j.Deadline.UnixNano(), j.Lease, j.ID), nil)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return true, q.Free(j.ID)
+}
+
+// InFlight returns the number of leased, not yet acknowledged jobs.
+func (q WorkQueue) InFlight() (int64, error) {
+	t, err := q.inFlight()
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Len()
+}
+
+// Lease re-queues the jobs with expired leases and then removes up to n jobs
+// from the front of the ready list and leases them for ttl. It does not wait
+// for new jobs, if there are less than n ready jobs, all of them are leased.
+func (q WorkQueue) Lease(n int, ttl time.Duration) ([]Job, error) {
+	return q.lease(time.Now(), n, ttl)
+}
+
+func (q WorkQueue) lease(now time.Time, n int, ttl time.Duration) ([]Job, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%T.Lease: invalid argument", q)
+	}
+
+	if _, err := q.requeue(now); err != nil {
+		return nil, err
+	}
+
+	t, err := q.inFlight()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := now.Add(ttl)
+	dl := deadline.UnixNano()
+	h := q.ready()
+	var r []Job
+	for len(r) < n {
+		off, err := h.Front()
+		if err != nil {
+			return r, err
+		}
+
+		if off == 0 {
+			break
+		}
+
+		l, err := q.OpenDList(off)
+		if err != nil {
+			return r, err
+		}
+
+		b, err := q.deque().read(l)
+		if err != nil {
+			return r, err
+		}
+
+		lease, err := q.r8(q.Off + oWorkQueueLease)
+		if err != nil {
+			return r, err
+		}
+
+		lease++
+		if err := q.w8(q.Off+oWorkQueueLease, lease); err != nil {
+			return r, err
+		}
+
+		cmp := q.cmp(dl, lease, off)
+		koff, _, err := t.Set(cmp, nil)
+		if err != nil {
+			return r, err
+		}
+
+		for i, v := range []int64{dl, lease, off} {
+			if err := q.w8(koff+8*int64(i), v); err != nil {
+				t.Delete(cmp, nil)
+				return r, err
+			}
+		}
+
+		if err := h.Unlink(l); err != nil {
+			t.Delete(cmp, nil)
+			return r, err
+		}
+
+		r = append(r, Job{Data: b, Deadline: deadline, ID: off, Lease: lease})
+	}
+	return r, nil
+}
+
+// Len returns the number of jobs ready to be leased. Jobs with expired leases
+// are not counted until they are re-queued by Lease.
+func (q WorkQueue) Len() (int64, error) { return q.ready().Len() }
+
+// Put appends a copy of data as a new job to the ready list of q and returns
+// the job ID.
+func (q WorkQueue) Put(data []byte) (int64, error) { return q.deque().push(data, false) }
+
+// Remove frees all jobs of q, leased or not, and q itself.
+func (q WorkQueue) Remove() error {
+	if err := q.ready().RemoveAll(); err != nil {
+		return err
+	}
+
+	t, err := q.inFlight()
+	if err != nil {
+		return err
+	}
+
+	if err := t.Remove(func(koff, _ int64) error {
+		id, err := q.r8(koff + 16)
+		if err != nil {
+			return err
+		}
+
+		return q.Free(id)
+	}); err != nil {
+		return err
+	}
+
+	return q.Free(q.Off)
+}
+
+// requeue moves the jobs with leases expired at now back to the front of the
+// ready list, the job with the earliest deadline first. It returns the
+// number of re-queued jobs.
+func (q WorkQueue) requeue(now time.Time) (int, error) {
+	t, err := q.inFlight()
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := t.SeekFirst()
+	if err != nil {
+		return 0, err
+	}
+
+	type item struct{ deadline, lease, id int64 }
+	var a []item
+	limit := now.UnixNano()
+	for c.Next() {
+		d, err := q.r8(c.K)
+		if err != nil {
+			return 0, err
+		}
+
+		if d > limit {
+			break
+		}
+
+		lease, err := q.r8(c.K + 8)
+		if err != nil {
+			return 0, err
+		}
+
+		id, err := q.r8(c.K + 16)
+		if err != nil {
+			return 0, err
+		}
+
+		a = append(a, item{d, lease, id})
+	}
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	h := q.ready()
+	for i := len(a) - 1; i >= 0; i-- {
+		v := a[i]
+		n, err := q.OpenDList(v.id)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := h.PushFront(n); err != nil {
+			return 0, err
+		}
+
+		if _, err := t.Delete(q.cmp(v.deadline, v.lease, v.id), nil); err != nil {
+			h.Unlink(n)
+			return 0, err
+		}
+	}
+	return len(a), nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 The DB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cznic/file"
+)
+
+func testWorkQueue(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	q, err := db.NewWorkQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := q.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	counts := func(ready, inFlight int64) {
+		n, err := q.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := q.InFlight()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != ready || m != inFlight {
+			t.Fatalf("got %v ready, %v in flight, expected %v, %v", n, m, ready, inFlight)
+		}
+	}
+	lease := func(now time.Time, n int, e ...string) []Job {
+		a, err := q.lease(now, n, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(a) != len(e) {
+			t.Fatalf("got %v jobs, expected %v", len(a), len(e))
+		}
+
+		for i, v := range a {
+			if g, e := string(v.Data), e[i]; g != e {
+				t.Fatalf("job #%v: got %q, expected %q", i, g, e)
+			}
+
+			if !v.Deadline.Equal(now.Add(time.Minute)) {
+				t.Fatal(i, v.Deadline)
+			}
+		}
+		return a
+	}
+	ack := func(j Job, e bool) {
+		ok, err := q.Ack(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != e {
+			t.Fatal(j.ID, j.Lease, ok, e)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		if _, err := q.Put([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts(6, 0)
+
+	t0 := time.Unix(1e9, 0)
+	a := lease(t0, 3, "0", "1", "2")
+	counts(3, 3)
+	ack(a[1], true)
+	ack(a[1], false)
+	counts(3, 2)
+
+	t1 := t0.Add(30 * time.Second)
+	b := lease(t1, 2, "3", "4")
+	counts(1, 4)
+
+	// Leases of a[0] and a[2] expire.
+	t2 := t0.Add(time.Minute + time.Second)
+	c := lease(t2, 1, "0")
+	counts(2, 3)
+	if g, e := c[0].ID, a[0].ID; g != e {
+		t.Fatal(g, e)
+	}
+
+	if c[0].Lease == a[0].Lease {
+		t.Fatal(c[0].Lease)
+	}
+
+	// The expired lease must not acknowledge the new one.
+	ack(a[0], false)
+	ack(a[2], false)
+	ack(b[0], true)
+	counts(2, 2)
+
+	// Lease of b[1] expires, c[0] is still leased.
+	t3 := t1.Add(time.Minute + time.Second)
+	d := lease(t3, 10, "4", "2", "5")
+	counts(0, 4)
+
+	// The offset of an acknowledged job may be reused by a new one.
+	ack(d[0], true)
+	if _, err := q.Put([]byte("6")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := lease(t3, 1, "6")
+	ack(d[0], false)
+	ack(e[0], true)
+	counts(0, 3)
+
+	if _, err := q.lease(t3, 1, 0); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestWorkQueue(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testWorkQueue(t, v.f) }) {
+			break
+		}
+	}
+}
+
+func testWorkQueueError(t *testing.T, ts func(t testing.TB) (file.File, func())) {
+	db, f := tmpDB(t, ts)
+
+	defer f()
+
+	q, err := db.NewWorkQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := q.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := q.Put([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Creating the in-flight tree or recording it fails.
+	for _, v := range []Storage{&allocLimit{db, 1}, &ioLimit{db, -1, 4}} {
+		if _, err := (&DB{v}).NewWorkQueue(); err == nil {
+			t.Fatal("unexpected success")
+		}
+	}
+
+	t0 := time.Unix(1e9, 0)
+	// Adding the in-flight entry fails.
+	x, err := (&DB{&allocLimit{db, 0}}).OpenWorkQueue(q.Off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := x.lease(t0, 3, time.Minute); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if n, err := q.Len(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	a, err := q.lease(t0, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range a {
+		if g, e := string(v.Data), fmt.Sprint(i); g != e {
+			t.Fatalf("job #%v: got %q, expected %q", i, g, e)
+		}
+	}
+}
+
+func TestWorkQueueError(t *testing.T) {
+	for _, v := range ctors {
+		if !t.Run(v.s, func(t *testing.T) { testWorkQueueError(t, v.f) }) {
+			break
+		}
+	}
+}